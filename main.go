@@ -0,0 +1,11 @@
+// Command teeproxy is a reverse HTTP proxy that passes requests on to a
+// production target and mirrors them to an alternate one. It is a thin
+// wrapper of package teeproxy/proxy, which programs of their own can import
+// to run teeproxy with event hooks, see proxy.RegisterEventHook.
+package main
+
+import "teeproxy/proxy"
+
+func main() {
+	proxy.Main()
+}
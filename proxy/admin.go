@@ -0,0 +1,388 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// AdminHandler returns the administrative API of h, served on -admin.listen
+func AdminHandler(h handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			fmt.Fprintf(w, "%d sessions\n", h.SessionCache.ItemCount())
+		case "POST":
+			// Body is in the format of -sessions.file
+			n, err := LoadSessions(req.Body, h.SessionCache)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("loaded %d sessions: %v", n, err), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, "loaded %d sessions\n", n)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		production, alternate := h.Stats.InFlight()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"production_in_flight": production,
+			"alternate_pending":    alternate,
+		})
+	})
+	mux.HandleFunc("/alternate", func(w http.ResponseWriter, req *http.Request) {
+		if h.Alternatives == nil {
+			http.Error(w, "no -b.green target to switch to", http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case "GET":
+		case "POST":
+			changed, err := h.Alternatives.Switch(req.FormValue("target"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if changed {
+				// the mapped sessions belong to the target switched away from
+				h.SessionCache.Flush()
+				active, dialer := h.Alternatives.Active()
+				fmt.Printf("Switched alternate target to %s %s\n", active, strings.Join(dialer.Addresses, ", "))
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		active, _ := h.Alternatives.Active()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"active": active,
+			"blue":   h.Alternatives.Blue.Addresses,
+			"green":  h.Alternatives.Green.Addresses,
+		})
+	})
+	mux.HandleFunc("/faults", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+		case "POST":
+			if err := h.Faults.Update(req.URL.Query()); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			settings := h.Faults.Settings()
+			fmt.Printf("Injecting faults: delay of %v into %g%%, %d status for %g%% of the requests\n",
+				settings.Delay, settings.DelayPercent, settings.AbortStatus, settings.AbortPercent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		settings := h.Faults.Settings()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"delay":         settings.Delay.String(),
+			"delay_percent": settings.DelayPercent,
+			"abort_percent": settings.AbortPercent,
+			"abort_status":  settings.AbortStatus,
+		})
+	})
+	mux.HandleFunc("/log", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+		case "POST":
+			if name := req.FormValue("level"); name != "" {
+				level, err := ParseLogLevel(name)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				SetLogLevel(level)
+				fmt.Printf("Log level changed to %s\n", LogLevel())
+			}
+			if prefix := req.FormValue("route"); prefix != "" {
+				AddDebugRoute(prefix)
+				fmt.Printf("Logging requests to %s at debug level\n", prefix)
+			}
+		case "DELETE":
+			RemoveDebugRoute(req.FormValue("route"))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"level":        LogLevel(),
+			"debug_routes": DebugRoutes(),
+		})
+	})
+	mux.HandleFunc("/annotations", func(w http.ResponseWriter, req *http.Request) {
+		key := req.FormValue("key")
+		if key == "" {
+			if req.Method != "GET" {
+				http.Error(w, "key missing", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, "%d annotations\n", h.Annotations.Len())
+			return
+		}
+		switch req.Method {
+		case "GET":
+			value, ok := h.Annotations.Get(key)
+			if !ok {
+				http.Error(w, "no annotation "+key, http.StatusNotFound)
+				return
+			}
+			fmt.Fprintln(w, value)
+		case "POST":
+			h.Annotations.Set(key, req.FormValue("value"))
+		case "DELETE":
+			h.Annotations.Delete(key)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/samples", func(w http.ResponseWriter, req *http.Request) {
+		if h.Samples == nil {
+			http.Error(w, "no -samples percentage to sample", http.StatusNotFound)
+			return
+		}
+		h.Samples.ServeHTTP(w, req)
+	})
+	mux.HandleFunc("/responses", func(w http.ResponseWriter, req *http.Request) {
+		if h.Recent == nil {
+			http.Error(w, "no -b.keep responses to look up", http.StatusNotFound)
+			return
+		}
+		h.Recent.ServeHTTP(w, req)
+	})
+	mux.HandleFunc("/statuses", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		h.Stats.Statuses.Render(w)
+	})
+	mux.HandleFunc("/version", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Build())
+	})
+	mux.Handle("/metrics", MetricsHandler(h))
+	return mux
+}
+
+// MetricsHandler serves the metrics of h alone, on -metrics.listen
+func MetricsHandler(h handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w, h)
+	})
+	return mux
+}
+
+// WriteMetrics writes the metrics of h in the Prometheus text format, as
+// served on /metrics
+func WriteMetrics(w io.Writer, h handler) {
+	production, alternate := h.Stats.InFlight()
+	requests, skipped, hits, misses := h.Stats.Traffic()
+	fmt.Fprintln(w, "# HELP teeproxy_requests_total Requests received and passed on to production.")
+	fmt.Fprintln(w, "# TYPE teeproxy_requests_total counter")
+	fmt.Fprintln(w, "teeproxy_requests_total", requests)
+	fmt.Fprintln(w, "# HELP teeproxy_alternate_skipped_total Requests passed on to production without being mirrored.")
+	fmt.Fprintln(w, "# TYPE teeproxy_alternate_skipped_total counter")
+	fmt.Fprintln(w, "teeproxy_alternate_skipped_total", skipped)
+	fmt.Fprintln(w, "# HELP teeproxy_session_lookups_total Lookups of production sessions in the session cache, by result.")
+	fmt.Fprintln(w, "# TYPE teeproxy_session_lookups_total counter")
+	fmt.Fprintf(w, "teeproxy_session_lookups_total{result=\"hit\"} %d\n", hits)
+	fmt.Fprintf(w, "teeproxy_session_lookups_total{result=\"miss\"} %d\n", misses)
+	fmt.Fprintln(w, "# HELP teeproxy_production_in_flight Production requests being served.")
+	fmt.Fprintln(w, "# TYPE teeproxy_production_in_flight gauge")
+	fmt.Fprintln(w, "teeproxy_production_in_flight", production)
+	fmt.Fprintln(w, "# HELP teeproxy_alternate_pending Alternate requests not finished yet.")
+	fmt.Fprintln(w, "# TYPE teeproxy_alternate_pending gauge")
+	fmt.Fprintln(w, "teeproxy_alternate_pending", alternate)
+	fmt.Fprintln(w, "# HELP teeproxy_panics_total Panics recovered while serving or mirroring requests.")
+	fmt.Fprintln(w, "# TYPE teeproxy_panics_total counter")
+	fmt.Fprintln(w, "teeproxy_panics_total", h.Stats.Panics())
+	retries, hedges := h.Stats.Retries()
+	fmt.Fprintln(w, "# HELP teeproxy_alternate_retries_total Alternate requests sent again after a connection error.")
+	fmt.Fprintln(w, "# TYPE teeproxy_alternate_retries_total counter")
+	fmt.Fprintln(w, "teeproxy_alternate_retries_total", retries)
+	fmt.Fprintln(w, "# HELP teeproxy_alternate_hedges_total Alternate requests hedged with a second copy.")
+	fmt.Fprintln(w, "# TYPE teeproxy_alternate_hedges_total counter")
+	fmt.Fprintln(w, "teeproxy_alternate_hedges_total", hedges)
+	fmt.Fprintln(w, "# HELP teeproxy_cookie_leaks_suppressed_total Cookies set by the alternate target removed from responses to clients, always 0 unless there is a bug.")
+	fmt.Fprintln(w, "# TYPE teeproxy_cookie_leaks_suppressed_total counter")
+	fmt.Fprintln(w, "teeproxy_cookie_leaks_suppressed_total", h.Stats.CookieLeaks())
+
+	writeLabelCounters(w, "teeproxy_", "experiment", h.Stats.Experiments())
+	if tenants := h.Stats.Tenants(); len(tenants) > 0 {
+		writeLabelCounters(w, "teeproxy_tenant_", "tenant", tenants)
+	}
+	if probes := h.Stats.Probes(); len(probes) > 0 {
+		names := make([]string, 0, len(probes))
+		for name := range probes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintln(w, "# HELP teeproxy_probes_total Follow-up requests sent to the alternate target, by probe and result.")
+		fmt.Fprintln(w, "# TYPE teeproxy_probes_total counter")
+		for _, name := range names {
+			fmt.Fprintf(w, "teeproxy_probes_total{probe=%s,result=\"passed\"} %d\n", labelValue(name), probes[name].Passed)
+			fmt.Fprintf(w, "teeproxy_probes_total{probe=%s,result=\"failed\"} %d\n", labelValue(name), probes[name].Failed)
+		}
+	}
+	if stubbed := h.Stats.Stubbed(); len(stubbed) > 0 {
+		names := make([]string, 0, len(stubbed))
+		for name := range stubbed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintln(w, "# HELP teeproxy_stub_responses_total Requests answered by a stub of -stubs instead of production, by stub.")
+		fmt.Fprintln(w, "# TYPE teeproxy_stub_responses_total counter")
+		for _, name := range names {
+			fmt.Fprintf(w, "teeproxy_stub_responses_total{stub=%s} %d\n", labelValue(name), stubbed[name])
+		}
+	}
+	if versions := h.Stats.Versions(); len(versions) > 0 {
+		targets := make([]string, 0, len(versions))
+		for target := range versions {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		fmt.Fprintln(w, "# HELP teeproxy_build_info Last version a target reported in -version.header, by target: production, alternate or an experiment.")
+		fmt.Fprintln(w, "# TYPE teeproxy_build_info gauge")
+		for _, target := range targets {
+			fmt.Fprintf(w, "teeproxy_build_info{target=%s,version=%s} 1\n", labelValue(target), labelValue(versions[target]))
+		}
+	}
+	if *strict {
+		rejections := h.Stats.Rejections()
+		fmt.Fprintln(w, "# HELP teeproxy_rejected_requests_total Requests rejected by -strict before reaching either target, by reason.")
+		fmt.Fprintln(w, "# TYPE teeproxy_rejected_requests_total counter")
+		for _, reason := range []string{RejectEncoding, RejectHeaderBytes, RejectHeaderFields, RejectHost, RejectPath} {
+			fmt.Fprintf(w, "teeproxy_rejected_requests_total{reason=%s} %d\n", labelValue(reason), rejections[reason])
+		}
+	}
+	if fuzzed := h.Stats.Fuzzed(); len(fuzzed) > 0 {
+		mutations := make([]string, 0, len(fuzzed))
+		for mutation := range fuzzed {
+			mutations = append(mutations, mutation)
+		}
+		sort.Strings(mutations)
+		fmt.Fprintln(w, "# HELP teeproxy_fuzz_variants_total Mutated variants of mirrored requests sent to the alternate target, by mutation and result.")
+		fmt.Fprintln(w, "# TYPE teeproxy_fuzz_variants_total counter")
+		for _, mutation := range mutations {
+			f := fuzzed[mutation]
+			fmt.Fprintf(w, "teeproxy_fuzz_variants_total{mutation=%s,result=\"ok\"} %d\n", labelValue(mutation), f.Sent-f.Failures)
+			fmt.Fprintf(w, "teeproxy_fuzz_variants_total{mutation=%s,result=\"failed\"} %d\n", labelValue(mutation), f.Failures)
+		}
+	}
+	if fields := h.Stats.Fields(); len(fields) > 0 {
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintln(w, "# HELP teeproxy_field_comparisons_total Comparisons of the fields of -diff.field, by field and result.")
+		fmt.Fprintln(w, "# TYPE teeproxy_field_comparisons_total counter")
+		for _, name := range names {
+			fmt.Fprintf(w, "teeproxy_field_comparisons_total{field=%s,result=\"match\"} %d\n", labelValue(name), fields[name].Matches)
+			fmt.Fprintf(w, "teeproxy_field_comparisons_total{field=%s,result=\"mismatch\"} %d\n", labelValue(name), fields[name].Mismatches)
+		}
+	}
+	writeSLOMetrics(w, h.Stats.SLOs)
+	writeSelfMetrics(w, h)
+	h.Stats.ProductionLatencies.Write(w, "teeproxy_production_latency_seconds", "Latency of the production responses.")
+	h.Stats.AlternateLatencies.Write(w, "teeproxy_alternate_latency_seconds", "Latency of the alternate responses.")
+}
+
+// labelEscaper escapes label values the way the Prometheus text format wants
+// them, unlike %q, which also escapes tabs and runes outside ASCII like Go
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue returns value quoted as a label value of the text format
+func labelValue(value string) string {
+	return `"` + labelEscaper.Replace(strings.ToValidUTF8(value, "\uFFFD")) + `"`
+}
+
+// writeLabelCounters writes the counters of the mirrored requests by the
+// values of label and the version of the alternate target, with the metric
+// names starting with prefix. The version is empty without -version.header.
+func writeLabelCounters(w io.Writer, prefix, label string, counts map[LabelKey]LabelStats) {
+	keys := make([]LabelKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Label != keys[j].Label {
+			return keys[i].Label < keys[j].Label
+		}
+		return keys[i].Version < keys[j].Version
+	})
+	for _, metric := range []struct {
+		name, help string
+		value      func(LabelStats) int
+	}{
+		{"alternate_requests_total", "Requests mirrored", func(l LabelStats) int { return l.Requests }},
+		{"alternate_errors_total", "Mirrored requests that failed or were answered with a 5xx", func(l LabelStats) int { return l.Errors }},
+		{"compared_total", "Responses compared with production", func(l LabelStats) int { return l.Compared }},
+		{"mismatches_total", "Responses that differed from production, not counting the expected differences", func(l LabelStats) int { return l.Mismatches }},
+		{"expected_differences_total", "Responses that differed from production as declared by -diff.expected", func(l LabelStats) int { return l.Expected }},
+	} {
+		fmt.Fprintf(w, "# HELP %s%s %s, by %s and alternate version.\n", prefix, metric.name, metric.help, label)
+		fmt.Fprintf(w, "# TYPE %s%s counter\n", prefix, metric.name)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s{%s=%s,version=%s} %d\n", prefix, metric.name, label, labelValue(key.Label), labelValue(key.Version), metric.value(counts[key]))
+		}
+	}
+}
+
+// writeSelfMetrics writes the metrics of the state of teeproxy itself, for
+// capacity planning and leak detection
+func writeSelfMetrics(w io.Writer, h handler) {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	gauge := func(name, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP teeproxy_%s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE teeproxy_%s gauge\n", name)
+		fmt.Fprintf(w, "teeproxy_%s %v\n", name, value)
+	}
+	gauge("goroutines", "Goroutines that currently exist.", runtime.NumGoroutine())
+	gauge("heap_inuse_bytes", "Bytes in in-use heap spans.", memory.HeapInuse)
+	gauge("session_cache_entries", "Mapped sessions in the session cache.", h.SessionCache.ItemCount())
+	gauge("annotations", "Entries in the annotation store.", h.Annotations.Len())
+	if h.SessionOrder != nil {
+		gauge("ordered_sessions", "Sessions with mirrored requests lined up by -b.ordered.", h.SessionOrder.Len())
+	}
+
+	memoryBytes, mappedBytes := BufferedBytes()
+	fmt.Fprintln(w, "# HELP teeproxy_buffered_bytes Bytes of buffered response bodies, in memory or memory-mapped by -body.spill.")
+	fmt.Fprintln(w, "# TYPE teeproxy_buffered_bytes gauge")
+	fmt.Fprintf(w, "teeproxy_buffered_bytes{storage=\"memory\"} %d\n", memoryBytes)
+	fmt.Fprintf(w, "teeproxy_buffered_bytes{storage=\"mapped\"} %d\n", mappedBytes)
+
+	if *warmConns > 0 {
+		fmt.Fprintln(w, "# HELP teeproxy_warm_connections Connections dialed ahead and ready to be taken, by target.")
+		fmt.Fprintln(w, "# TYPE teeproxy_warm_connections gauge")
+		fmt.Fprintf(w, "teeproxy_warm_connections{target=\"production\"} %d\n", h.TargetDialer.Warm())
+		if h.Alternatives != nil {
+			fmt.Fprintf(w, "teeproxy_warm_connections{target=\"blue\"} %d\n", h.Alternatives.Blue.Warm())
+			fmt.Fprintf(w, "teeproxy_warm_connections{target=\"green\"} %d\n", h.Alternatives.Green.Warm())
+		} else {
+			fmt.Fprintf(w, "teeproxy_warm_connections{target=\"alternate\"} %d\n", h.AlternativeDialer.Warm())
+		}
+	}
+	fmt.Fprintln(w, "# HELP teeproxy_target_connections Connections open to the targets, in use or idle in the pools of -a.conn.pool and -b.conn.pool, by target.")
+	fmt.Fprintln(w, "# TYPE teeproxy_target_connections gauge")
+	fmt.Fprintf(w, "teeproxy_target_connections{target=\"production\"} %d\n", h.TargetDialer.Open())
+	if h.Alternatives != nil {
+		fmt.Fprintf(w, "teeproxy_target_connections{target=\"blue\"} %d\n", h.Alternatives.Blue.Open())
+		fmt.Fprintf(w, "teeproxy_target_connections{target=\"green\"} %d\n", h.Alternatives.Green.Open())
+	} else {
+		fmt.Fprintf(w, "teeproxy_target_connections{target=\"alternate\"} %d\n", h.AlternativeDialer.Open())
+	}
+}
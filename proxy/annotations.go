@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Annotations is a keyed store of values expiring after a TTL, like the
+// SessionCache for anything else worth correlating across requests, e.g.
+// the alternate id of an order created on production
+type Annotations struct {
+	cache *cache.Cache
+}
+
+// NewAnnotations returns an empty store whose values expire after ttl
+func NewAnnotations(ttl time.Duration) *Annotations {
+	return &Annotations{cache: cache.New(ttl, ttl)}
+}
+
+// Set stores value under key for the TTL of the store
+func (a *Annotations) Set(key, value string) {
+	a.cache.Set(key, value, cache.DefaultExpiration)
+}
+
+// Get returns the value stored under key, if it has not expired
+func (a *Annotations) Get(key string) (string, bool) {
+	value, ok := a.cache.Get(key)
+	if !ok {
+		return "", false
+	}
+	return value.(string), true
+}
+
+// Delete removes key
+func (a *Annotations) Delete(key string) {
+	a.cache.Delete(key)
+}
+
+// Len returns the number of values stored, including expired ones not
+// cleaned up yet
+func (a *Annotations) Len() int {
+	return a.cache.ItemCount()
+}
+
+// Funcs are the template functions reading and writing the store:
+// {{annotate "key" value}} stores value, formatted with fmt.Sprint, and
+// {{annotation "key"}} returns it, empty if there is none
+func (a *Annotations) Funcs() template.FuncMap {
+	return template.FuncMap{
+		"annotate": func(key string, value interface{}) string {
+			a.Set(key, fmt.Sprint(value))
+			return ""
+		},
+		"annotation": func(key string) string {
+			value, _ := a.Get(key)
+			return value
+		},
+	}
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchRequest is a request of a recording, kept to be sent again and again
+type benchRequest struct {
+	method string
+	uri    string
+	host   string
+	header http.Header
+	body   []byte
+}
+
+// LoadBenchRequests reads all requests of next into memory
+func LoadBenchRequests(next RequestReader) ([]benchRequest, error) {
+	var requests []benchRequest
+	for n := 1; ; n++ {
+		req, err := next()
+		if err == io.EOF {
+			return requests, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading request %d: %v", n, err)
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading request %d: %v", n, err)
+		}
+		RemoveHopHeaders(req.Header)
+		requests = append(requests, benchRequest{method: req.Method, uri: req.URL.RequestURI(), host: req.Host, header: req.Header, body: body})
+	}
+}
+
+// BenchStep is the result of sending requests at one rate
+type BenchStep struct {
+	Rate      float64 // requests per second
+	Sent      int
+	Completed int // answered, errors included
+	Errors    int // not answered or answered with a 5xx
+	Dropped   int // not sent, -concurrency requests were in flight
+	Elapsed   time.Duration
+
+	latencies []time.Duration // of the completed requests, sorted
+}
+
+// Throughput returns the requests completed per second
+func (s *BenchStep) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Completed) / s.Elapsed.Seconds()
+}
+
+// Percentile returns the latency p percent of the completed requests took
+// at most
+func (s *BenchStep) Percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(s.latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(s.latencies) {
+		i = len(s.latencies) - 1
+	}
+	return s.latencies[i]
+}
+
+// FailureRate returns the percentage of the requests due that failed or
+// were dropped
+func (s *BenchStep) FailureRate() float64 {
+	return percent(s.Errors+s.Dropped, s.Sent+s.Dropped)
+}
+
+// Bench sends the requests of a recording to Target in turn, starting over at
+// its end, at increasing rates
+type Bench struct {
+	Target      string // base URL
+	Requests    []benchRequest
+	Client      *http.Client
+	Concurrency int
+
+	next int // the request sent next
+}
+
+// Step sends requests at rate for duration and waits for the responses
+func (b *Bench) Step(rate float64, duration time.Duration) *BenchStep {
+	step := &BenchStep{Rate: rate}
+	interval := time.Duration(float64(time.Second) / rate)
+	var inFlight int64
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for at := start; at.Before(start.Add(duration)); at = at.Add(interval) {
+		time.Sleep(time.Until(at))
+		r := b.Requests[b.next]
+		b.next = (b.next + 1) % len(b.Requests)
+		if atomic.LoadInt64(&inFlight) >= int64(b.Concurrency) {
+			step.Dropped++
+			continue
+		}
+		step.Sent++
+		atomic.AddInt64(&inFlight, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer atomic.AddInt64(&inFlight, -1)
+			latency, err := b.send(r)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil || latency > 0 {
+				step.Completed++
+				step.latencies = append(step.latencies, latency)
+			}
+			if err != nil {
+				step.Errors++
+			}
+		}()
+	}
+	wg.Wait()
+	step.Elapsed = time.Since(start)
+	sort.Slice(step.latencies, func(i, j int) bool { return step.latencies[i] < step.latencies[j] })
+	return step
+}
+
+// send sends r and returns how long it took to be answered, with an error if
+// it failed or was answered with a 5xx
+func (b *Bench) send(r benchRequest) (time.Duration, error) {
+	req, err := http.NewRequest(r.method, b.Target+r.uri, bytes.NewReader(r.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header = r.header.Clone()
+	req.Host = r.host
+	start := time.Now()
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(start)
+	if resp.StatusCode >= 500 {
+		return latency, fmt.Errorf("status %s", resp.Status)
+	}
+	return latency, nil
+}
+
+// benchMain implements "teeproxy bench", a load test replaying a recording
+// against a target at increasing rates
+func benchMain(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := flags.String("target", "", "base URL of the target, like http://localhost:9000")
+	format := flags.String("format", "raw", "format of the recording: raw HTTP requests or gor for a GoReplay file")
+	rate := flags.Float64("rate", 10, "requests per second of the first step")
+	rateStep := flags.Float64("rate.step", 10, "requests per second added with every step")
+	rateMax := flags.Float64("rate.max", 100, "requests per second of the last step")
+	stepDuration := flags.Duration("step", 10*time.Second, "how long each rate is kept up")
+	concurrency := flags.Int("concurrency", 100, "most requests in flight, further ones are dropped")
+	timeout := flags.Duration("timeout", 10*time.Second, "how long a request may take")
+	stopErrors := flags.Float64("stop.errors", 5, "stop after a step in which more than this percentage of the requests failed or was dropped, 0 to run all steps")
+	insecure := flags.Bool("insecure", false, "don't verify the certificate of an https target")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: teeproxy bench -target URL [flags] recording")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *target == "" || (*format != "raw" && *format != "gor") || *rate <= 0 || *rateStep < 0 || *concurrency < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	recording, err := OpenPipe(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	requests := RawRequests(recording)
+	if *format == "gor" {
+		requests = GoReplayRequests(recording)
+	}
+	loaded, err := LoadBenchRequests(requests)
+	recording.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(loaded) == 0 {
+		fmt.Fprintf(os.Stderr, "no requests in %s\n", flags.Arg(0))
+		return 1
+	}
+
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: *concurrency,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: *insecure},
+	}
+	bench := &Bench{
+		Target:      strings.TrimSuffix(*target, "/"),
+		Requests:    loaded,
+		Client:      &http.Client{Transport: transport, Timeout: *timeout, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+		Concurrency: *concurrency,
+	}
+	fmt.Printf("Replaying %d requests of %s against %s\n", len(loaded), flags.Arg(0), bench.Target)
+	// steps are printed as they finish, so the columns have a fixed width
+	const columns = "%8s  %8s  %8s  %8s  %10s  %10s  %10s  %10s  %10s\n"
+	fmt.Printf(columns, "rate", "sent", "errors", "dropped", "throughput", "p50", "p95", "p99", "max")
+	for r := *rate; r <= *rateMax; r += *rateStep {
+		step := bench.Step(r, *stepDuration)
+		latency := func(p float64) string { return step.Percentile(p).Round(time.Microsecond).String() }
+		fmt.Printf(columns, fmt.Sprintf("%.0f/s", step.Rate), strconv.Itoa(step.Sent), strconv.Itoa(step.Errors), strconv.Itoa(step.Dropped),
+			fmt.Sprintf("%.1f/s", step.Throughput()), latency(50), latency(95), latency(99), latency(100))
+		if *stopErrors > 0 && step.FailureRate() > *stopErrors {
+			fmt.Printf("Stopped: %.1f%% of the requests failed or were dropped at %.0f/s\n", step.FailureRate(), r)
+			break
+		}
+		if *rateStep == 0 {
+			break
+		}
+	}
+	return 0
+}
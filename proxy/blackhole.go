@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BlackHole sends alternativeRequest without waiting for an answer, see
+// -b.blackhole: in mode discard to the target dialed by dialer, whose
+// connection is closed right after writing, in mode sink nowhere, it is only
+// written out in memory. Either measures what mirroring costs the proxy, and
+// the network with discard, before a real alternate system takes the load.
+func (h handler) BlackHole(ctx context.Context, dialer *Failover, timeout time.Duration, req *http.Request, alternativeRequest *http.Request) error {
+	if *altBlackHole == "sink" {
+		return alternativeRequest.Write(ioutil.Discard)
+	}
+	conn, address, err := dialer.DialContext(ctx, timeout)
+	if err != nil {
+		if debugging(req) {
+			fmt.Printf("Failed to connect to %s: %v\n", strings.Join(dialer.Addresses, ", "), err)
+		}
+		return err
+	}
+	defer conn.Close()
+	if dialer.Bandwidth != nil {
+		conn = dialer.Bandwidth.Conn(conn)
+	}
+	if err := alternativeRequest.Write(conn); err != nil {
+		if debugging(req) {
+			fmt.Printf("Failed to send to %s: %v\n", address, err)
+		}
+		return err
+	}
+	return nil
+}
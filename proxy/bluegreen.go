@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// BlueGreen holds two alternate targets of which one, blue unless switched,
+// receives the mirrored traffic
+type BlueGreen struct {
+	Blue  *Failover
+	Green *Failover
+
+	green int32 // accessed atomically, 1 while green is active
+}
+
+// Active returns the color and the dialer of the alternate target in use
+func (b *BlueGreen) Active() (string, *Failover) {
+	if atomic.LoadInt32(&b.green) == 1 {
+		return "green", b.Green
+	}
+	return "blue", b.Blue
+}
+
+// Switch makes the target of the given color the active one. It reports
+// whether that changed anything.
+func (b *BlueGreen) Switch(color string) (bool, error) {
+	switch color {
+	case "blue":
+		return atomic.SwapInt32(&b.green, 0) == 1, nil
+	case "green":
+		return atomic.SwapInt32(&b.green, 1) == 0, nil
+	}
+	return false, fmt.Errorf("unknown target %q, want blue or green", color)
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+)
+
+// How a client closed its connection, as seen by the guard of the connection
+const (
+	clientHalfClosed = "half-close" // the client shut down its sending side
+	clientReset      = "reset"      // the connection was reset or broke
+)
+
+// closeKind classifies the error a read from a client connection failed
+// with. Timeouts are not closes, net/http uses them to stop its own reads.
+func closeKind(err error) string {
+	if errors.Is(err, io.EOF) {
+		return clientHalfClosed
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ""
+	}
+	return clientReset
+}
+
+// ClientWatch passes on the client closing its connection while a request is
+// served to the exchange with the production target
+type ClientWatch struct {
+	cancel    context.CancelFunc
+	stop      chan struct{}
+	done      chan struct{}
+	cancelled int32
+	closed    int32 // the exchange was cancelled or conn half-closed
+
+	mu   sync.Mutex
+	conn net.Conn // to the target, once the exchange got one
+}
+
+// WatchClient watches the connection req came in on until Stop is called. A
+// half-close is passed on as one to the connection to the target, which the
+// exchange has to be traced for with Trace, so the target still answers a
+// client that only finished sending. A reset or other break cancels the
+// exchange with cancel, which closes the connection to the target, so
+// clients that gave up don't pin workers of the target.
+func WatchClient(req *http.Request, cancel context.CancelFunc) *ClientWatch {
+	w := &ClientWatch{cancel: cancel, stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		select {
+		case <-w.stop:
+			return
+		case <-req.Context().Done():
+		}
+		kind := ""
+		if g, ok := req.Context().Value(guardContextKey{}).(*guardConn); ok {
+			kind, _ = g.closed.Load().(string)
+		}
+		switch kind {
+		case clientHalfClosed:
+			w.mu.Lock()
+			atomic.StoreInt32(&w.closed, 1)
+			conn := w.conn
+			w.mu.Unlock()
+			if conn == nil || closeWrite(conn) == nil {
+				return // a connection got later is half-closed by Trace
+			}
+		case "":
+			return // not closed by the client, e.g. the server shutting down
+		}
+		w.abort()
+	}()
+	return w
+}
+
+// Trace returns ctx traced to pass the connection the exchange gets to w
+func (w *ClientWatch) Trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.conn = info.Conn
+		if w.Closed() && !w.Cancelled() && closeWrite(w.conn) != nil {
+			w.abort()
+		}
+	}})
+}
+
+// abort cancels the exchange for a client that went away
+func (w *ClientWatch) abort() {
+	atomic.StoreInt32(&w.cancelled, 1)
+	atomic.StoreInt32(&w.closed, 1)
+	w.cancel()
+}
+
+// Stop stops watching, it must be called once the exchange with the target
+// is over. A connection the watch half-closed is closed then, as it is unfit
+// for another request, otherwise it is left alone.
+func (w *ClientWatch) Stop() {
+	close(w.stop)
+	<-w.done
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.Closed() && w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+// Closed reports whether the watch cancelled the exchange or shut down the
+// sending side of its connection
+func (w *ClientWatch) Closed() bool {
+	return atomic.LoadInt32(&w.closed) == 1
+}
+
+// Cancelled reports whether the exchange was cancelled because the client
+// went away
+func (w *ClientWatch) Cancelled() bool {
+	return atomic.LoadInt32(&w.cancelled) == 1
+}
+
+// closeWrite shuts down the sending side of conn, looking through the
+// connections wrapping it
+func closeWrite(conn net.Conn) error {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite()
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return fmt.Errorf("can't half-close %T", conn)
+		}
+	}
+}
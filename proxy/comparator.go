@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExternalComparator hands the response pairs to a long running process,
+// so comparison logic can be written in any language. Each pair is written to
+// its stdin as one line of JSON, a Record whose diff holds the built-in
+// comparison; the process answers with one line of ComparatorVerdict JSON on
+// its stdout. Pairs are compared one after the other. A process that exits or
+// doesn't answer within Timeout is killed and started again for the next pair.
+type ExternalComparator struct {
+	Command []string
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// ComparatorVerdict is the answer of an external comparator to a pair
+type ComparatorVerdict struct {
+	Match  bool   `json:"match"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewExternalComparator returns a comparator running command, split at
+// spaces, and starts it
+func NewExternalComparator(command string, timeout time.Duration) (*ExternalComparator, error) {
+	c := &ExternalComparator{Command: strings.Fields(command), Timeout: timeout}
+	if len(c.Command) == 0 {
+		return nil, errors.New("empty comparator command")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c, c.start()
+}
+
+// start starts the process, c.mu must be held
+func (c *ExternalComparator) start() error {
+	cmd := exec.Command(c.Command[0], c.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	c.cmd, c.stdin, c.stdout = cmd, stdin, bufio.NewReader(stdout)
+	return nil
+}
+
+// stop kills the process, c.mu must be held
+func (c *ExternalComparator) stop() {
+	if c.cmd == nil {
+		return
+	}
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	c.cmd = nil
+}
+
+// Compare asks the process whether the responses of r match
+func (c *ExternalComparator) Compare(r *Record) (*ComparatorVerdict, error) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cmd == nil {
+		if err := c.start(); err != nil {
+			return nil, err
+		}
+	}
+	answers := make(chan []byte, 1)
+	failed := make(chan error, 1)
+	go func(stdin io.Writer, stdout *bufio.Reader) {
+		if _, err := stdin.Write(append(line, '\n')); err != nil {
+			failed <- err
+			return
+		}
+		answer, err := stdout.ReadBytes('\n')
+		if err != nil {
+			failed <- err
+			return
+		}
+		answers <- answer
+	}(c.stdin, c.stdout)
+
+	timer := time.NewTimer(c.Timeout)
+	defer timer.Stop()
+	select {
+	case answer := <-answers:
+		verdict := &ComparatorVerdict{}
+		if err := json.Unmarshal(answer, verdict); err != nil {
+			c.stop() // out of step with the pairs
+			return nil, fmt.Errorf("bad answer %q: %v", strings.TrimSpace(string(answer)), err)
+		}
+		return verdict, nil
+	case err := <-failed:
+		c.stop()
+		return nil, err
+	case <-timer.C:
+		c.stop()
+		return nil, fmt.Errorf("no answer within %s", c.Timeout)
+	}
+}
+
+// Close stops the process
+func (c *ExternalComparator) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stop()
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// CookieGuard keeps the cookies set by the alternate target out of the
+// responses to clients. It remembers the name=value pairs of the Set-Cookie
+// headers of the alternate responses; a pair in a response to a client that
+// the production target didn't set itself is a leak. Nothing should lead
+// there, the guard upholds the invariant should a bug do so.
+type CookieGuard struct {
+	seen *cache.Cache
+}
+
+// NewCookieGuard returns a guard remembering the alternate cookies for ttl,
+// as long as the sessions they belong to are kept
+func NewCookieGuard(ttl time.Duration) *CookieGuard {
+	return &CookieGuard{seen: cache.New(ttl, ttl)}
+}
+
+// cookiePair returns the name=value part of a Set-Cookie header value
+func cookiePair(setCookie string) string {
+	pair, _, _ := strings.Cut(setCookie, ";")
+	return strings.TrimSpace(pair)
+}
+
+// Observe remembers the cookies set by an alternate response; nothing for a
+// nil guard
+func (g *CookieGuard) Observe(header http.Header) {
+	if g == nil {
+		return
+	}
+	for _, setCookie := range header["Set-Cookie"] {
+		g.seen.SetDefault(cookiePair(setCookie), true)
+	}
+}
+
+// ObserveCookie remembers a cookie the alternate target issued otherwise,
+// e.g. in a login response
+func (g *CookieGuard) ObserveCookie(name, value string) {
+	if g == nil {
+		return
+	}
+	g.seen.SetDefault(name+"="+value, true)
+}
+
+// Suppress removes the Set-Cookie headers of the alternate target from
+// header, the response to a client, unless production set the same cookie
+// in its response with productionHeader. It returns how many it removed;
+// none for a nil guard.
+func (g *CookieGuard) Suppress(header, productionHeader http.Header) int {
+	if g == nil || len(header["Set-Cookie"]) == 0 {
+		return 0
+	}
+	production := map[string]bool{}
+	for _, setCookie := range productionHeader["Set-Cookie"] {
+		production[cookiePair(setCookie)] = true
+	}
+	var kept []string
+	suppressed := 0
+	for _, setCookie := range header["Set-Cookie"] {
+		pair := cookiePair(setCookie)
+		if _, alternate := g.seen.Get(pair); alternate && !production[pair] {
+			suppressed++
+			continue
+		}
+		kept = append(kept, setCookie)
+	}
+	if suppressed > 0 {
+		if len(kept) == 0 {
+			header.Del("Set-Cookie")
+		} else {
+			header["Set-Cookie"] = kept
+		}
+	}
+	return suppressed
+}
+
+// RewriteSetCookie rewrites the Domain and Path attributes of a Set-Cookie
+// header value. A domain of "-" drops the attribute so the cookie is bound to
+// the host the client talked to; an empty domain leaves it alone. Paths
+// starting with pathFrom get that prefix replaced by pathTo.
+func RewriteSetCookie(value, domain, pathFrom, pathTo string) string {
+	attrs := strings.Split(value, ";")
+	rewritten := attrs[:1]
+	for _, attr := range attrs[1:] {
+		name := strings.ToLower(strings.TrimSpace(attr))
+		switch {
+		case strings.HasPrefix(name, "domain=") && domain == "-":
+			continue
+		case strings.HasPrefix(name, "domain=") && domain != "":
+			attr = " Domain=" + domain
+		case strings.HasPrefix(name, "path=") && pathFrom != "":
+			path := strings.TrimSpace(attr)[len("path="):]
+			if strings.HasPrefix(path, pathFrom) {
+				attr = " Path=" + joinPath(pathTo, strings.TrimPrefix(path, pathFrom))
+			}
+		}
+		rewritten = append(rewritten, attr)
+	}
+	return strings.Join(rewritten, ";")
+}
+
+func joinPath(prefix, rest string) string {
+	if strings.HasSuffix(prefix, "/") && strings.HasPrefix(rest, "/") {
+		rest = rest[1:]
+	}
+	if prefix+rest == "" {
+		return "/"
+	}
+	return prefix + rest
+}
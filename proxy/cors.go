@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// IsPreflight reports whether req is a CORS pre-flight request
+func IsPreflight(req *http.Request) bool {
+	return req.Method == "OPTIONS" && req.Header.Get("Origin") != "" && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// corsOrigins returns the origins listed by -cors.origin, none for any
+func corsOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(*corsOrigin, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin answering origin, and
+// false if origin isn't one of -cors.origin. Any origin is allowed if none
+// are listed, which -cors.credentials doesn't allow.
+func allowOrigin(origin string) (string, bool) {
+	origins := corsOrigins()
+	if len(origins) == 0 {
+		return origin, true
+	}
+	for _, allowed := range origins {
+		if allowed == "*" || allowed == origin {
+			return allowed, true
+		}
+	}
+	return "", false
+}
+
+// AnswerPreflight answers a CORS pre-flight request with the headers
+// configured by the -cors flags, without involving either target. Origins
+// not allowed get an answer without them, which browsers refuse.
+func AnswerPreflight(w http.ResponseWriter, req *http.Request) {
+	w.Header().Add("Vary", "Origin")
+	origin, ok := allowOrigin(req.Header.Get("Origin"))
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	allowHeaders := *corsHeaders
+	if allowHeaders == "" {
+		allowHeaders = req.Header.Get("Access-Control-Request-Headers")
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Methods", *corsMethods)
+	if allowHeaders != "" {
+		w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+	}
+	if *corsCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if *corsMaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// CredentialMap maps production credentials to the shadow identities they
+// are replaced with on the mirrored leg, for alternate systems whose tokens
+// can't be minted or re-signed by teeproxy
+type CredentialMap struct {
+	Basic   map[string]string            // production user to alternate user:password
+	Bearer  map[string]string            // production token to alternate token
+	Headers map[string]map[string]string // by canonical header name
+	Query   map[string]map[string]string // by query parameter
+	Strip   bool                         // remove credentials without a mapping
+}
+
+// LoadCredentials reads a credential mapping. Each line maps one credential
+// as kind production alternate, where kind is basic, bearer, header:Name or
+// query:name. Basic credentials are mapped by user, production user or
+// user:password to alternate user:password. Empty lines and lines starting
+// with # are skipped.
+func LoadCredentials(r io.Reader) (*CredentialMap, error) {
+	m := &CredentialMap{
+		Basic:   map[string]string{},
+		Bearer:  map[string]string{},
+		Headers: map[string]map[string]string{},
+		Query:   map[string]map[string]string{},
+	}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want kind, production and alternate credential, got %q", line, text)
+		}
+		kind, production, alternate := fields[0], fields[1], fields[2]
+		switch {
+		case kind == "basic":
+			user, _, _ := strings.Cut(production, ":")
+			if !strings.Contains(alternate, ":") {
+				return nil, fmt.Errorf("line %d: want alternate user:password, got %q", line, alternate)
+			}
+			m.Basic[user] = alternate
+		case kind == "bearer":
+			m.Bearer[production] = alternate
+		case strings.HasPrefix(kind, "header:") && len(kind) > len("header:"):
+			name := http.CanonicalHeaderKey(strings.TrimPrefix(kind, "header:"))
+			if m.Headers[name] == nil {
+				m.Headers[name] = map[string]string{}
+			}
+			m.Headers[name][production] = alternate
+		case strings.HasPrefix(kind, "query:") && len(kind) > len("query:"):
+			name := strings.TrimPrefix(kind, "query:")
+			if m.Query[name] == nil {
+				m.Query[name] = map[string]string{}
+			}
+			m.Query[name][production] = alternate
+		default:
+			return nil, fmt.Errorf("line %d: want basic, bearer, header:Name or query:name, got %q", line, kind)
+		}
+	}
+	return m, scanner.Err()
+}
+
+// LoadCredentialsFile is LoadCredentials reading from the file at path
+func LoadCredentialsFile(path string) (*CredentialMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadCredentials(f)
+}
+
+// Map replaces the credentials of the alternative request with the mapped
+// shadow identities. Credentials without a mapping are kept, or removed with
+// Strip; it reports how many were left unmapped.
+func (m *CredentialMap) Map(alternativeRequest *http.Request) (unmapped int) {
+	if auth := alternativeRequest.Header.Get("Authorization"); auth != "" {
+		scheme, credential, _ := strings.Cut(auth, " ")
+		replacement, ok := "", false
+		switch {
+		case strings.EqualFold(scheme, "Bearer"):
+			var token string
+			token, ok = m.Bearer[strings.TrimSpace(credential)]
+			replacement = "Bearer " + token
+		case strings.EqualFold(scheme, "Basic"):
+			if user, _, basic := alternativeRequest.BasicAuth(); basic {
+				var userPassword string
+				userPassword, ok = m.Basic[user]
+				replacement = "Basic " + base64.StdEncoding.EncodeToString([]byte(userPassword))
+			}
+		}
+		m.replaceHeader(alternativeRequest.Header, "Authorization", replacement, ok, &unmapped)
+	}
+	for name, values := range m.Headers {
+		if value := alternativeRequest.Header.Get(name); value != "" {
+			replacement, ok := values[value]
+			m.replaceHeader(alternativeRequest.Header, name, replacement, ok, &unmapped)
+		}
+	}
+	if len(m.Query) == 0 {
+		return unmapped
+	}
+	query := alternativeRequest.URL.Query()
+	changed := false
+	for name, values := range m.Query {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		replacement, ok := values[value]
+		switch {
+		case ok:
+			query.Set(name, replacement)
+		case m.Strip:
+			unmapped++
+			query.Del(name)
+		default:
+			unmapped++
+			continue
+		}
+		changed = true
+	}
+	if changed {
+		alternativeRequest.URL.RawQuery = query.Encode()
+	}
+	return unmapped
+}
+
+// replaceHeader sets header name to replacement if it is mapped, otherwise
+// counts it as unmapped and removes it with Strip
+func (m *CredentialMap) replaceHeader(header http.Header, name, replacement string, mapped bool, unmapped *int) {
+	switch {
+	case mapped:
+		header.Set(name, replacement)
+	case m.Strip:
+		*unmapped++
+		header.Del(name)
+	default:
+		*unmapped++
+	}
+}
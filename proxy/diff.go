@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// Diff is the outcome of comparing the production and the alternate response to one request
+type Diff struct {
+	Time              time.Time `json:"time"`
+	Experiment        string    `json:"experiment,omitempty"` // empty for the -b target
+	Method            string    `json:"method"`
+	URL               string    `json:"url"`
+	Route             string    `json:"route"`
+	RequestKey        string    `json:"request_key"` // alike for identical logical requests, see RequestKey
+	ProductionStatus  int       `json:"production_status"`
+	AlternateStatus   int       `json:"alternate_status"`
+	ProductionVersion string    `json:"production_version,omitempty"`
+	AlternateVersion  string    `json:"alternate_version,omitempty"`
+
+	ProductionETag         string `json:"production_etag,omitempty"`
+	AlternateETag          string `json:"alternate_etag,omitempty"`
+	ProductionLastModified string `json:"production_last_modified,omitempty"`
+	AlternateLastModified  string `json:"alternate_last_modified,omitempty"`
+
+	StatusMatch bool `json:"status_match"`
+	BodyMatch   bool `json:"body_match"`
+
+	HeaderMismatches []string `json:"header_mismatches,omitempty"` // headers of -diff.header that differ
+	FieldMismatches  []string `json:"field_mismatches,omitempty"`  // fields of -diff.field that differ
+	ComparatorReason string   `json:"comparator_reason,omitempty"` // why the -diff.external comparator decided
+	Expected         string   `json:"expected,omitempty"`          // the expected difference of -diff.expected accepting a mismatch
+
+	AlternateAttempts int `json:"alternate_attempts,omitempty"` // set when retried or hedged, see -b.retries and -b.hedge
+}
+
+// Match reports whether the alternate response is considered equal to production
+func (d *Diff) Match() bool {
+	return d.StatusMatch && d.BodyMatch && len(d.HeaderMismatches) == 0
+}
+
+// Regression reports whether the alternate response differs from production
+// in a way not accepted by -diff.expected
+func (d *Diff) Regression() bool {
+	return !d.Match() && d.Expected == ""
+}
+
+// Compare builds the Diff of the two responses to req. The bodies are passed
+// separately because they have already been consumed from the responses; they
+// are not looked at if the ETags match with -diff.etag. Of the headers only
+// those of -diff.header are compared. JSON bodies that are equal once
+// normalized match, see JSONBodiesMatch, as do XML bodies that are the same
+// canonical document.
+func Compare(req *http.Request, production *http.Response, productionBody []byte, alternate *http.Response, alternateBody []byte) *Diff {
+	return &Diff{
+		Time:              time.Now(),
+		Method:            req.Method,
+		URL:               req.URL.String(),
+		Route:             Route(req),
+		RequestKey:        RequestKey(req),
+		ProductionStatus:  production.StatusCode,
+		AlternateStatus:   alternate.StatusCode,
+		ProductionVersion: BackendVersion(production),
+		AlternateVersion:  BackendVersion(alternate),
+
+		ProductionETag:         production.Header.Get("ETag"),
+		AlternateETag:          alternate.Header.Get("ETag"),
+		ProductionLastModified: production.Header.Get("Last-Modified"),
+		AlternateLastModified:  alternate.Header.Get("Last-Modified"),
+
+		StatusMatch:      production.StatusCode == alternate.StatusCode,
+		HeaderMismatches: CompareHeaders(diffHeaders, production.Header, alternate.Header),
+		BodyMatch: ETagsMatch(production, alternate) || bytes.Equal(productionBody, alternateBody) ||
+			JSONBodiesMatch(req, productionBody, alternateBody) ||
+			XMLBodiesMatch(production, productionBody, alternate, alternateBody),
+	}
+}
+
+// JSONBodiesMatch reports whether two JSON bodies of responses to req are
+// equal once normalized for the comparison: the fields ignored for req, by
+// -diff.openapi and by -graphql.ignore, are removed, the -diff.jq expressions
+// of the path of req are applied, and so are the -diff.normalize rules. Bodies that are not JSON, or that no ignored
+// field, jq expression or normalization rule applies to, don't match here;
+// they are compared byte by byte. Numbers are compared by their exact value.
+func JSONBodiesMatch(req *http.Request, production, alternate []byte) bool {
+	fields := append(append([][]string(nil), diffIgnore.Fields(req)...), graphqlIgnore.Fields(req)...)
+	if len(fields) == 0 && len(diffNormalize) == 0 && len(diffJQ) == 0 {
+		return false
+	}
+	p, err := decodeJSON(production)
+	if err != nil {
+		return false
+	}
+	a, err := decodeJSON(alternate)
+	if err != nil {
+		return false
+	}
+	for _, field := range fields {
+		p = removeField(p, field)
+		a = removeField(a, field)
+	}
+	if p, err = diffJQ.Apply(req.URL.Path, p); err != nil {
+		return false
+	}
+	if a, err = diffJQ.Apply(req.URL.Path, a); err != nil {
+		return false
+	}
+	p, a = diffNormalize.Apply(p, a)
+	return jsonEqual(p, a)
+}
+
+// decodeJSON decodes data with its numbers as json.Number, so large integers
+// like ids keep every digit instead of being rounded to a float64
+func decodeJSON(data []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("data after the JSON value")
+	}
+	return v, nil
+}
+
+// jsonEqual reports whether the decoded JSON values a and b are equal.
+// Numbers are equal if their values are, exactly, however they are written,
+// e.g. 1 and 1.0.
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		if b, ok := b.(json.Number); ok && a == b {
+			return true
+		}
+		return numbersEqual(a, b)
+	case float64:
+		return numbersEqual(a, b)
+	}
+	return a == b
+}
+
+// numbersEqual reports whether a and b are numbers of the same value
+func numbersEqual(a, b interface{}) bool {
+	x, ok := jsonNumber(a)
+	if !ok {
+		return false
+	}
+	y, ok := jsonNumber(b)
+	return ok && x.Cmp(y) == 0
+}
+
+// jsonNumber returns the value of a json.Number or float64, exactly
+func jsonNumber(v interface{}) (*big.Float, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, _, err := big.ParseFloat(string(n), 10, 1024, big.ToNearestEven)
+		return f, err == nil
+	case float64:
+		if math.IsNaN(n) {
+			return nil, false
+		}
+		return big.NewFloat(n), true
+	}
+	return nil, false
+}
+
+// ETagsMatch reports whether -diff.etag is set and both responses carry the
+// same ETag, so their bodies are the same without looking at them
+func ETagsMatch(production, alternate *http.Response) bool {
+	if !*diffETag {
+		return false
+	}
+	etag := production.Header.Get("ETag")
+	return etag != "" && etag == alternate.Header.Get("ETag")
+}
+
+// CompareHeaders returns the names of the headers that differ between
+// production and alternate, all their values considered in order
+func CompareHeaders(names []string, production, alternate http.Header) []string {
+	var mismatches []string
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if !reflect.DeepEqual(production.Values(name), alternate.Values(name)) {
+			mismatches = append(mismatches, name)
+		}
+	}
+	return mismatches
+}
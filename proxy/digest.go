@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	textTemplate "text/template"
+	"time"
+)
+
+// digestRoutes is how many of the most mismatching routes a digest lists
+const digestRoutes = 10
+
+// Digest summarizes the shadow results of one period, see -digest.interval
+type Digest struct {
+	Started  time.Time
+	Finished time.Time
+	Total    DigestRoute
+	Routes   []*DigestRoute // the most mismatching routes, most mismatches first
+}
+
+// DigestRoute are the results of the requests to one route
+type DigestRoute struct {
+	Route string
+	LabelStats
+
+	answered          int           // requests both targets answered
+	productionLatency time.Duration // summed over answered requests
+	alternateLatency  time.Duration // summed over answered requests
+}
+
+func (r *DigestRoute) add(o *Outcome) {
+	r.LabelStats.add(o)
+	if o.ProductionStatus != 0 && o.AlternateStatus != 0 {
+		r.answered++
+		r.productionLatency += o.ProductionLatency
+		r.alternateLatency += o.AlternateLatency
+	}
+}
+
+// MatchRate returns the percentage of the compared responses that matched,
+// leaving out the expected differences
+func (r *DigestRoute) MatchRate() float64 {
+	return percent(r.Compared-r.Expected-r.Mismatches, r.Compared-r.Expected)
+}
+
+// ErrorRate returns the percentage of the alternate requests that failed
+func (r *DigestRoute) ErrorRate() float64 {
+	return percent(r.Errors, r.Requests)
+}
+
+// LatencyDelta returns how much longer the alternate target took on average
+func (r *DigestRoute) LatencyDelta() time.Duration {
+	if r.answered == 0 {
+		return 0
+	}
+	return (r.alternateLatency - r.productionLatency) / time.Duration(r.answered)
+}
+
+// DigestCollector collects the outcomes of the current period
+type DigestCollector struct {
+	mu      sync.Mutex
+	started time.Time
+	total   DigestRoute
+	routes  map[string]*DigestRoute
+}
+
+// NewDigestCollector returns a collector whose first period starts now
+func NewDigestCollector() *DigestCollector {
+	return &DigestCollector{started: time.Now(), routes: map[string]*DigestRoute{}}
+}
+
+// Add accounts the outcome of a mirrored request; nothing for a nil collector.
+// Routes of experiments are prefixed with the experiment name.
+func (c *DigestCollector) Add(o *Outcome) {
+	if c == nil {
+		return
+	}
+	route := o.Route
+	if o.Experiment != defaultExperiment {
+		route = o.Experiment + ": " + route
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.routes[route]
+	if !ok {
+		if len(c.routes) >= maxStatusRoutes {
+			route = "other"
+			r = c.routes[route]
+		}
+		if r == nil {
+			r = &DigestRoute{Route: route}
+			c.routes[route] = r
+		}
+	}
+	r.add(o)
+	c.total.add(o)
+}
+
+// Rotate ends the current period, returning its digest, and starts the next
+func (c *DigestCollector) Rotate() *Digest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := &Digest{Started: c.started, Finished: time.Now(), Total: c.total}
+	d.Total.Route = "all"
+	for _, r := range c.routes {
+		if r.Mismatches > 0 || r.Errors > 0 {
+			d.Routes = append(d.Routes, r)
+		}
+	}
+	sort.Slice(d.Routes, func(i, j int) bool {
+		if d.Routes[i].Mismatches != d.Routes[j].Mismatches {
+			return d.Routes[i].Mismatches > d.Routes[j].Mismatches
+		}
+		return d.Routes[i].Errors > d.Routes[j].Errors
+	})
+	if len(d.Routes) > digestRoutes {
+		d.Routes = d.Routes[:digestRoutes]
+	}
+	c.started, c.total, c.routes = d.Finished, DigestRoute{}, map[string]*DigestRoute{}
+	return d
+}
+
+//go:embed assets/digest.html
+var digestHTML string
+
+//go:embed assets/digest.md
+var digestMarkdown string
+
+var (
+	htmlDigest     = template.Must(template.New("digest").Parse(digestHTML))
+	markdownDigest = textTemplate.Must(textTemplate.New("digest").Parse(digestMarkdown))
+)
+
+// Render writes the digest to w in format html or markdown
+func (d *Digest) Render(w io.Writer, format string) error {
+	if format == "markdown" {
+		return markdownDigest.Execute(w, d)
+	}
+	return htmlDigest.Execute(w, d)
+}
+
+// DigestSink delivers digests: written to a file in Dir, posted to Webhook,
+// or both
+type DigestSink struct {
+	Format  string // html or markdown
+	Dir     string
+	Webhook string
+}
+
+// Deliver renders d and delivers it
+func (s DigestSink) Deliver(d *Digest) error {
+	var out bytes.Buffer
+	if err := d.Render(&out, s.Format); err != nil {
+		return err
+	}
+	extension, contentType := ".html", "text/html; charset=utf-8"
+	if s.Format == "markdown" {
+		extension, contentType = ".md", "text/markdown; charset=utf-8"
+	}
+	if s.Dir != "" {
+		name := filepath.Join(s.Dir, "digest-"+d.Finished.Format("20060102-150405.000")+extension)
+		if err := ioutil.WriteFile(name, out.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	if s.Webhook == "" {
+		return nil
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(s.Webhook, contentType, &out)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// Run delivers the digest of c every interval
+func (s DigestSink) Run(c *DigestCollector, interval time.Duration) {
+	for range time.Tick(interval) {
+		s.Flush(c)
+	}
+}
+
+// Flush delivers the digest of the current period of c, logging failures
+func (s DigestSink) Flush(c *DigestCollector) {
+	d := c.Rotate()
+	if err := s.Deliver(d); err != nil {
+		fmt.Printf("Failed to deliver the digest of %s to %s: %v\n", d.Started.Format(time.RFC3339), d.Finished.Format(time.RFC3339), err)
+	}
+}
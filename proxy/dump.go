@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// DumpState writes a snapshot of the configuration and the runtime state of
+// h to w, for incidents where the admin API can't be reached
+func DumpState(w io.Writer, h handler) {
+	fmt.Fprintf(w, "State of teeproxy %s at %s\n", Build().Version, time.Now().Format(time.RFC3339))
+	fmt.Fprintln(w, "Flags:")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "  -%s=%s\n", f.Name, maskURL(f.Value.String()))
+	})
+
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	fmt.Fprintf(w, "Goroutines: %d, heap: %d bytes in use, GC cycles: %d\n", runtime.NumGoroutine(), memory.HeapInuse, memory.NumGC)
+	production, alternate := h.Stats.InFlight()
+	fmt.Fprintf(w, "In flight: %d production requests, %d alternate requests pending\n", production, alternate)
+	fmt.Fprintf(w, "Panics: %d\n", h.Stats.Panics())
+	memoryBytes, mappedBytes := BufferedBytes()
+	fmt.Fprintf(w, "Buffered bodies: %d bytes in memory, %d bytes mapped\n", memoryBytes, mappedBytes)
+	fmt.Fprintln(w, h.Stats.Summary())
+	fmt.Fprintf(w, "Session cache: %d sessions\n", h.SessionCache.ItemCount())
+	fmt.Fprintf(w, "Log level: %s, debug routes: %v\n", LogLevel(), DebugRoutes())
+
+	fmt.Fprintln(w, "Targets:")
+	dumpDialer(w, "production", h.TargetDialer)
+	if h.Alternatives != nil {
+		color, _ := h.Alternatives.Active()
+		fmt.Fprintf(w, "  active alternate: %s\n", color)
+		dumpDialer(w, "blue", h.Alternatives.Blue)
+		dumpDialer(w, "green", h.Alternatives.Green)
+	} else {
+		dumpDialer(w, "alternate", h.AlternativeDialer)
+	}
+	for _, e := range h.Experiments {
+		if e.Dialer != nil {
+			dumpDialer(w, "experiment "+e.Name, e.Dialer)
+		}
+	}
+}
+
+// maskURL returns value with the credentials it may carry masked if it is a
+// URL, like the webhooks and the Pushgateway of the flags: the password of
+// its user info, its query and, for HTTP URLs, which often take a token in
+// the path, its path
+func maskURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || !strings.Contains(value, "://") {
+		return value
+	}
+	masked := u.Scheme + "://"
+	if u.User != nil {
+		masked += u.User.Username()
+		if _, ok := u.User.Password(); ok {
+			masked += ":" + redactedValue
+		}
+		masked += "@"
+	}
+	path := u.EscapedPath()
+	if (u.Scheme == "http" || u.Scheme == "https") && strings.Trim(path, "/") != "" {
+		path = "/" + redactedValue
+	}
+	masked += u.Host + path
+	if u.RawQuery != "" {
+		masked += "?" + redactedValue
+	}
+	return masked
+}
+
+// dumpDialer writes the addresses of dialer and whether they are held down after failing
+func dumpDialer(w io.Writer, name string, dialer *Failover) {
+	if dialer == nil {
+		return
+	}
+	held := dialer.HeldDown()
+	for _, address := range dialer.Addresses {
+		if until, ok := held[address]; ok {
+			fmt.Fprintf(w, "  %s %s: down for %v\n", name, address, time.Until(until).Round(time.Millisecond))
+		} else {
+			fmt.Fprintf(w, "  %s %s: up\n", name, address)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package proxy
+
+import "os"
+
+// notifyDump does nothing where there is no SIGUSR1
+func notifyDump(c chan<- os.Signal) {}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package proxy
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDump relays SIGUSR1 to c
+func notifyDump(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// Event is what the proxy reports to the hooks registered with
+// RegisterEventHook: *RequestReceived, *ProductionDone, *AlternateDone or
+// *DiffComputed. The requests and diffs must not be modified by the hooks.
+type Event interface {
+	event()
+}
+
+// RequestReceived is emitted when a client request comes in
+type RequestReceived struct {
+	Time    time.Time
+	Request *http.Request
+}
+
+// ProductionDone is emitted once the production response has been passed on
+// to the client, or production failed with Err
+type ProductionDone struct {
+	Request *http.Request
+	Status  int // 0 if production failed
+	Latency time.Duration
+	Err     error
+}
+
+// AlternateDone is emitted once the alternate target answered, or failed with Err
+type AlternateDone struct {
+	Request    *http.Request
+	Experiment string
+	Address    string // the address dialed, empty if none could be
+	Status     int    // 0 if the alternate request failed
+	Latency    time.Duration
+	Err        error
+}
+
+// DiffComputed is emitted for every comparison of the two responses
+type DiffComputed struct {
+	Request *http.Request
+	Diff    *Diff
+}
+
+func (*RequestReceived) event() {}
+func (*ProductionDone) event()  {}
+func (*AlternateDone) event()   {}
+func (*DiffComputed) event()    {}
+
+var eventHooks []func(Event)
+
+// RegisterEventHook makes hook receive the events of every request, e.g. to
+// build custom analytics into a program of its own running teeproxy:
+//
+//	func main() {
+//		proxy.RegisterEventHook(func(e proxy.Event) { ... })
+//		proxy.Main()
+//	}
+//
+// Hooks are called synchronously from the request handling, so they must be
+// quick; EventChannel decouples a slow consumer. Hooks must be registered
+// before Main runs.
+func RegisterEventHook(hook func(Event)) {
+	eventHooks = append(eventHooks, hook)
+}
+
+// EventChannel returns a hook sending the events to c. Events are dropped
+// while c is full so a consumer falling behind doesn't slow down the proxy.
+func EventChannel(c chan<- Event) func(Event) {
+	return func(e Event) {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// emit passes e to the registered hooks
+func emit(e Event) {
+	for _, hook := range eventHooks {
+		hook(e)
+	}
+}
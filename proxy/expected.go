@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ExpectedDifference declares a difference between the targets that is known
+// and accepted, like the alternate target answering 404 for an endpoint it
+// deprecated. Mismatching responses to matching requests are counted as
+// expected differences instead of regressions and left out of the match rate.
+type ExpectedDifference struct {
+	Name             string `json:"name"`
+	Method           string `json:"method,omitempty"`            // method of the requests, all if empty
+	Path             string `json:"path"`                        // path prefix of the requests
+	ProductionStatus int    `json:"production_status,omitempty"` // status production answered with, any if 0
+	AlternateStatus  int    `json:"alternate_status,omitempty"`  // status the alternate target answered with, any if 0
+	Reason           string `json:"reason,omitempty"`            // why the difference is accepted, for the record
+}
+
+// ExpectedDifferences are the expected differences of -diff.expected, the
+// first matching one accepts a mismatch
+type ExpectedDifferences []*ExpectedDifference
+
+// LoadExpectedDifferences reads a JSON array of expected differences from path
+func LoadExpectedDifferences(path string) (ExpectedDifferences, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var differences ExpectedDifferences
+	if err := json.NewDecoder(f).Decode(&differences); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, e := range differences {
+		switch {
+		case e.Name == "":
+			return nil, fmt.Errorf("expected difference without a name")
+		case names[e.Name]:
+			return nil, fmt.Errorf("expected difference name %q is taken", e.Name)
+		case !strings.HasPrefix(e.Path, "/"):
+			return nil, fmt.Errorf("expected difference %s needs a path starting with /", e.Name)
+		}
+		names[e.Name] = true
+	}
+	return differences, nil
+}
+
+// Accepts returns the name of the first expected difference covering the
+// mismatch d of req, empty if there is none
+func (e ExpectedDifferences) Accepts(req *http.Request, d *Diff) string {
+	for _, difference := range e {
+		if (difference.Method == "" || strings.EqualFold(difference.Method, req.Method)) &&
+			strings.HasPrefix(req.URL.Path, difference.Path) &&
+			(difference.ProductionStatus == 0 || difference.ProductionStatus == d.ProductionStatus) &&
+			(difference.AlternateStatus == 0 || difference.AlternateStatus == d.AlternateStatus) {
+			return difference.Name
+		}
+	}
+	return ""
+}
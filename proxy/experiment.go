@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultExperiment labels the metrics of the traffic mirrored to -b
+const defaultExperiment = "default"
+
+// Experiment mirrors a sample of the requests matching its filter to a target
+// of its own, in addition to the -b target. Its diffs, records and metrics
+// are labeled with its name. Session cookies are passed on as received.
+type Experiment struct {
+	Name       string   `json:"name"`
+	Target     string   `json:"target"`               // comma separated addresses tried in order
+	Path       string   `json:"path,omitempty"`       // path prefix of the requests mirrored
+	Methods    []string `json:"methods,omitempty"`    // methods of the requests mirrored, all if empty
+	Operations []string `json:"operations,omitempty"` // operations of the -graphql endpoint mirrored, all if empty
+	Sample     float64  `json:"sample,omitempty"`     // percentage of the matching requests mirrored, all if 0
+	Timeout    string   `json:"timeout,omitempty"`    // replaces -b.timeout and -b.deadline, in seconds or as a duration
+	Debug      bool     `json:"debug,omitempty"`      // log every request mirrored to the target
+
+	Dialer  *Failover     `json:"-"`
+	timeout time.Duration // 0 unless Timeout is set
+}
+
+// AlternateTarget is a target of -b and its options
+type AlternateTarget struct {
+	Address string
+	Name    string        // label of its traffic, the address unless set
+	Timeout time.Duration // replaces -b.timeout and -b.deadline unless 0
+	Debug   bool          // log every request mirrored to it
+}
+
+// AlternateTargets are the targets of -b. Requests are mirrored to all of
+// them concurrently: to the first one as the alternate target, to the others
+// as experiments without a filter, labeled with their names.
+type AlternateTargets []*AlternateTarget
+
+func (t *AlternateTargets) String() string {
+	specs := make([]string, len(*t))
+	for i, target := range *t {
+		specs[i] = target.Address
+		if target.Name != target.Address {
+			specs[i] += ";name=" + target.Name
+		}
+		if target.Timeout > 0 {
+			specs[i] += ";timeout=" + target.Timeout.String()
+		}
+		if target.Debug {
+			specs[i] += ";debug"
+		}
+	}
+	return strings.Join(specs, ",")
+}
+
+// Set adds the comma separated targets of value, each an address optionally
+// followed by options, like localhost:8081;name=release-b;timeout=2s;debug
+func (t *AlternateTargets) Set(value string) error {
+	for _, spec := range strings.Split(value, ",") {
+		options := strings.Split(strings.TrimSpace(spec), ";")
+		target := &AlternateTarget{Address: options[0], Name: options[0]}
+		if target.Address == "" {
+			return fmt.Errorf("want an address, got %q", spec)
+		}
+		for _, option := range options[1:] {
+			key, value, _ := strings.Cut(option, "=")
+			var err error
+			switch key {
+			case "name":
+				target.Name = value
+			case "timeout":
+				target.Timeout, err = ParseTimeout(value)
+			case "debug":
+				target.Debug = true
+				if value != "" {
+					target.Debug, err = strconv.ParseBool(value)
+				}
+			default:
+				err = fmt.Errorf("unknown option %q, want name, timeout or debug", key)
+			}
+			if err != nil {
+				return fmt.Errorf("target %s: %v", target.Address, err)
+			}
+		}
+		if target.Name == "" || target.Name == defaultExperiment {
+			return fmt.Errorf("target %s: want a name other than %q", target.Address, target.Name)
+		}
+		*t = append(*t, target)
+	}
+	return nil
+}
+
+// Experiment returns an experiment mirroring all requests to t
+func (t *AlternateTarget) Experiment() *Experiment {
+	e := &Experiment{Name: t.Name, Target: t.Address, Debug: t.Debug, timeout: t.Timeout}
+	if t.Timeout > 0 {
+		e.Timeout = t.Timeout.String()
+	}
+	e.Dialer = newAlternativeDialer([]string{t.Address})
+	return e
+}
+
+// LoadExperiments reads a JSON array of experiments from path
+func LoadExperiments(path string) ([]*Experiment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var experiments []*Experiment
+	if err := json.NewDecoder(f).Decode(&experiments); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{defaultExperiment: true}
+	for _, e := range experiments {
+		switch {
+		case e.Name == "":
+			return nil, fmt.Errorf("experiment without a name")
+		case names[e.Name]:
+			return nil, fmt.Errorf("experiment name %q is taken", e.Name)
+		case e.Target == "":
+			return nil, fmt.Errorf("experiment %s has no target", e.Name)
+		case e.Sample < 0 || e.Sample > 100:
+			return nil, fmt.Errorf("experiment %s samples %v%%, want 0 to 100", e.Name, e.Sample)
+		}
+		if e.Timeout != "" {
+			if e.timeout, err = ParseTimeout(e.Timeout); err != nil {
+				return nil, fmt.Errorf("experiment %s: %v", e.Name, err)
+			}
+		}
+		names[e.Name] = true
+		e.Dialer = newAlternativeDialer(strings.Split(e.Target, ","))
+	}
+	return experiments, nil
+}
+
+// Selects reports whether req passes the filter of the experiment and is
+// sampled
+func (e *Experiment) Selects(req *http.Request) bool {
+	if !strings.HasPrefix(req.URL.Path, e.Path) {
+		return false
+	}
+	if len(e.Methods) > 0 {
+		allowed := false
+		for _, m := range e.Methods {
+			allowed = allowed || strings.EqualFold(m, req.Method)
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if len(e.Operations) > 0 {
+		operation := GraphQLOperation(req)
+		selected := false
+		for _, o := range e.Operations {
+			selected = selected || o == operation
+		}
+		if !selected {
+			return false
+		}
+	}
+	return e.Sample == 0 || rand.Float64()*100 < e.Sample
+}
+
+// copyRequest returns a copy of request, which must not have been sent yet,
+// with a body of its own
+func copyRequest(request *http.Request) *http.Request {
+	c := request.Clone(context.Background())
+	if request.GetBody != nil {
+		c.Body, _ = request.GetBody()
+	}
+	return c
+}
+
+// releaseAfter returns a func calling release on its n-th call
+func releaseAfter(n int, release func()) func() {
+	remaining := int32(n)
+	return func() {
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			release()
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MetricsExport hands the metrics of a run over to monitoring once it is
+// over, for runs too short to be scraped: written to File, e.g. for the
+// textfile collector of the node exporter, and pushed to the Prometheus
+// Pushgateway at Push, grouped by Job
+type MetricsExport struct {
+	File string
+	Push string // base URL of the Pushgateway
+	Job  string
+}
+
+// Export writes and pushes the metrics of h as they are now
+func (e MetricsExport) Export(h handler) error {
+	var metrics bytes.Buffer
+	WriteMetrics(&metrics, h)
+	if e.File != "" {
+		if err := e.write(metrics.Bytes()); err != nil {
+			return err
+		}
+	}
+	if e.Push != "" {
+		if err := e.push(metrics.Bytes()); err != nil {
+			return fmt.Errorf("pushing to %s: %v", e.Push, err)
+		}
+	}
+	return nil
+}
+
+// write replaces File, so collectors never read it half written
+func (e MetricsExport) write(metrics []byte) error {
+	temporary, err := ioutil.TempFile(filepath.Dir(e.File), filepath.Base(e.File)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name()) // if not renamed
+	_, err = temporary.Write(metrics)
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temporary.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(temporary.Name(), e.File)
+	}
+	return err
+}
+
+// push replaces the metrics of the job on the Pushgateway
+func (e MetricsExport) push(metrics []byte) error {
+	target := strings.TrimSuffix(e.Push, "/") + "/metrics/job/" + url.PathEscape(e.Job)
+	req, err := http.NewRequest(http.MethodPut, target, bytes.NewReader(metrics))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Failover dials the first reachable address of an ordered list. An address
+// that could not be dialed is skipped for Hold, unless all addresses are.
+type Failover struct {
+	Addresses []string
+	Hold      time.Duration
+	TLS       *tls.Config // nil for plain connections
+
+	MaxHeaderBytes  int64 // largest response header read, 0 for no limit
+	MaxHeaderFields int   // most response header fields accepted, 0 for no limit
+
+	IdleTimeout time.Duration // close connections idle for longer, 0 for no limit
+	MaxLifetime time.Duration // close connections older than this, 0 for no limit
+
+	// Settings of the transport of Exchange, read on its first use
+	DialTimeout   time.Duration // for each address, and the TLS handshake separately
+	HeaderTimeout time.Duration // wait for the response header once sent, 0 for no limit
+	MaxIdle       int           // idle connections kept open for reuse, 0 for none
+	IdleAge       time.Duration // close idle connections after this long, 0 for no limit
+	Bandwidth     *Bandwidth    // shapes the connections, nil for no shaping
+
+	mu        sync.Mutex
+	downUntil map[string]time.Time
+
+	warm   chan warmConn // nil unless Prewarm was called
+	taken  chan struct{}
+	maxAge time.Duration
+
+	once sync.Once
+	t    *http.Transport
+	open int64 // connections of t
+}
+
+// NewFailover returns a Failover over the given addresses in order of preference
+func NewFailover(hold time.Duration, addresses ...string) *Failover {
+	return &Failover{Addresses: addresses, Hold: hold, downUntil: map[string]time.Time{}}
+}
+
+// Dial connects to the first address that is not held down, trying the others
+// in order if that fails. It returns the address the connection is to. The
+// timeout applies to the TLS handshake separately.
+func (f *Failover) Dial(timeout time.Duration) (net.Conn, string, error) {
+	return f.DialContext(context.Background(), timeout)
+}
+
+// DialContext is like Dial, but gives up once ctx is done and sets the
+// deadline of ctx, if any, on the connection returned. Warm connections are
+// taken first. Requests are sent with Exchange instead, which reuses
+// connections.
+func (f *Failover) DialContext(ctx context.Context, timeout time.Duration) (net.Conn, string, error) {
+	conn, address, err := f.connect(ctx, timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, address, nil
+}
+
+// connect takes a warm connection, or dials one, and bounds it
+func (f *Failover) connect(ctx context.Context, timeout time.Duration) (net.Conn, string, error) {
+	conn, address, dialed, ok := f.takeWarm()
+	if !ok {
+		var err error
+		conn, address, err = f.dial(ctx, timeout)
+		if err != nil {
+			return nil, "", err
+		}
+		dialed = time.Now()
+	}
+	return f.bound(conn, dialed), address, nil
+}
+
+// dial connects to the first address that is not held down, handshaking TLS
+func (f *Failover) dial(ctx context.Context, timeout time.Duration) (net.Conn, string, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	var err error
+	for _, address := range f.candidates() {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+		if err == nil && f.TLS != nil {
+			conn, err = upstreamHandshake(conn, address, f.TLS, timeout)
+		}
+		if err == nil {
+			f.mark(address, time.Time{})
+			return conn, address, nil
+		}
+		if ctx.Err() != nil {
+			return nil, "", err // not the address' fault
+		}
+		if len(f.Addresses) > 1 {
+			f.mark(address, time.Now().Add(f.Hold))
+		}
+	}
+	return nil, "", err
+}
+
+// candidates are the addresses not held down, or all if every one is
+func (f *Failover) candidates() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	var up []string
+	for _, address := range f.Addresses {
+		if now.After(f.downUntil[address]) {
+			up = append(up, address)
+		}
+	}
+	if len(up) == 0 {
+		return f.Addresses
+	}
+	return up
+}
+
+func (f *Failover) mark(address string, downUntil time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if downUntil.IsZero() {
+		delete(f.downUntil, address)
+	} else {
+		f.downUntil[address] = downUntil
+	}
+}
+
+// Serves reports whether host, as found in a URL, is one of the addresses
+func (f *Failover) Serves(host string) bool {
+	for _, address := range f.Addresses {
+		if host == address {
+			return true
+		}
+	}
+	return false
+}
+
+// HeldDown returns the addresses currently skipped and until when
+func (f *Failover) HeldDown() map[string]time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	held := map[string]time.Time{}
+	for address, until := range f.downUntil {
+		if now.Before(until) {
+			held[address] = until
+		}
+	}
+	return held
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FaultSettings are the faults injected into the production path
+type FaultSettings struct {
+	Delay        time.Duration // added to DelayPercent of the requests
+	DelayPercent float64
+	AbortPercent float64 // of the requests answered with AbortStatus instead of being passed on
+	AbortStatus  int
+}
+
+// Validate checks the percentages and the abort status
+func (s FaultSettings) Validate() error {
+	if s.DelayPercent < 0 || s.DelayPercent > 100 || s.AbortPercent < 0 || s.AbortPercent > 100 {
+		return fmt.Errorf("percentages must be between 0 and 100")
+	}
+	if s.AbortStatus < 100 || s.AbortStatus > 599 {
+		return fmt.Errorf("abort status %d is no status code", s.AbortStatus)
+	}
+	return nil
+}
+
+// Faults injects failures into the production path, turning the proxied
+// traffic into a resilience test of the clients. The settings can be changed
+// while serving.
+type Faults struct {
+	mu       sync.Mutex
+	settings FaultSettings
+}
+
+// NewFaults returns Faults injecting those of settings
+func NewFaults(settings FaultSettings) *Faults {
+	return &Faults{settings: settings}
+}
+
+// Settings returns the faults currently injected
+func (f *Faults) Settings() FaultSettings {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.settings
+}
+
+// Update changes the settings given in values as delay, delay.percent,
+// abort.percent and abort.status, leaving the others as they are
+func (f *Faults) Update(values url.Values) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	settings := f.settings
+	var err error
+	if v := values.Get("delay"); v != "" {
+		if settings.Delay, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("delay: %v", err)
+		}
+	}
+	for name, percent := range map[string]*float64{"delay.percent": &settings.DelayPercent, "abort.percent": &settings.AbortPercent} {
+		if v := values.Get(name); v != "" {
+			if *percent, err = strconv.ParseFloat(v, 64); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	if v := values.Get("abort.status"); v != "" {
+		if settings.AbortStatus, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("abort.status: %v", err)
+		}
+	}
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	f.settings = settings
+	return nil
+}
+
+// Inject delays the request or answers it with the abort status, as chosen
+// at random by the settings. It returns true if the request was answered.
+func (f *Faults) Inject(w http.ResponseWriter) bool {
+	settings := f.Settings()
+	if settings.AbortPercent > 0 && rand.Float64()*100 < settings.AbortPercent {
+		http.Error(w, "injected fault", settings.AbortStatus)
+		return true
+	}
+	if settings.DelayPercent > 0 && rand.Float64()*100 < settings.DelayPercent {
+		time.Sleep(settings.Delay)
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// FieldRule compares one field of the JSON responses, selected by a JSONPath
+// of the form $.order.total_price, $.items[0].id, $.items[*].price or
+// $['odd key']. Its matches are counted on /metrics, giving a field level
+// view of the shadow quality.
+type FieldRule struct {
+	Name string
+	Path string
+
+	steps []string // keys, indexes and * for all elements
+}
+
+// FieldRules is a flag of name=JSONPath rules, e.g. total_price=$.order.total_price
+type FieldRules []*FieldRule
+
+func (r *FieldRules) String() string {
+	rules := make([]string, len(*r))
+	for i, rule := range *r {
+		rules[i] = rule.Name + "=" + rule.Path
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *FieldRules) Set(value string) error {
+	name, path, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("want name=$.json.path, got %q", value)
+	}
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, &FieldRule{Name: name, Path: path, steps: steps})
+	return nil
+}
+
+// parseJSONPath splits a JSONPath into its steps
+func parseJSONPath(path string) ([]string, error) {
+	rest := strings.TrimSpace(path)
+	if !strings.HasPrefix(rest, "$") {
+		return nil, fmt.Errorf("JSONPath %q must start with $", path)
+	}
+	rest = rest[1:]
+	var steps []string
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q: unterminated ['", path)
+			}
+			steps = append(steps, rest[2:end])
+			rest = rest[end+2:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q: unterminated [", path)
+			}
+			index := rest[1:end]
+			if _, err := strconv.Atoi(index); err != nil && index != "*" {
+				return nil, fmt.Errorf("JSONPath %q: want an index or *, got [%s]", path, index)
+			}
+			steps = append(steps, index)
+			rest = rest[end+1:]
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("JSONPath %q: empty key", path)
+			}
+			steps = append(steps, key)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("JSONPath %q: unexpected %q", path, rest)
+		}
+	}
+	return steps, nil
+}
+
+// Extract returns the values the path selects in the decoded JSON v
+func (r *FieldRule) Extract(v interface{}) []interface{} {
+	values := []interface{}{v}
+	for _, step := range r.steps {
+		var next []interface{}
+		for _, value := range values {
+			switch node := value.(type) {
+			case map[string]interface{}:
+				if child, ok := node[step]; ok {
+					next = append(next, child)
+				}
+			case []interface{}:
+				if step == "*" {
+					next = append(next, node...)
+				} else if i, err := strconv.Atoi(step); err == nil && i >= 0 && i < len(node) {
+					next = append(next, node[i])
+				}
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+// CompareFields compares the fields of the rules in the JSON bodies, once
+// -diff.normalize is applied, and counts the results in stats. It returns
+// the names of the fields that differ. Fields missing from both bodies are
+// not counted.
+func CompareFields(rules FieldRules, stats *RunStats, productionBody, alternateBody []byte) []string {
+	production, alternate := diffNormalize.Apply(jsonBody(productionBody), jsonBody(alternateBody))
+	var mismatches []string
+	for _, rule := range rules {
+		p, a := rule.Extract(production), rule.Extract(alternate)
+		if len(p) == 0 && len(a) == 0 {
+			continue
+		}
+		match := reflect.DeepEqual(p, a)
+		stats.Field(rule.Name, match)
+		if !match {
+			mismatches = append(mismatches, rule.Name)
+		}
+	}
+	return mismatches
+}
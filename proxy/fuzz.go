@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fuzzValues are the boundary values put into query parameters and headers
+var fuzzValues = []string{"", "0", "-1", "2147483648", "-9223372036854775809", "1e309", "NaN", "null", "true", "[]", "%", "\u00ff\u202e", strings.Repeat("A", 8192)}
+
+// fuzzJSONValues are the boundary values put into the fields of JSON bodies
+var fuzzJSONValues = []interface{}{nil, "", json.Number("0"), json.Number("-1"), json.Number("9223372036854775808"), json.Number("1e308"), true, []interface{}{}, map[string]interface{}{}, strings.Repeat("A", 8192)}
+
+// Fuzzer follows a sample of the mirrored requests with mutated variants sent
+// to the alternate target only: headers and query parameters with boundary
+// values, JSON bodies with a field replaced by one of another type or size,
+// and truncated bodies. The variants the alternate target fails on, with a
+// 5xx or no response, are findings, written as JSON lines to Out to
+// reproduce them with.
+type Fuzzer struct {
+	Percent  float64
+	Variants int // per request
+	Out      io.Writer
+
+	mu sync.Mutex // of Out
+}
+
+// FuzzFinding is a variant the alternate target failed on
+type FuzzFinding struct {
+	Time     time.Time   `json:"time"`
+	Mutation string      `json:"mutation"` // header, query, json or truncate
+	Detail   string      `json:"detail"`   // what was mutated
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Header   http.Header `json:"header"`
+	Body     string      `json:"body,omitempty"`
+	Status   int         `json:"status,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// Sampled reports whether req is to be followed by variants; false for a nil
+// Fuzzer
+func (f *Fuzzer) Sampled(req *http.Request) bool {
+	return f != nil && rand.Float64()*100 < f.Percent
+}
+
+// Run sends the variants of alternativeRequest, with body, to the target
+// dialed by dialer, one after the other, each within deadline, and counts
+// their results in stats
+func (f *Fuzzer) Run(dialer *Failover, timeout, deadline time.Duration, stats *RunStats, req *http.Request, alternativeRequest *http.Request, body []byte) {
+	for i := 0; i < f.Variants; i++ {
+		variant, variantBody, mutation, detail := mutate(alternativeRequest, body)
+		status, err := f.send(dialer, timeout, deadline, variant, variantBody)
+		failed := err != nil || status >= 500
+		stats.Fuzz(mutation, failed)
+		if !failed {
+			continue
+		}
+		if debugging(req) {
+			fmt.Printf("Alternate target failed on %s %s fuzzed by %s %s: status %d, %v\n", req.Method, req.URL, mutation, detail, status, err)
+		}
+		finding := &FuzzFinding{Time: time.Now(), Mutation: mutation, Detail: detail, Method: variant.Method, URL: variant.URL.String(), Header: RedactHeader(variant.Header), Body: string(variantBody), Status: status}
+		if err != nil {
+			finding.Error = err.Error()
+		}
+		f.write(finding)
+	}
+}
+
+func (f *Fuzzer) send(dialer *Failover, timeout, deadline time.Duration, variant *http.Request, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	// a connection of its own, written to as is: the transport would refuse
+	// some mutations, and a mutated request may leave the target out of step
+	conn, _, err := dialer.DialContext(ctx, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	variant.Body, variant.ContentLength = ioutil.NopCloser(bytes.NewReader(body)), int64(len(body))
+	if err := variant.Write(conn); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), variant)
+	if err != nil {
+		return 0, err
+	}
+	DrainBody(resp.Body)
+	if err := dialer.checkHeaderFields(resp); err != nil {
+		return 0, err
+	}
+	return resp.StatusCode, nil
+}
+
+func (f *Fuzzer) write(finding *FuzzFinding) {
+	if f.Out == nil {
+		return
+	}
+	line, err := json.Marshal(finding)
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Out.Write(append(line, '\n'))
+}
+
+// mutate returns a variant of req with one mutation picked at random of the
+// ones that apply to it, its body, the kind of mutation and what it mutated
+func mutate(req *http.Request, body []byte) (*http.Request, []byte, string, string) {
+	variant := req.Clone(context.Background())
+	variant.Body = nil
+	variant.Header.Del("Content-Length") // of the body sent
+	fields := jsonFields(body)
+	kinds := []string{"header"}
+	if len(variant.URL.Query()) > 0 {
+		kinds = append(kinds, "query")
+	}
+	if fields != nil {
+		kinds = append(kinds, "json")
+	}
+	if len(body) > 1 {
+		kinds = append(kinds, "truncate")
+	}
+	switch kind := kinds[rand.Intn(len(kinds))]; kind {
+	case "query":
+		query := variant.URL.Query()
+		names := make([]string, 0, len(query))
+		for name := range query {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		name, value := names[rand.Intn(len(names))], fuzzValues[rand.Intn(len(fuzzValues))]
+		query.Set(name, value)
+		variant.URL.RawQuery = query.Encode()
+		return variant, body, kind, name + "=" + abbreviate(value)
+	case "json":
+		field, value := fields[rand.Intn(len(fields))], fuzzJSONValues[rand.Intn(len(fuzzJSONValues))]
+		root := field(value)
+		if mutated, err := json.Marshal(root); err == nil {
+			encoded, _ := json.Marshal(value)
+			return variant, mutated, kind, "field set to " + abbreviate(string(encoded))
+		}
+	case "truncate":
+		cut := rand.Intn(len(body)-1) + 1
+		return variant, body[:cut], kind, strconv.Itoa(cut) + " of " + strconv.Itoa(len(body)) + " bytes"
+	}
+	names := []string{"X-Fuzz"}
+	for name := range variant.Header {
+		if name != "Host" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	name, value := names[rand.Intn(len(names))], fuzzValues[rand.Intn(len(fuzzValues))]
+	variant.Header.Set(name, value)
+	return variant, body, "header", name + ": " + abbreviate(value)
+}
+
+// jsonFields decodes a JSON body and returns a setter for each of its leaf
+// values. A setter replaces the value and returns the decoded body, with
+// only that value replaced. Nil if body isn't JSON with leaf values.
+func jsonFields(body []byte) []func(interface{}) interface{} {
+	decode := func() interface{} {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var v interface{}
+		if decoder.Decode(&v) != nil {
+			return nil
+		}
+		return v
+	}
+	root := decode()
+	if root == nil {
+		return nil
+	}
+	// leaves are addressed by their path of keys and indexes, each setter
+	// works on a fresh copy of the body
+	var fields []func(interface{}) interface{}
+	var walk func(v interface{}, path []interface{})
+	walk = func(v interface{}, path []interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, value := range v {
+				walk(value, append(path[:len(path):len(path)], key))
+			}
+			return
+		case []interface{}:
+			for i, value := range v {
+				walk(value, append(path[:len(path):len(path)], i))
+			}
+			return
+		}
+		if len(path) == 0 {
+			return // a bare value
+		}
+		fields = append(fields, func(value interface{}) interface{} {
+			copied := decode()
+			parent := copied
+			for _, step := range path[:len(path)-1] {
+				parent = jsonChild(parent, step)
+			}
+			switch last := path[len(path)-1].(type) {
+			case string:
+				parent.(map[string]interface{})[last] = value
+			case int:
+				parent.([]interface{})[last] = value
+			}
+			return copied
+		})
+	}
+	walk(root, nil)
+	return fields
+}
+
+func jsonChild(v interface{}, step interface{}) interface{} {
+	if key, ok := step.(string); ok {
+		return v.(map[string]interface{})[key]
+	}
+	return v.([]interface{})[step.(int)]
+}
+
+// abbreviate shortens long values in the details of findings
+func abbreviate(value string) string {
+	if len(value) > 32 {
+		return fmt.Sprintf("%s... (%d bytes)", value[:16], len(value))
+	}
+	return value
+}
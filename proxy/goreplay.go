@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// GoReplay (gor) files hold payloads, each a header line of type, id,
+// timestamp and latency followed by a raw HTTP message, separated by the
+// monkeys below. Requests, the original responses and the replayed
+// responses have the types 1, 2 and 3.
+const goReplaySeparator = "\n\U0001F435\U0001F648\U0001F649\n"
+
+func init() {
+	RegisterRecordStore("gor", OpenGoReplayStore)
+}
+
+// GoReplayStore writes records as GoReplay file payloads, the production
+// response as the original and the alternate response as the replayed one,
+// so recordings can be used with the gor middlewares and emitters
+type GoReplayStore struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenGoReplayStore opens the GoReplayStore at the path of location, e.g. gor:///var/lib/teeproxy/requests.gor
+func OpenGoReplayStore(location *url.URL) (RecordStore, error) {
+	f, err := os.OpenFile(sqlitePath(location), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &GoReplayStore{file: f}, nil
+}
+
+func (s *GoReplayStore) Store(r *Record) error {
+	id := make([]byte, 12)
+	rand.Read(id)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "1 %s %d -1\n", hex.EncodeToString(id), r.Time.UnixNano())
+	writeRawRequest(&buf, &r.Request)
+	buf.WriteString(goReplaySeparator)
+	for i, resp := range []*RecordedResponse{r.Production, r.Alternate} {
+		if resp == nil {
+			continue
+		}
+		fmt.Fprintf(&buf, "%d %s %d %d\n", i+2, hex.EncodeToString(id), r.Time.Add(resp.Latency).UnixNano(), resp.Latency.Nanoseconds())
+		writeRawResponse(&buf, r.Request.Method, resp)
+		buf.WriteString(goReplaySeparator)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.file.Write(buf.Bytes())
+	return err
+}
+
+func (s *GoReplayStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+func writeRawRequest(w io.Writer, r *RecordedRequest) {
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\nHost: %s\r\n", r.Method, r.URL, r.Host)
+	header := r.Header.Clone()
+	header.Del("Host")
+	header.Del("Transfer-Encoding") // the body was recorded decoded
+	if len(r.Body) > 0 {
+		header.Set("Content-Length", strconv.Itoa(len(r.Body)))
+	}
+	header.Write(w)
+	io.WriteString(w, "\r\n")
+	w.Write(r.Body)
+}
+
+func writeRawResponse(w io.Writer, method string, r *RecordedResponse) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", r.Status, http.StatusText(r.Status))
+	header := r.Header.Clone()
+	header.Del("Transfer-Encoding")
+	if BodyAllowed(method, r.Status) {
+		header.Set("Content-Length", strconv.Itoa(len(r.Body)))
+	}
+	header.Write(w)
+	io.WriteString(w, "\r\n")
+	w.Write(r.Body)
+}
+
+// GoReplayRequests returns the requests of the GoReplay file read from r,
+// skipping the responses
+func GoReplayRequests(r io.Reader) RequestReader {
+	lines := bufio.NewReader(r)
+	return func() (*http.Request, error) {
+		for {
+			var payload []byte
+			for {
+				line, err := lines.ReadBytes('\n')
+				payload = append(payload, line...)
+				if bytes.HasSuffix(payload, []byte(goReplaySeparator)) {
+					payload = payload[:len(payload)-len(goReplaySeparator)]
+					break
+				}
+				if err == io.EOF && len(bytes.TrimSpace(payload)) == 0 {
+					return nil, io.EOF
+				}
+				if err != nil {
+					return nil, fmt.Errorf("incomplete payload: %v", err)
+				}
+			}
+			meta, message, _ := bytes.Cut(payload, []byte("\n"))
+			if !bytes.HasPrefix(meta, []byte("1 ")) {
+				continue
+			}
+			return http.ReadRequest(bufio.NewReader(bytes.NewReader(message)))
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// graphQLRequest is the part of a GraphQL request needed to name its operation
+type graphQLRequest struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+	Extensions    struct {
+		PersistedQuery struct {
+			Sha256Hash string `json:"sha256Hash"`
+		} `json:"persistedQuery"`
+	} `json:"extensions"`
+}
+
+// graphQLOperationPattern finds the type and name of the first operation
+// defined in a query document
+var graphQLOperationPattern = regexp.MustCompile(`^\s*(query|mutation|subscription)\s*([_A-Za-z][_0-9A-Za-z]*)?`)
+
+// name returns the operation name of the request, as given or defined in
+// the query, or "anonymous" for shorthand and unnamed operations
+func (r graphQLRequest) name() string {
+	if r.OperationName != "" {
+		return r.OperationName
+	}
+	if r.Query == "" {
+		r.Query = graphqlQueries[r.Extensions.PersistedQuery.Sha256Hash]
+	}
+	if m := graphQLOperationPattern.FindStringSubmatch(r.Query); m != nil && m[2] != "" {
+		return m[2]
+	}
+	return "anonymous"
+}
+
+// GraphQLOperation returns the name of the operation requested from the
+// -graphql endpoint, or "" for other requests. Batches are named by their
+// operations joined with "+". The body is read through req.GetBody, so it
+// must have been duplicated before.
+func GraphQLOperation(req *http.Request) string {
+	if *graphqlPath == "" || req.URL.Path != *graphqlPath {
+		return ""
+	}
+	if req.Method == http.MethodGet {
+		query := req.URL.Query()
+		r := graphQLRequest{Query: query.Get("query"), OperationName: query.Get("operationName")}
+		json.Unmarshal([]byte(query.Get("extensions")), &r.Extensions)
+		return r.name()
+	}
+	if req.GetBody == nil {
+		return ""
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return ""
+	}
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	var single graphQLRequest
+	if json.Unmarshal(data, &single) == nil {
+		return single.name()
+	}
+	var batch []graphQLRequest
+	if json.Unmarshal(data, &batch) != nil || len(batch) == 0 {
+		return ""
+	}
+	names := make([]string, len(batch))
+	for i, r := range batch {
+		names[i] = r.name()
+	}
+	return strings.Join(names, "+")
+}
+
+// Route names the route of req results and metrics are grouped by: its
+// method and path, followed by the operation for the -graphql endpoint
+func Route(req *http.Request) string {
+	route := req.Method + " " + req.URL.Path
+	if operation := GraphQLOperation(req); operation != "" {
+		route += " " + operation
+	}
+	return route
+}
+
+// GraphQLSamples is a flag of operation=percent, the percentage of the
+// requests of a GraphQL operation that are mirrored. The operation *
+// applies to all others, which are mirrored completely if it's not given.
+type GraphQLSamples map[string]float64
+
+func (s GraphQLSamples) String() string {
+	samples := make([]string, 0, len(s))
+	for operation, percent := range s {
+		samples = append(samples, operation+"="+strconv.FormatFloat(percent, 'f', -1, 64))
+	}
+	return strings.Join(samples, ",")
+}
+
+func (s GraphQLSamples) Set(value string) error {
+	operation, v, ok := strings.Cut(value, "=")
+	percent, err := strconv.ParseFloat(v, 64)
+	if !ok || operation == "" || err != nil || percent < 0 || percent > 100 {
+		return fmt.Errorf("want operation=percent from 0 to 100, got %q", value)
+	}
+	s[operation] = percent
+	return nil
+}
+
+// Sampled reports whether a request of operation is mirrored
+func (s GraphQLSamples) Sampled(operation string) bool {
+	percent, ok := s[operation]
+	if !ok {
+		if percent, ok = s["*"]; !ok {
+			return true
+		}
+	}
+	return rand.Float64()*100 < percent
+}
+
+// GraphQLIgnoreRules is a flag of operation=$.json.path, fields of the
+// responses of a GraphQL operation, or * for all, that are left out when
+// comparing them. The paths are made of keys and [*].
+type GraphQLIgnoreRules map[string][][]string
+
+func (r GraphQLIgnoreRules) String() string {
+	rules := make([]string, 0, len(r))
+	for operation, fields := range r {
+		for _, field := range fields {
+			rules = append(rules, operation+"=$."+strings.Join(field, "."))
+		}
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r GraphQLIgnoreRules) Set(value string) error {
+	operation, path, ok := strings.Cut(value, "=")
+	if !ok || operation == "" {
+		return fmt.Errorf("want operation=$.json.path, got %q", value)
+	}
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		return fmt.Errorf("ignoring the whole response of %s, want a field", operation)
+	}
+	field := make([]string, len(steps))
+	for i, step := range steps {
+		if step == "*" {
+			step = "[]"
+		}
+		field[i] = step
+	}
+	r[operation] = append(r[operation], field)
+	return nil
+}
+
+// Fields returns the fields ignored in responses to req
+func (r GraphQLIgnoreRules) Fields(req *http.Request) [][]string {
+	if len(r) == 0 {
+		return nil
+	}
+	operation := GraphQLOperation(req)
+	if operation == "" {
+		return nil
+	}
+	fields := append([][]string(nil), r["*"]...)
+	for _, name := range strings.Split(operation, "+") {
+		fields = append(fields, r[name]...)
+	}
+	return fields
+}
+
+// PersistedQueries maps the SHA-256 hashes of persisted GraphQL queries to
+// the queries
+type PersistedQueries map[string]string
+
+// LoadPersistedQueries reads a persisted query manifest, either in the
+// format of Apollo, with operations of an id and a body, or a JSON object of
+// hashes and queries as used by Relay
+func LoadPersistedQueries(path string) (PersistedQueries, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	queries := PersistedQueries{}
+	var manifest struct {
+		Operations []struct {
+			ID   string `json:"id"`
+			Body string `json:"body"`
+		} `json:"operations"`
+	}
+	if json.Unmarshal(data, &manifest) == nil && len(manifest.Operations) > 0 {
+		for _, operation := range manifest.Operations {
+			queries[operation.ID] = operation.Body
+		}
+		return queries, nil
+	}
+	if err := json.Unmarshal(data, &queries); err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no queries in %s", path)
+	}
+	return queries, nil
+}
+
+// Expand replaces the hashes of persisted queries known to the manifest by
+// the queries in req to the -graphql endpoint, which is about to be sent to
+// the alternate target, as that may not share the persisted query cache.
+// The persistedQuery extension is removed from expanded requests.
+func (q PersistedQueries) Expand(req *http.Request) {
+	if *graphqlPath == "" || req.URL.Path != *graphqlPath {
+		return
+	}
+	if req.Method == http.MethodGet {
+		query := req.URL.Query()
+		var extensions map[string]interface{}
+		if query.Get("query") != "" || json.Unmarshal([]byte(query.Get("extensions")), &extensions) != nil {
+			return
+		}
+		r := map[string]interface{}{"extensions": extensions}
+		if !q.expand(r) {
+			return
+		}
+		query.Set("query", r["query"].(string))
+		if extensions, ok := r["extensions"]; ok {
+			encoded, _ := json.Marshal(extensions)
+			query.Set("extensions", string(encoded))
+		} else {
+			query.Del("extensions")
+		}
+		req.URL.RawQuery = query.Encode()
+		return
+	}
+	if req.Body == nil {
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	changed := false
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			changed = q.expand(v)
+		case []interface{}:
+			for _, r := range v {
+				if r, ok := r.(map[string]interface{}); ok && q.expand(r) {
+					changed = true
+				}
+			}
+		}
+	}
+	if changed {
+		body, _ = json.Marshal(v)
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+}
+
+// expand adds the query to a decoded GraphQL request without one and reports
+// whether it did
+func (q PersistedQueries) expand(r map[string]interface{}) bool {
+	if query, _ := r["query"].(string); query != "" {
+		return false
+	}
+	extensions, _ := r["extensions"].(map[string]interface{})
+	persisted, _ := extensions["persistedQuery"].(map[string]interface{})
+	hash, _ := persisted["sha256Hash"].(string)
+	query, ok := q[hash]
+	if !ok {
+		return false
+	}
+	r["query"] = query
+	delete(extensions, "persistedQuery")
+	if len(extensions) == 0 {
+		delete(r, "extensions")
+	}
+	return true
+}
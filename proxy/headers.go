@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// HeaderRule sets a header on the responses to requests whose path starts
+// with Prefix. An empty Value removes the header.
+type HeaderRule struct {
+	Prefix string
+	Name   string
+	Value  string
+}
+
+// HeaderRules is a repeatable [/prefix=]Name: value command line flag. All
+// matching rules apply, in order.
+type HeaderRules []HeaderRule
+
+func (r *HeaderRules) String() string {
+	rules := make([]string, len(*r))
+	for i, rule := range *r {
+		rules[i] = rule.Name + ": " + rule.Value
+		if rule.Prefix != "/" {
+			rules[i] = rule.Prefix + "=" + rules[i]
+		}
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *HeaderRules) Set(value string) error {
+	prefix := "/"
+	if strings.HasPrefix(value, "/") {
+		var ok bool
+		prefix, value, ok = strings.Cut(value, "=")
+		if !ok {
+			return fmt.Errorf("want [/path/prefix=]Name: value, got %q", value)
+		}
+	}
+	name, v, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("want [/path/prefix=]Name: value, got %q", value)
+	}
+	*r = append(*r, HeaderRule{Prefix: prefix, Name: name, Value: strings.TrimSpace(v)})
+	return nil
+}
+
+// Apply sets the headers of the rules matching path
+func (r HeaderRules) Apply(path string, header http.Header) {
+	for _, rule := range r {
+		if !strings.HasPrefix(path, rule.Prefix) {
+			continue
+		}
+		if rule.Value == "" {
+			header.Del(rule.Name)
+		} else {
+			header.Set(rule.Name, rule.Value)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the latency histograms
+// unless -metrics.buckets is set, those of the Prometheus client libraries
+var DefaultBuckets = Buckets{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Buckets are ascending upper bounds in seconds, set as a comma separated list
+type Buckets []float64
+
+func (b *Buckets) String() string {
+	bounds := make([]string, len(*b))
+	for i, bound := range *b {
+		bounds[i] = strconv.FormatFloat(bound, 'g', -1, 64)
+	}
+	return strings.Join(bounds, ",")
+}
+
+func (b *Buckets) Set(value string) error {
+	var bounds Buckets
+	for _, s := range strings.Split(value, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || bound <= 0 {
+			return fmt.Errorf("want positive seconds, got %q", s)
+		}
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	*b = bounds
+	return nil
+}
+
+// Histogram counts latencies into buckets for the /metrics endpoint
+type Histogram struct {
+	bounds Buckets
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+}
+
+// NewHistogram returns an empty Histogram with the given bucket bounds
+func NewHistogram(bounds Buckets) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe counts a latency
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(h.bounds, seconds) // the first bound >= seconds
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += seconds
+	h.mu.Unlock()
+}
+
+// Write writes the histogram as metric name in the Prometheus text format
+func (h *Histogram) Write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum := h.sum
+	h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	cumulative += counts[len(h.bounds)]
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %g\n", name, sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, cumulative)
+}
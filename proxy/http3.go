@@ -0,0 +1,30 @@
+//go:build http3
+
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// ListenHTTP3 serves handler over HTTP/3 on the UDP address addr, with the
+// certificates of config. Requests are mirrored like the ones of the TCP
+// listener, toward the targets they are HTTP/1.1.
+func ListenHTTP3(addr string, config *tls.Config, handler http.Handler) (io.Closer, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(config)}
+	go func() {
+		if err := server.Serve(conn); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("Failed to serve HTTP/3 on %s: %v\n", addr, err)
+		}
+	}()
+	return server, nil
+}
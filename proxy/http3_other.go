@@ -0,0 +1,15 @@
+//go:build !http3
+
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// ListenHTTP3 fails, QUIC support is only built in with the http3 tag
+func ListenHTTP3(addr string, config *tls.Config, handler http.Handler) (io.Closer, error) {
+	return nil, errors.New("teeproxy was built without HTTP/3 support, build it with -tags http3")
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// idKeyPrefix prefixes the production ids in the annotation store
+const idKeyPrefix = "id:"
+
+// IDRule extracts the id of a resource created by a matching request from
+// both responses, so the production id can be translated to the alternate
+// one in the requests that follow. The id is taken from the JSON field at
+// the dotted path JSON of the body, or from the first group of Regexp
+// matched against the body or, if Header is set, that header.
+type IDRule struct {
+	Name   string `json:"name"`
+	Method string `json:"method,omitempty"` // method of the creating requests, all if empty
+	Path   string `json:"path,omitempty"`   // path prefix of the creating requests
+	JSON   string `json:"json,omitempty"`   // e.g. data.order.id or items.0.id
+	Header string `json:"header,omitempty"` // e.g. Location
+	Regexp string `json:"regexp,omitempty"` // e.g. /orders/([0-9]+)$
+
+	regexp *regexp.Regexp
+}
+
+// LoadIDRules reads a JSON array of ID rules from path
+func LoadIDRules(path string) ([]*IDRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []*IDRule
+	if err := json.NewDecoder(f).Decode(&rules); err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		switch {
+		case r.Name == "":
+			return nil, fmt.Errorf("id rule without a name")
+		case r.JSON == "" && r.Regexp == "":
+			return nil, fmt.Errorf("id rule %s has neither json nor regexp", r.Name)
+		case r.Regexp != "":
+			if r.regexp, err = regexp.Compile(r.Regexp); err != nil {
+				return nil, fmt.Errorf("id rule %s: %v", r.Name, err)
+			}
+			if r.regexp.NumSubexp() < 1 {
+				return nil, fmt.Errorf("id rule %s: regexp has no group", r.Name)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Matches reports whether the rule applies to the responses to req
+func (r *IDRule) Matches(req *http.Request) bool {
+	return (r.Method == "" || strings.EqualFold(r.Method, req.Method)) && strings.HasPrefix(req.URL.Path, r.Path)
+}
+
+// Extract returns the id in the response, empty if there is none
+func (r *IDRule) Extract(header http.Header, body []byte) string {
+	if r.regexp != nil {
+		text := body
+		if r.Header != "" {
+			text = []byte(header.Get(r.Header))
+		}
+		if m := r.regexp.FindSubmatch(text); m != nil {
+			return string(m[1])
+		}
+		return ""
+	}
+	v := jsonBody(body)
+	for _, field := range strings.Split(r.JSON, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[field]
+		case []interface{}:
+			i, err := strconv.Atoi(field)
+			if err != nil || i < 0 || i >= len(node) {
+				return ""
+			}
+			v = node[i]
+		default:
+			return ""
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// LearnIDs stores the translation of the production ids extracted by the
+// rules matching req to the alternate ones in annotations
+func LearnIDs(rules []*IDRule, annotations *Annotations, req *http.Request, production *http.Response, productionBody []byte, alternate *http.Response, alternateBody []byte) {
+	for _, r := range rules {
+		if !r.Matches(req) {
+			continue
+		}
+		productionID, alternateID := r.Extract(production.Header, productionBody), r.Extract(alternate.Header, alternateBody)
+		if productionID == "" || alternateID == "" {
+			if debugging(req) {
+				fmt.Printf("ID rule %s found no id in the responses to %s %s\n", r.Name, req.Method, req.URL)
+			}
+			continue
+		}
+		if productionID != alternateID {
+			annotations.Set(idKeyPrefix+productionID, alternateID)
+		}
+	}
+}
+
+// TranslateIDs replaces the production ids known to annotations by their
+// alternate ids in the path segments, query values and JSON body of req,
+// which is about to be sent to the alternate target
+func TranslateIDs(annotations *Annotations, req *http.Request) {
+	translate := func(id string) (string, bool) {
+		if id == "" {
+			return "", false
+		}
+		return annotations.Get(idKeyPrefix + id)
+	}
+
+	segments := strings.Split(req.URL.Path, "/")
+	changed := false
+	for i, s := range segments {
+		if t, ok := translate(s); ok {
+			segments[i], changed = t, true
+		}
+	}
+	if changed {
+		req.URL.Path = strings.Join(segments, "/")
+		req.URL.RawPath = ""
+	}
+	if req.URL.RawQuery != "" {
+		query := req.URL.Query()
+		changed = false
+		for _, values := range query {
+			for i, v := range values {
+				if t, ok := translate(v); ok {
+					values[i], changed = t, true
+				}
+			}
+		}
+		if changed {
+			req.URL.RawQuery = query.Encode()
+		}
+	}
+
+	if req.Body == nil || !strings.Contains(req.Header.Get("Content-Type"), "json") {
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil && translateJSON(v, translate) {
+		body, _ = json.Marshal(v)
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+}
+
+// translateJSON replaces the ids in the string and number values of v and
+// reports whether it did. Numbers stay numbers if their translation is one.
+func translateJSON(v interface{}, translate func(string) (string, bool)) bool {
+	changed := false
+	replace := func(value interface{}) (interface{}, bool) {
+		switch value := value.(type) {
+		case string:
+			if t, ok := translate(value); ok {
+				return t, true
+			}
+		case float64:
+			if t, ok := translate(strconv.FormatFloat(value, 'f', -1, 64)); ok {
+				if n, err := strconv.ParseFloat(t, 64); err == nil {
+					return n, true
+				}
+				return t, true
+			}
+		default:
+			return value, translateJSON(value, translate)
+		}
+		return value, false
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			var ok bool
+			v[k], ok = replace(value)
+			changed = changed || ok
+		}
+	case []interface{}:
+		for i, value := range v {
+			var ok bool
+			v[i], ok = replace(value)
+			changed = changed || ok
+		}
+	}
+	return changed
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/itchyny/gojq"
+)
+
+// JQ is a compiled jq expression, run by gojq, for declarative transforms of
+// JSON bodies without a scripting plugin. Expressions get neither the
+// environment nor further inputs.
+//
+// Values are decoded JSON, with float64 or json.Number numbers; they are
+// not modified. Numbers jq computes come back as float64, or as json.Number
+// if a float64 can't hold them exactly.
+type JQ struct {
+	Source string
+
+	code *gojq.Code
+}
+
+// ParseJQ compiles a jq expression
+func ParseJQ(source string) (*JQ, error) {
+	query, err := gojq.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("jq %q: %v", source, err)
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return nil, fmt.Errorf("jq %q: %v", source, err)
+	}
+	return &JQ{Source: source, code: code}, nil
+}
+
+// Run returns the outputs of the expression for the input v
+func (q *JQ) Run(v interface{}) ([]interface{}, error) {
+	var outputs []interface{}
+	iter := q.code.Run(v)
+	for {
+		output, ok := iter.Next()
+		if !ok {
+			return outputs, nil
+		}
+		if err, ok := output.(error); ok {
+			return nil, fmt.Errorf("jq %q: %v", q.Source, err)
+		}
+		output, _ = jqValue(output)
+		outputs = append(outputs, output)
+	}
+}
+
+// RunOne returns the single output of the expression for the input v
+func (q *JQ) RunOne(v interface{}) (interface{}, error) {
+	outputs, err := q.Run(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(outputs) != 1 {
+		return nil, fmt.Errorf("jq %q gave %d results, want 1", q.Source, len(outputs))
+	}
+	return outputs[0], nil
+}
+
+// jqValue returns v with the ints and *big.Ints gojq computes turned into
+// the numbers of decoded JSON, and whether any was. Arrays and objects are
+// copied only if they change, as they may be part of the input.
+func jqValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case int:
+		if v >= -1<<53 && v <= 1<<53 {
+			return float64(v), true
+		}
+		return json.Number(strconv.Itoa(v)), true
+	case *big.Int:
+		return json.Number(v.String()), true
+	case []interface{}:
+		var c []interface{}
+		for i, e := range v {
+			if e, changed := jqValue(e); changed {
+				if c == nil {
+					c = append([]interface{}(nil), v...)
+				}
+				c[i] = e
+			}
+		}
+		if c == nil {
+			return v, false
+		}
+		return c, true
+	case map[string]interface{}:
+		var c map[string]interface{}
+		for k, e := range v {
+			if e, changed := jqValue(e); changed {
+				if c == nil {
+					c = make(map[string]interface{}, len(v))
+					for k, e := range v {
+						c[k] = e
+					}
+				}
+				c[k] = e
+			}
+		}
+		if c == nil {
+			return v, false
+		}
+		return c, true
+	}
+	return v, false
+}
+
+// JQRule applies a jq expression to the bodies of responses to requests to
+// paths starting with Prefix
+type JQRule struct {
+	Prefix string
+	*JQ
+}
+
+// JQRules is a repeatable /prefix=expression command line flag
+type JQRules []JQRule
+
+func (r *JQRules) String() string {
+	rules := make([]string, len(*r))
+	for i, rule := range *r {
+		rules[i] = rule.Prefix + "=" + rule.Source
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *JQRules) Set(value string) error {
+	prefix, source, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("want /path/prefix=jq expression, got %q", value)
+	}
+	q, err := ParseJQ(source)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, JQRule{Prefix: prefix, JQ: q})
+	return nil
+}
+
+// Apply runs the expressions of the rules matching path on the decoded JSON
+// v, one after the other in the order they were given
+func (r JQRules) Apply(path string, v interface{}) (interface{}, error) {
+	for _, rule := range r {
+		if !strings.HasPrefix(path, rule.Prefix) {
+			continue
+		}
+		var err error
+		if v, err = rule.RunOne(v); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
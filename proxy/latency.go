@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxBaselineRoutes bounds the routes LatencyFloor learns a baseline for,
+// further routes are only held to the configured floor
+const maxBaselineRoutes = 1000
+
+// LatencyFloor holds back responses that would be faster than a floor, so
+// clients don't adapt to timings that changed during an experiment, e.g.
+// because of stubs or caching in front of production. The floor is the
+// configured one of the route or, with Baseline, the median production
+// latency of the first Baseline requests of the route, whichever is longer.
+type LatencyFloor struct {
+	Floor    time.Duration
+	Routes   RouteRules // floors overriding Floor by path prefix
+	Baseline int        // production latencies of a route its baseline is learned from, 0 for none
+
+	mu        sync.Mutex
+	baselines map[string]*routeBaseline
+}
+
+// routeBaseline is the baseline of a route, learned once all samples are in
+type routeBaseline struct {
+	samples []time.Duration
+	median  time.Duration
+}
+
+// NewLatencyFloor returns a LatencyFloor, nil if it holds back nothing
+func NewLatencyFloor(floor time.Duration, routes RouteRules, baseline int) *LatencyFloor {
+	if floor <= 0 && len(routes) == 0 && baseline <= 0 {
+		return nil
+	}
+	return &LatencyFloor{Floor: floor, Routes: routes, Baseline: baseline, baselines: map[string]*routeBaseline{}}
+}
+
+// Learn adds the latency production answered a request of route with to the
+// baseline of the route, if it is still being learned; nothing for a nil
+// LatencyFloor
+func (f *LatencyFloor) Learn(route string, latency time.Duration) {
+	if f == nil || f.Baseline <= 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.baselines[route]
+	if !ok {
+		if len(f.baselines) >= maxBaselineRoutes {
+			return
+		}
+		b = &routeBaseline{}
+		f.baselines[route] = b
+	}
+	if b.median > 0 {
+		return
+	}
+	b.samples = append(b.samples, latency)
+	if len(b.samples) == f.Baseline {
+		sort.Slice(b.samples, func(i, j int) bool { return b.samples[i] < b.samples[j] })
+		b.median = b.samples[len(b.samples)/2]
+		b.samples = nil
+	}
+}
+
+// Of returns the floor of req
+func (f *LatencyFloor) Of(req *http.Request) time.Duration {
+	floor := f.Floor
+	if t, ok := f.Routes.Lookup(req.URL.Path); ok {
+		floor, _ = time.ParseDuration(t)
+	}
+	if f.Baseline > 0 {
+		f.mu.Lock()
+		if b, ok := f.baselines[Route(req)]; ok && b.median > floor {
+			floor = b.median
+		}
+		f.mu.Unlock()
+	}
+	return floor
+}
+
+// Hold waits until the floor of req has passed since start, or the client
+// went away; nothing for a nil LatencyFloor
+func (f *LatencyFloor) Hold(req *http.Request, start time.Time) {
+	if f == nil {
+		return
+	}
+	wait := time.Until(start.Add(f.Of(req)))
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-req.Context().Done():
+	}
+}
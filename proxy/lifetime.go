@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// boundedConn is an upstream connection that times out once it was idle,
+// neither reading nor writing, for longer than idle, and once it is older
+// than the lifetime of its Failover, so long-lived connections rotate across
+// load balancers and pick up DNS changes
+type boundedConn struct {
+	net.Conn
+	idle    time.Duration // 0 for no idle timeout
+	expires time.Time     // zero for no lifetime
+
+	mu       sync.Mutex
+	deadline time.Time // set with SetDeadline
+}
+
+// NetConn returns the connection the bounds are applied to
+func (c *boundedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *boundedConn) Read(p []byte) (int, error) {
+	c.extend()
+	return c.Conn.Read(p)
+}
+
+func (c *boundedConn) Write(p []byte) (int, error) {
+	c.extend()
+	return c.Conn.Write(p)
+}
+
+func (c *boundedConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.extend()
+}
+
+// extend moves the deadline of the connection to the earliest of the one
+// set, its expiry and the end of the idle timeout starting now
+func (c *boundedConn) extend() error {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	for _, t := range []time.Time{c.expires, c.idleUntil()} {
+		if !t.IsZero() && (deadline.IsZero() || t.Before(deadline)) {
+			deadline = t
+		}
+	}
+	return c.Conn.SetDeadline(deadline)
+}
+
+func (c *boundedConn) idleUntil() time.Time {
+	if c.idle <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.idle)
+}
+
+// bound applies the idle timeout and lifetime of f to conn, dialed at dialed
+func (f *Failover) bound(conn net.Conn, dialed time.Time) net.Conn {
+	if f.IdleTimeout <= 0 && f.MaxLifetime <= 0 {
+		return conn
+	}
+	c := &boundedConn{Conn: conn, idle: f.IdleTimeout}
+	if f.MaxLifetime > 0 {
+		c.expires = dialed.Add(f.MaxLifetime)
+	}
+	c.extend()
+	return c
+}
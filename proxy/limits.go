@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ResponseLimitError is returned for a response a target should never have sent
+type ResponseLimitError struct {
+	Reason string
+}
+
+func (e *ResponseLimitError) Error() string {
+	return "rejected response: " + e.Reason
+}
+
+// checkHeaderFields rejects resp, read from f, with a *ResponseLimitError
+// if it has more header fields than f allows. The header size is limited by
+// the transport of f itself.
+func (f *Failover) checkHeaderFields(resp *http.Response) error {
+	if f.MaxHeaderFields <= 0 {
+		return nil
+	}
+	fields := 0
+	for _, values := range resp.Header {
+		fields += len(values)
+	}
+	if fields > f.MaxHeaderFields {
+		return &ResponseLimitError{fmt.Sprintf("%d header fields, at most %d are allowed", fields, f.MaxHeaderFields)}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"text/template"
+)
+
+// ShadowLogin logs users into the alternate target to mint sessions for
+// production sessions the session cache does not know yet.
+type ShadowLogin struct {
+	Request    *template.Template // raw HTTP login request
+	UserHeader string             // request header identifying the user, if any
+}
+
+// loginData is what the login request template is executed with
+type loginData struct {
+	User    string      // value of -login.user
+	Session string      // production session id
+	Header  http.Header // headers of the original request
+}
+
+// LoadShadowLogin reads the login request template from path
+func LoadShadowLogin(path, userHeader string) (*ShadowLogin, error) {
+	t, err := template.New(filepath.Base(path)).Funcs(secretFuncs).ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ShadowLogin{Request: t, UserHeader: userHeader}, nil
+}
+
+// Login sends the login request for the user of req to the target dialed by
+// dialer and returns the session the target handed out in a cookie named like
+// the production session. It gives up once ctx is done.
+func (l *ShadowLogin) Login(ctx context.Context, dialer *Failover, req *http.Request, session *http.Cookie) (string, error) {
+	data := loginData{Session: session.Value, Header: req.Header}
+	if l.UserHeader != "" {
+		data.User = req.Header.Get(l.UserHeader)
+		if data.User == "" {
+			return "", fmt.Errorf("no %s header to log in with", l.UserHeader)
+		}
+	}
+	loginRequest, err := l.render(data)
+	if err != nil {
+		return "", err
+	}
+
+	resp, _, err := dialer.Exchange(loginRequest.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	DrainBody(resp.Body)
+	cookie := FindCookie(resp, session.Name)
+	if cookie == nil {
+		return "", fmt.Errorf("login answered %s without a %s cookie", resp.Status, session.Name)
+	}
+	return cookie.Value, nil
+}
+
+// render executes the template and parses the result as an HTTP request. The
+// body is whatever follows the headers, so templates need no Content-Length.
+func (l *ShadowLogin) render(data loginData) (*http.Request, error) {
+	raw := new(bytes.Buffer)
+	if err := l.Request.Execute(raw, data); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(raw)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, fmt.Errorf("login request: %v", err)
+	}
+	if req.ContentLength == 0 {
+		body, _ := ioutil.ReadAll(r)
+		body = bytes.TrimRight(body, "\r\n")
+		req.Body = nopCloser{bytes.NewReader(body)}
+		req.ContentLength = int64(len(body))
+	}
+	return req, nil
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Log levels, from the most to the least verbose
+const (
+	LogDebug int32 = iota // also ignored output, like failures of the alternate leg
+	LogInfo               // also the session lookups of every request
+	LogWarn               // only failures and warnings
+)
+
+var logLevelNames = []string{"debug", "info", "warn"}
+
+// logLevel is the current log level, changed at runtime through the admin API
+var logLevel int32 = LogInfo
+
+// debugRoutes are path prefixes of requests logged at debug level whatever
+// the log level
+var debugRoutes = struct {
+	sync.RWMutex
+	prefixes []string
+}{}
+
+// ParseLogLevel returns the level named debug, info or warn
+func ParseLogLevel(name string) (int32, error) {
+	for level, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return int32(level), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want debug, info or warn", name)
+}
+
+// SetLogLevel changes the log level
+func SetLogLevel(level int32) {
+	atomic.StoreInt32(&logLevel, level)
+}
+
+// LogLevel returns the name of the log level
+func LogLevel() string {
+	return logLevelNames[atomic.LoadInt32(&logLevel)]
+}
+
+// AddDebugRoute logs requests to paths starting with prefix at debug level
+func AddDebugRoute(prefix string) {
+	debugRoutes.Lock()
+	defer debugRoutes.Unlock()
+	for _, p := range debugRoutes.prefixes {
+		if p == prefix {
+			return
+		}
+	}
+	debugRoutes.prefixes = append(debugRoutes.prefixes, prefix)
+}
+
+// RemoveDebugRoute stops logging requests to prefix at debug level, all
+// prefixes are removed if it's empty
+func RemoveDebugRoute(prefix string) {
+	debugRoutes.Lock()
+	defer debugRoutes.Unlock()
+	prefixes := []string{}
+	for _, p := range debugRoutes.prefixes {
+		if prefix != "" && p != prefix {
+			prefixes = append(prefixes, p)
+		}
+	}
+	debugRoutes.prefixes = prefixes
+}
+
+// DebugRoutes returns the path prefixes logged at debug level
+func DebugRoutes() []string {
+	debugRoutes.RLock()
+	defer debugRoutes.RUnlock()
+	return append([]string{}, debugRoutes.prefixes...)
+}
+
+// debugging reports whether debug output is logged for req, which may be nil
+// for output not related to a request
+func debugging(req *http.Request) bool {
+	if atomic.LoadInt32(&logLevel) == LogDebug {
+		return true
+	}
+	if req == nil {
+		return false
+	}
+	debugRoutes.RLock()
+	defer debugRoutes.RUnlock()
+	for _, p := range debugRoutes.prefixes {
+		if strings.HasPrefix(req.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// infof logs at info level, or for requests to debug routes
+func infof(req *http.Request, format string, a ...interface{}) {
+	if atomic.LoadInt32(&logLevel) <= LogInfo || debugging(req) {
+		fmt.Printf(format, a...)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxTraceStateMembers is the most list members tracestate may carry
+const maxTraceStateMembers = 32
+
+// AddMetadata tells the alternate target about the original exchange by
+// adding -b.meta prefixed headers to the alternative request: the client IP,
+// and the production status and latency in milliseconds if they are known.
+func AddMetadata(alternativeRequest *http.Request, req *http.Request, productionStatus int, productionLatency time.Duration) {
+	prefix := *altMetaPrefix
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+	alternativeRequest.Header.Set(prefix+"Client-Ip", clientIP)
+	if productionStatus != 0 {
+		alternativeRequest.Header.Set(prefix+"Production-Status", strconv.Itoa(productionStatus))
+		alternativeRequest.Header.Set(prefix+"Production-Latency", strconv.FormatInt(productionLatency.Milliseconds(), 10))
+	}
+}
+
+// TagShadow marks the alternative request as shadow traffic for the services
+// and databases behind the alternate target by adding the -b.baggage entry to
+// its W3C baggage header and the -b.tracestate entry to its tracestate
+// header. An entry of the same key received from the client is replaced.
+func TagShadow(alternativeRequest *http.Request) {
+	if *altBaggage != "" {
+		members := withoutMember(alternativeRequest.Header.Values("Baggage"), *altBaggage)
+		alternativeRequest.Header.Set("Baggage", strings.Join(append(members, *altBaggage), ","))
+	}
+	if *altTraceState != "" {
+		members := append([]string{*altTraceState}, withoutMember(alternativeRequest.Header.Values("Tracestate"), *altTraceState)...)
+		if len(members) > maxTraceStateMembers {
+			members = members[:maxTraceStateMembers]
+		}
+		alternativeRequest.Header.Set("Tracestate", strings.Join(members, ","))
+	}
+}
+
+// withoutMember returns the members of comma separated key=value lists in
+// values, leaving out empty ones and those with the key of entry
+func withoutMember(values []string, entry string) []string {
+	key := memberKey(entry)
+	var members []string
+	for _, v := range values {
+		for _, member := range strings.Split(v, ",") {
+			member = strings.TrimSpace(member)
+			if member != "" && memberKey(member) != key {
+				members = append(members, member)
+			}
+		}
+	}
+	return members
+}
+
+func memberKey(member string) string {
+	key, _, _ := strings.Cut(member, "=")
+	return strings.TrimSpace(key)
+}
+
+// ValidTraceEntry reports whether entry is a single key=value list member
+// for the baggage or tracestate header
+func ValidTraceEntry(entry string) bool {
+	key, value, ok := strings.Cut(entry, "=")
+	return ok && key != "" && value != "" && !strings.ContainsAny(entry, ", \t")
+}
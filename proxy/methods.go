@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Method policies
+const (
+	MethodAllow      = "allow"      // forward to production and mirror
+	MethodDeny       = "deny"       // answer with 405 Method Not Allowed
+	MethodProduction = "production" // forward to production only
+)
+
+// MethodPolicies is a repeatable METHOD=policy command line flag
+type MethodPolicies map[string]string
+
+func (m MethodPolicies) String() string {
+	policies := make([]string, 0, len(m))
+	for method, policy := range m {
+		policies = append(policies, method+"="+policy)
+	}
+	sort.Strings(policies)
+	return strings.Join(policies, ",")
+}
+
+func (m MethodPolicies) Set(value string) error {
+	method, policy, _ := strings.Cut(value, "=")
+	switch policy {
+	case MethodAllow, MethodDeny, MethodProduction:
+	default:
+		return fmt.Errorf("want METHOD=allow, deny or production, got %q", value)
+	}
+	m[strings.ToUpper(method)] = policy
+	return nil
+}
+
+// Policy returns the policy for method, allow if none is configured
+func (m MethodPolicies) Policy(method string) string {
+	if policy, ok := m[method]; ok {
+		return policy
+	}
+	return MethodAllow
+}
+
+// Allowed lists the common methods that are not denied, for the Allow header
+func (m MethodPolicies) Allowed() string {
+	var allowed []string
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"} {
+		if m.Policy(method) != MethodDeny {
+			allowed = append(allowed, method)
+		}
+	}
+	return strings.Join(allowed, ", ")
+}
+
+// DenyMethod answers req with 405 Method Not Allowed
+func (m MethodPolicies) DenyMethod(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Allow", m.Allowed())
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// isWrite reports whether a request of method may change state on the target
+func isWrite(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
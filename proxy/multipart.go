@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// MultipartRule changes the parts of multipart bodies mirrored to the
+// alternate target whose form name matches Name, a glob. With File only
+// parts carrying a file name match. Action is drop, truncate:bytes or
+// scrub[:replacement], which replaces the content.
+type MultipartRule struct {
+	Name   string
+	File   bool
+	Action string
+
+	limit       int
+	replacement []byte
+}
+
+// MultipartRules is a flag of [file:]name=action rules
+type MultipartRules []*MultipartRule
+
+func (r *MultipartRules) String() string {
+	rules := make([]string, len(*r))
+	for i, rule := range *r {
+		name := rule.Name
+		if rule.File {
+			name = "file:" + name
+		}
+		rules[i] = name + "=" + rule.Action
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *MultipartRules) Set(value string) error {
+	name, action, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("want [file:]name=action, got %q", value)
+	}
+	rule := &MultipartRule{Action: action}
+	if strings.HasPrefix(name, "file:") {
+		name, rule.File = name[len("file:"):], true
+	}
+	if _, err := path.Match(name, ""); err != nil {
+		return fmt.Errorf("bad part name %q: %v", name, err)
+	}
+	rule.Name = name
+	op, arg, _ := strings.Cut(action, ":")
+	switch op {
+	case "drop":
+	case "truncate":
+		limit, err := strconv.Atoi(arg)
+		if err != nil || limit < 0 {
+			return fmt.Errorf("want truncate:bytes, got %q", action)
+		}
+		rule.limit = limit
+	case "scrub":
+		rule.replacement = []byte(arg)
+	default:
+		return fmt.Errorf("unknown part action %q, want drop, truncate:bytes or scrub[:replacement]", action)
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// Rule returns the first rule matching a part, or nil
+func (r MultipartRules) Rule(part *multipart.Part) *MultipartRule {
+	for _, rule := range r {
+		if rule.File && part.FileName() == "" {
+			continue
+		}
+		if ok, _ := path.Match(rule.Name, part.FormName()); ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Scrub applies the rules to the parts of the multipart body of req, which is
+// about to be sent to the alternate target. The boundary is kept, so the
+// Content-Type header stays valid. Bodies that are not multipart or fail to
+// parse are left alone.
+func (r MultipartRules) Scrub(req *http.Request) {
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" || req.Body == nil {
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if scrubbed, err := r.scrub(body, params["boundary"]); err == nil {
+		body = scrubbed
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	} else if debugging(req) {
+		fmt.Printf("Failed to scrub multipart body of %s %s: %v\n", req.Method, req.URL, err)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+}
+
+func (r MultipartRules) scrub(body []byte, boundary string) ([]byte, error) {
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	var scrubbed bytes.Buffer
+	writer := multipart.NewWriter(&scrubbed)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rule := r.Rule(part)
+		if rule != nil && rule.Action == "drop" {
+			continue
+		}
+		w, err := writer.CreatePart(textproto.MIMEHeader(part.Header))
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case rule == nil:
+			_, err = io.Copy(w, part)
+		case strings.HasPrefix(rule.Action, "scrub"):
+			_, err = w.Write(rule.replacement)
+		default:
+			_, err = io.Copy(w, io.LimitReader(part, int64(rule.limit)))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return scrubbed.Bytes(), nil
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NormalizeRule normalizes the values a JSONPath selects in both JSON bodies
+// before they are compared, so representation differences don't count as
+// mismatches. Op is one of lower, trim, round:N for N decimals and time:skew
+// for timestamps, RFC 3339 strings or Unix seconds, considered equal if they
+// are at most skew apart.
+type NormalizeRule struct {
+	Path string
+	Op   string
+
+	steps    []string
+	decimals int
+	skew     time.Duration
+}
+
+// NormalizeRules is a flag of $.json.path=op rules
+type NormalizeRules []*NormalizeRule
+
+func (r *NormalizeRules) String() string {
+	rules := make([]string, len(*r))
+	for i, rule := range *r {
+		rules[i] = rule.Path + "=" + rule.Op
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *NormalizeRules) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return fmt.Errorf("want $.json.path=op, got %q", value)
+	}
+	rule := &NormalizeRule{Path: value[:i], Op: value[i+1:]}
+	var err error
+	if rule.steps, err = parseJSONPath(rule.Path); err != nil {
+		return err
+	}
+	op, arg, _ := strings.Cut(rule.Op, ":")
+	switch op {
+	case "lower", "trim":
+	case "round":
+		if rule.decimals, err = strconv.Atoi(arg); err != nil || rule.decimals < 0 {
+			return fmt.Errorf("want round:decimals, got %q", rule.Op)
+		}
+	case "time":
+		if rule.skew, err = time.ParseDuration(arg); err != nil {
+			return fmt.Errorf("want time:skew like time:2s, got %q", rule.Op)
+		}
+	default:
+		return fmt.Errorf("unknown normalization %q, want lower, trim, round:N or time:skew", rule.Op)
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// Apply normalizes the decoded JSON values p and a, the production and the
+// alternate body, in place and returns them
+func (r NormalizeRules) Apply(p, a interface{}) (interface{}, interface{}) {
+	for _, rule := range r {
+		p, a = normalizeAt(p, a, rule.steps, rule.normalize)
+	}
+	return p, a
+}
+
+// normalizeAt calls normalize on the pairs of values at the steps of a
+// JSONPath in p and a, replacing them with the results
+func normalizeAt(p, a interface{}, steps []string, normalize func(p, a interface{}) (interface{}, interface{})) (interface{}, interface{}) {
+	if len(steps) == 0 {
+		return normalize(p, a)
+	}
+	step, rest := steps[0], steps[1:]
+	switch pNode := p.(type) {
+	case map[string]interface{}:
+		aNode, ok := a.(map[string]interface{})
+		if !ok {
+			break
+		}
+		pChild, pOK := pNode[step]
+		aChild, aOK := aNode[step]
+		if pOK && aOK {
+			pNode[step], aNode[step] = normalizeAt(pChild, aChild, rest, normalize)
+		}
+	case []interface{}:
+		aNode, ok := a.([]interface{})
+		if !ok {
+			break
+		}
+		for i := range pNode {
+			if i < len(aNode) && (step == "*" || step == strconv.Itoa(i)) {
+				pNode[i], aNode[i] = normalizeAt(pNode[i], aNode[i], rest, normalize)
+			}
+		}
+	}
+	return p, a
+}
+
+func (rule *NormalizeRule) normalize(p, a interface{}) (interface{}, interface{}) {
+	switch {
+	case rule.Op == "lower":
+		return mapString(p, strings.ToLower), mapString(a, strings.ToLower)
+	case rule.Op == "trim":
+		return mapString(p, strings.TrimSpace), mapString(a, strings.TrimSpace)
+	case strings.HasPrefix(rule.Op, "time:"):
+		pTime, pOK := timestamp(p)
+		aTime, aOK := timestamp(a)
+		if pOK && aOK && pTime.Sub(aTime) <= rule.skew && aTime.Sub(pTime) <= rule.skew {
+			return p, p
+		}
+		return p, a
+	}
+	return rule.round(p), rule.round(a)
+}
+
+func mapString(v interface{}, f func(string) string) interface{} {
+	if s, ok := v.(string); ok {
+		return f(s)
+	}
+	return v
+}
+
+// round rounds numbers and numeric strings to the decimals of the rule
+func (rule *NormalizeRule) round(v interface{}) interface{} {
+	scale := math.Pow(10, float64(rule.decimals))
+	switch v := v.(type) {
+	case float64:
+		return math.Round(v*scale) / scale
+	case json.Number:
+		if n, err := v.Float64(); err == nil {
+			return math.Round(n*scale) / scale
+		}
+	case string:
+		if n, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return strconv.FormatFloat(math.Round(n*scale)/scale, 'f', rule.decimals, 64)
+		}
+	}
+	return v
+}
+
+// timestamp parses an RFC 3339 string or Unix seconds, as number or string
+func timestamp(v interface{}) (time.Time, bool) {
+	if s, ok := v.(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, true
+		}
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		v = n
+	}
+	if n, ok := v.(json.Number); ok {
+		f, err := n.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		v = f
+	}
+	if n, ok := v.(float64); ok {
+		sec, frac := math.Modf(n)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	}
+	return time.Time{}, false
+}
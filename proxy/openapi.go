@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// IgnoreRule names the JSON fields of the responses to one operation that are
+// left out when comparing them. Path segments in braces match any segment,
+// a field is a path of keys in which "[]" stands for every array element.
+type IgnoreRule struct {
+	Method string
+	Path   []string
+	Fields [][]string
+}
+
+// IgnoreRules are the rules of all operations, as derived by LoadOpenAPIIgnoreRules
+type IgnoreRules []IgnoreRule
+
+// diffIgnore is loaded from -diff.openapi
+var diffIgnore IgnoreRules
+
+// Fields returns the fields ignored in responses to req
+func (rules IgnoreRules) Fields(req *http.Request) [][]string {
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	for _, rule := range rules {
+		if rule.Method == req.Method && pathMatches(rule.Path, segments) {
+			return rule.Fields
+		}
+	}
+	return nil
+}
+
+func pathMatches(template, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+	for i, t := range template {
+		if t != segments[i] && !(strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}")) {
+			return false
+		}
+	}
+	return true
+}
+
+// removeField deletes field from the decoded JSON value v
+func removeField(v interface{}, field []string) interface{} {
+	if len(field) == 0 {
+		return v
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(field) == 1 {
+			delete(v, field[0])
+		} else if child, ok := v[field[0]]; ok {
+			v[field[0]] = removeField(child, field[1:])
+		}
+	case []interface{}:
+		if field[0] == "[]" {
+			for i := range v {
+				v[i] = removeField(v[i], field[1:])
+			}
+		}
+	}
+	return v
+}
+
+// openAPISchema is the part of an OpenAPI (or Swagger 2) schema object
+// needed to find read-only properties
+type openAPISchema struct {
+	Ref        string                    `json:"$ref"`
+	ReadOnly   bool                      `json:"readOnly"`
+	Properties map[string]*openAPISchema `json:"properties"`
+	Items      *openAPISchema            `json:"items"`
+	AllOf      []*openAPISchema          `json:"allOf"`
+	OneOf      []*openAPISchema          `json:"oneOf"`
+	AnyOf      []*openAPISchema          `json:"anyOf"`
+}
+
+type openAPIResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema *openAPISchema `json:"schema"`
+	} `json:"content"`
+	Schema *openAPISchema `json:"schema"` // Swagger 2
+}
+
+type openAPISpec struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+
+	Components struct {
+		Schemas   map[string]*openAPISchema   `json:"schemas"`
+		Responses map[string]*openAPIResponse `json:"responses"`
+	} `json:"components"`
+	Definitions map[string]*openAPISchema   `json:"definitions"` // Swagger 2
+	Responses   map[string]*openAPIResponse `json:"responses"`   // Swagger 2
+}
+
+// LoadOpenAPIIgnoreRules derives IgnoreRules from the OpenAPI spec at path,
+// which must be JSON. The fields ignored for an operation are the properties
+// its response schemas document as readOnly, i.e. generated by the server
+// like ids and timestamps.
+func LoadOpenAPIIgnoreRules(path string) (IgnoreRules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var spec openAPISpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+
+	var rules IgnoreRules
+	for template, operations := range spec.Paths {
+		for method, raw := range operations {
+			var operation struct {
+				Responses map[string]*openAPIResponse `json:"responses"`
+			}
+			if json.Unmarshal(raw, &operation) != nil {
+				continue // "parameters" and extensions
+			}
+			seen := map[string]bool{}
+			var fields [][]string
+			for _, response := range operation.Responses {
+				if response == nil {
+					continue
+				}
+				if response.Ref != "" {
+					response = spec.response(response.Ref)
+				}
+				if response == nil {
+					continue
+				}
+				schemas := []*openAPISchema{response.Schema}
+				for _, content := range response.Content {
+					schemas = append(schemas, content.Schema)
+				}
+				for _, schema := range schemas {
+					for _, field := range spec.readOnly(schema, nil, map[string]bool{}) {
+						if key := strings.Join(field, "."); !seen[key] {
+							seen[key] = true
+							fields = append(fields, field)
+						}
+					}
+				}
+			}
+			if len(fields) > 0 {
+				sort.Slice(fields, func(i, j int) bool { return strings.Join(fields[i], ".") < strings.Join(fields[j], ".") })
+				rules = append(rules, IgnoreRule{
+					Method: strings.ToUpper(method),
+					Path:   strings.Split(strings.Trim(template, "/"), "/"),
+					Fields: fields,
+				})
+			}
+		}
+	}
+	return rules, nil
+}
+
+func (spec *openAPISpec) response(ref string) *openAPIResponse {
+	if name := strings.TrimPrefix(ref, "#/components/responses/"); name != ref {
+		return spec.Components.Responses[name]
+	}
+	return spec.Responses[strings.TrimPrefix(ref, "#/responses/")]
+}
+
+func (spec *openAPISpec) schema(ref string) *openAPISchema {
+	if name := strings.TrimPrefix(ref, "#/components/schemas/"); name != ref {
+		return spec.Components.Schemas[name]
+	}
+	return spec.Definitions[strings.TrimPrefix(ref, "#/definitions/")]
+}
+
+// readOnly returns the paths of the read-only properties in schema, which is
+// found at prefix. refs holds the references being resolved, so recursive
+// schemas end.
+func (spec *openAPISpec) readOnly(schema *openAPISchema, prefix []string, refs map[string]bool) [][]string {
+	if schema == nil {
+		return nil
+	}
+	if schema.Ref != "" {
+		if refs[schema.Ref] {
+			return nil
+		}
+		refs[schema.Ref] = true
+		defer delete(refs, schema.Ref)
+		return spec.readOnly(spec.schema(schema.Ref), prefix, refs)
+	}
+	if schema.ReadOnly && len(prefix) > 0 {
+		return [][]string{prefix}
+	}
+	var fields [][]string
+	for name, property := range schema.Properties {
+		fields = append(fields, spec.readOnly(property, appendPath(prefix, name), refs)...)
+	}
+	fields = append(fields, spec.readOnly(schema.Items, appendPath(prefix, "[]"), refs)...)
+	for _, schemas := range [][]*openAPISchema{schema.AllOf, schema.OneOf, schema.AnyOf} {
+		for _, s := range schemas {
+			fields = append(fields, spec.readOnly(s, prefix, refs)...)
+		}
+	}
+	return fields
+}
+
+func appendPath(prefix []string, name string) []string {
+	return append(append([]string(nil), prefix...), name)
+}
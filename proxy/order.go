@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"sync"
+)
+
+// SessionQueue lines up the mirrored requests of each session, so they can be
+// sent to the alternate target in the order production received them
+type SessionQueue struct {
+	mu    sync.Mutex
+	tails map[string]chan struct{}
+}
+
+// NewSessionQueue returns an empty SessionQueue
+func NewSessionQueue() *SessionQueue {
+	return &SessionQueue{tails: map[string]chan struct{}{}}
+}
+
+// SessionTurn is the place of a request in the queue of its session. Wait is
+// closed once the request before it is done. Done must be called once this
+// request is, and may be called more than once; a request done before the
+// one ahead of it, e.g. sent after giving up waiting, still only lets the
+// next one go once that is done too.
+type SessionTurn struct {
+	Wait <-chan struct{}
+	Done func()
+}
+
+// Enqueue puts a request of session at the end of its queue
+func (q *SessionQueue) Enqueue(session string) *SessionTurn {
+	turn := make(chan struct{})
+	q.mu.Lock()
+	previous, ok := q.tails[session]
+	if !ok {
+		previous = make(chan struct{})
+		close(previous)
+	}
+	q.tails[session] = turn
+	q.mu.Unlock()
+
+	var once sync.Once
+	pass := func() {
+		q.mu.Lock()
+		if q.tails[session] == turn {
+			delete(q.tails, session)
+		}
+		q.mu.Unlock()
+		close(turn)
+	}
+	return &SessionTurn{Wait: previous, Done: func() {
+		once.Do(func() {
+			select {
+			case <-previous:
+				pass()
+			default:
+				go func() {
+					<-previous
+					pass()
+				}()
+			}
+		})
+	}}
+}
+
+// Len returns the number of sessions with requests in the queue
+func (q *SessionQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tails)
+}
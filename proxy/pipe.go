@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// OpenPipe opens the stream of -pipe, stdin for "-". Named pipes are opened
+// like files.
+func OpenPipe(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// RequestReader returns the next request of a stream, io.EOF at its end. The
+// body of a request must be read before the next one is asked for.
+type RequestReader func() (*http.Request, error)
+
+// RawRequests returns the raw HTTP/1.x requests read from r
+func RawRequests(r io.Reader) RequestReader {
+	requests := bufio.NewReader(r)
+	return func() (*http.Request, error) {
+		return http.ReadRequest(requests)
+	}
+}
+
+// Checkpoint is the replay position of a stream kept in a file, see
+// -pipe.checkpoint: the number of requests served from its start
+type Checkpoint struct {
+	Path     string
+	Position int
+}
+
+// LoadCheckpoint reads the position kept in path, 0 if there is none yet
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	c := &Checkpoint{Path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.Position, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil || c.Position < 0 {
+		return nil, fmt.Errorf("%s: invalid position %q", path, strings.TrimSpace(string(data)))
+	}
+	return c, nil
+}
+
+// Acknowledge keeps position as served; nothing for a nil checkpoint. The
+// file is replaced rather than rewritten, so an interruption leaves either
+// the old or the new position.
+func (c *Checkpoint) Acknowledge(position int) error {
+	if c == nil {
+		return nil
+	}
+	temporary, err := ioutil.TempFile(filepath.Dir(c.Path), filepath.Base(c.Path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name()) // if not renamed
+	_, err = fmt.Fprintf(temporary, "%d\n", position)
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temporary.Name(), c.Path)
+	}
+	if err == nil {
+		c.Position = position
+	}
+	return err
+}
+
+// Finish removes the file at the end of the stream, so the next run replays
+// it from the start; nothing for a nil checkpoint
+func (c *Checkpoint) Finish() error {
+	if c == nil {
+		return nil
+	}
+	if err := os.Remove(c.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pipeLaneBacklog is how many requests may wait in a lane of -pipe.workers
+// before reading the stream waits for it
+const pipeLaneBacklog = 64
+
+// PipeLanes spreads the requests of a pipe over concurrent workers, see
+// -pipe.workers. The requests of a session always take the same lane and are
+// served one after the other in the order of the stream, so stateful flows
+// replay as recorded; requests without a session take the lanes in turn.
+type PipeLanes struct {
+	Workers int
+	Session IdentitySource
+}
+
+// lane returns the lane of req, the nth request of the stream
+func (l PipeLanes) lane(req *http.Request, n int) int {
+	session := l.Session.Identity(req)
+	if session == "" {
+		return n % l.Workers
+	}
+	h := fnv.New32a()
+	h.Write([]byte(session))
+	return int(h.Sum32() % uint32(l.Workers))
+}
+
+// pipedRequest is the nth request of a stream
+type pipedRequest struct {
+	n   int
+	req *http.Request
+}
+
+// acknowledgements advance a checkpoint over requests served out of order.
+// Its position is the last request up to which all requests were served.
+type acknowledgements struct {
+	checkpoint *Checkpoint
+
+	mu       sync.Mutex
+	position int
+	served   map[int]bool // past position
+	err      error        // of keeping the position
+}
+
+func (a *acknowledgements) serve(n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.served[n] = true
+	position := a.position
+	for a.served[position+1] {
+		delete(a.served, position+1)
+		position++
+	}
+	if position == a.position || a.err != nil {
+		return
+	}
+	a.position = position
+	if err := a.checkpoint.Acknowledge(position); err != nil {
+		a.err = fmt.Errorf("keeping the position %d: %v", position, err)
+	}
+}
+
+func (a *acknowledgements) failed() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// ServePipe serves the requests of next with handler, as if a client had sent
+// them to the listener, and discards the responses. The requests are served
+// one after the other, or in the lanes of more than one worker. It returns at
+// the end of the stream once all requests were served. With a checkpoint the
+// requests before its position are skipped and the requests served are
+// acknowledged, so an interrupted replay resumes after them instead of
+// sending their writes again.
+func ServePipe(next RequestReader, handler http.Handler, checkpoint *Checkpoint, lanes PipeLanes) error {
+	skip := 0
+	if checkpoint != nil && checkpoint.Position > 0 {
+		skip = checkpoint.Position
+		fmt.Printf("Resuming after request %d of the checkpoint %s\n", skip, checkpoint.Path)
+	}
+	acks := &acknowledgements{checkpoint: checkpoint, position: skip, served: map[int]bool{}}
+	var queues []chan pipedRequest
+	var workers sync.WaitGroup
+	if lanes.Workers > 1 {
+		queues = make([]chan pipedRequest, lanes.Workers)
+		for i := range queues {
+			queues[i] = make(chan pipedRequest, pipeLaneBacklog)
+			workers.Add(1)
+			go func(queue chan pipedRequest) {
+				defer workers.Done()
+				for p := range queue {
+					servePiped(handler, p.req)
+					acks.serve(p.n)
+				}
+			}(queues[i])
+		}
+	}
+	wait := func() {
+		for _, queue := range queues {
+			close(queue)
+		}
+		queues = nil
+		workers.Wait()
+	}
+	defer wait()
+	for n := 1; ; n++ {
+		if err := acks.failed(); err != nil {
+			return err
+		}
+		req, err := next()
+		if err == io.EOF {
+			if n <= skip {
+				return fmt.Errorf("the stream ended at request %d, before the position %d of %s", n-1, skip, checkpoint.Path)
+			}
+			wait()
+			if err := acks.failed(); err != nil {
+				return err
+			}
+			return checkpoint.Finish()
+		}
+		if err != nil {
+			return fmt.Errorf("reading request %d: %v", n, err)
+		}
+		if n <= skip {
+			io.Copy(ioutil.Discard, req.Body)
+			continue
+		}
+		req.RemoteAddr = "pipe"
+		if queues == nil {
+			servePiped(handler, req)
+			io.Copy(ioutil.Discard, req.Body) // left unread if not forwarded
+			acks.serve(n)
+			continue
+		}
+		body, err := ioutil.ReadAll(req.Body) // before the next request is read
+		if err != nil {
+			return fmt.Errorf("reading request %d: %v", n, err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		queues[lanes.lane(req, n)] <- pipedRequest{n: n, req: req}
+	}
+}
+
+// servePiped serves req with handler, which may abort the response as it
+// would on a client connection
+func servePiped(handler http.Handler, req *http.Request) {
+	defer func() {
+		if r := recover(); r != nil && r != http.ErrAbortHandler {
+			panic(r)
+		}
+	}()
+	handler.ServeHTTP(&discardResponse{header: http.Header{}}, req)
+}
+
+// discardResponse is the ResponseWriter of requests read from a pipe
+type discardResponse struct {
+	header http.Header
+}
+
+func (d *discardResponse) Header() http.Header         { return d.header }
+func (d *discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardResponse) WriteHeader(int)             {}
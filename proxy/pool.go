@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// targetConn is a connection of the transport of a Failover, which tells
+// the address it went to and is counted until closed
+type targetConn struct {
+	net.Conn
+	address string
+	open    *int64
+	once    sync.Once
+}
+
+// NetConn returns the connection as dialed
+func (c *targetConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *targetConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(c.open, -1) })
+	return c.Conn.Close()
+}
+
+// Open returns the number of connections of the transport of f, in use or
+// idle in its pool
+func (f *Failover) Open() int64 {
+	return atomic.LoadInt64(&f.open)
+}
+
+// transport returns the http.Transport requests to f are sent with, made
+// from the settings of f on first use. Up to MaxIdle connections are kept
+// open once their response was read, for later requests to reuse instead of
+// dialing, which spares the targets the handshakes and teeproxy the sockets
+// in TIME_WAIT. They are closed once idle for longer than IdleAge, which has
+// to stay below the keep-alive timeout of the targets, or than IdleTimeout.
+func (f *Failover) transport() *http.Transport {
+	f.once.Do(func() {
+		idleAge := f.IdleAge
+		if f.IdleTimeout > 0 && (idleAge <= 0 || f.IdleTimeout < idleAge) {
+			idleAge = f.IdleTimeout
+		}
+		maxHeaderBytes := f.MaxHeaderBytes
+		if maxHeaderBytes <= 0 {
+			maxHeaderBytes = math.MaxInt64 // the transport takes 0 for its default
+		}
+		f.t = &http.Transport{
+			DialContext:            f.dialTransport,
+			MaxIdleConnsPerHost:    f.MaxIdle,
+			DisableKeepAlives:      f.MaxIdle <= 0,
+			IdleConnTimeout:        idleAge,
+			ResponseHeaderTimeout:  f.HeaderTimeout,
+			MaxResponseHeaderBytes: maxHeaderBytes,
+			DisableCompression:     true, // bodies are passed on as the target sent them
+		}
+	})
+	return f.t
+}
+
+// dialTransport dials a connection for the transport of f to the address
+// DialContext picks, whatever addr the request was made for
+func (f *Failover) dialTransport(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, address, err := f.connect(ctx, f.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if f.Bandwidth != nil {
+		conn = f.Bandwidth.Conn(conn)
+	}
+	atomic.AddInt64(&f.open, 1)
+	return &targetConn{Conn: conn, address: address, open: &f.open}, nil
+}
+
+// Exchange sends req to f on a connection of its pool or a new one and reads
+// the response header. It returns the address the request went to, empty if
+// it got no connection. The request is cancelled once the context of req is
+// done. Closing the body of the response before its end closes the
+// connection, so the rest is never read. A response with a header larger or
+// with more fields than f allows is rejected with a *ResponseLimitError.
+//
+// A request that can safely be repeated is sent again on a new connection
+// if the target closes a reused one before answering.
+func (f *Failover) Exchange(req *http.Request) (*http.Response, string, error) {
+	var address string
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		if c, ok := info.Conn.(*targetConn); ok {
+			address = c.address
+		}
+	}}
+	out := req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	u := *req.URL
+	u.Scheme, u.Host = "http", f.Addresses[0] // the connection is to the address dialed
+	out.URL, out.RequestURI = &u, ""
+	if out.ContentLength == 0 {
+		out.Body = http.NoBody
+	}
+	out.GetBody = nil // the body may have been replaced since, never resend the old one
+	resp, err := f.transport().RoundTrip(out)
+	if err != nil {
+		if f.MaxHeaderBytes > 0 && strings.Contains(err.Error(), "server response headers exceeded") {
+			err = &ResponseLimitError{fmt.Sprintf("header exceeds %d bytes", f.MaxHeaderBytes)}
+		}
+		return nil, address, err
+	}
+	if err := f.checkHeaderFields(resp); err != nil {
+		resp.Body.Close()
+		return nil, address, err
+	}
+	return resp, address, nil
+}
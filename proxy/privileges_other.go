@@ -0,0 +1,10 @@
+//go:build !unix
+
+package proxy
+
+import "errors"
+
+// DropPrivileges is not supported where there are no user ids to switch to
+func DropPrivileges(spec string) error {
+	return errors.New("dropping privileges is only supported on Unix")
+}
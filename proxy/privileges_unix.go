@@ -0,0 +1,68 @@
+//go:build unix
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DropPrivileges switches the process to the user of spec, user or
+// user:group by name or id, once the listeners are bound. Without a group
+// the primary group of the user is taken; the supplementary groups are the
+// user's. Go applies the switch to all threads.
+func DropPrivileges(spec string) error {
+	name, groupName, _ := strings.Cut(spec, ":")
+	u, err := user.Lookup(name)
+	if _, unknown := err.(user.UnknownUserError); unknown {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		return err
+	}
+	gid := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, unknown := err.(user.UnknownGroupError); unknown {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return err
+		}
+		gid = g.Gid
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s has no numeric id", u.Username)
+	}
+	primary, err := strconv.Atoi(gid)
+	if err != nil {
+		return fmt.Errorf("group %s is not numeric", gid)
+	}
+	groups := []int{primary}
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if n, err := strconv.Atoi(id); err == nil && n != primary {
+				groups = append(groups, n)
+			}
+		}
+	}
+	// the groups first, changing them takes the privileges given up last
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setting groups: %v", err)
+	}
+	if err := syscall.Setgid(primary); err != nil {
+		return fmt.Errorf("setting group %d: %v", primary, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setting user %d: %v", uid, err)
+	}
+	if os.Geteuid() != uid || os.Getegid() != primary {
+		return fmt.Errorf("still running as %d:%d", os.Geteuid(), os.Getegid())
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Probe is a synthetic follow-up request sent to the alternate target after
+// it answered a matching request, e.g. reading back the order a POST /orders
+// created. The method, path, headers and body of the follow-up are templates
+// executed on ProbeData.
+type Probe struct {
+	Name    string       `json:"name"`
+	Method  string       `json:"method,omitempty"` // method of the requests followed up, all if empty
+	Path    string       `json:"path,omitempty"`   // path prefix of the requests followed up
+	Request ProbeRequest `json:"request"`
+	Status  int          `json:"status,omitempty"` // status the follow-up must be answered with, any 2xx if 0
+
+	method, path, body *template.Template
+	header             map[string]*template.Template
+}
+
+// ProbeRequest is the follow-up request of a Probe
+type ProbeRequest struct {
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   string            `json:"body,omitempty"`
+}
+
+// ProbeData is what the templates of a probe can refer to. The JSON bodies
+// are nil if they are not JSON, e.g. {{.Alternate.id}} is the id field of
+// the alternate response and {{.AlternateHeader.Get "Location"}} its Location.
+type ProbeData struct {
+	Request          *http.Request
+	Production       interface{}
+	ProductionHeader http.Header
+	Alternate        interface{}
+	AlternateHeader  http.Header
+}
+
+// LoadProbes reads a JSON array of probes from path. Their templates can
+// use the functions of annotations.
+func LoadProbes(path string, annotations *Annotations) ([]*Probe, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var probes []*Probe
+	if err := json.NewDecoder(f).Decode(&probes); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, p := range probes {
+		switch {
+		case p.Name == "":
+			return nil, fmt.Errorf("probe without a name")
+		case names[p.Name]:
+			return nil, fmt.Errorf("probe name %q is taken", p.Name)
+		case p.Request.Path == "":
+			return nil, fmt.Errorf("probe %s has no request path", p.Name)
+		}
+		names[p.Name] = true
+		if p.Request.Method == "" {
+			p.Request.Method = "GET"
+		}
+		parse := func(text string) *template.Template {
+			if err == nil {
+				var t *template.Template
+				t, err = template.New(p.Name).Option("missingkey=error").Funcs(annotations.Funcs()).Parse(text)
+				return t
+			}
+			return nil
+		}
+		p.method, p.path, p.body = parse(p.Request.Method), parse(p.Request.Path), parse(p.Request.Body)
+		p.header = map[string]*template.Template{}
+		for name, value := range p.Request.Header {
+			p.header[name] = parse(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("probe %s: %v", p.Name, err)
+		}
+	}
+	return probes, nil
+}
+
+// Follows reports whether the probe follows up req
+func (p *Probe) Follows(req *http.Request) bool {
+	return (p.Method == "" || strings.EqualFold(p.Method, req.Method)) && strings.HasPrefix(req.URL.Path, p.Path)
+}
+
+// NewRequest executes the templates of the probe on data. The follow-up
+// carries the cookies and credentials of the alternate request it follows.
+func (p *Probe) NewRequest(data *ProbeData, alternativeRequest *http.Request) (*http.Request, error) {
+	var method, path, body bytes.Buffer
+	for _, t := range []struct {
+		template *template.Template
+		out      *bytes.Buffer
+	}{{p.method, &method}, {p.path, &path}, {p.body, &body}} {
+		if err := t.template.Execute(t.out, data); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method.String(), path.String(), &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = alternativeRequest.Host
+	for _, name := range []string{"Cookie", "Authorization"} {
+		if values, ok := alternativeRequest.Header[name]; ok {
+			req.Header[name] = values
+		}
+	}
+	for name, t := range p.header {
+		var value bytes.Buffer
+		if err := t.Execute(&value, data); err != nil {
+			return nil, err
+		}
+		req.Header.Set(name, value.String())
+	}
+	return req, nil
+}
+
+// Passed reports whether status is what the probe expects
+func (p *Probe) Passed(status int) bool {
+	if p.Status == 0 {
+		return status >= 200 && status < 300
+	}
+	return status == p.Status
+}
+
+// jsonBody returns body decoded, nil if it is not JSON
+func jsonBody(body []byte) interface{} {
+	var v interface{}
+	if json.Unmarshal(body, &v) != nil {
+		return nil
+	}
+	return v
+}
+
+// RunProbes sends the follow-ups of the probes to the target dialed by
+// dialer, one after the other, and counts whether they passed in stats
+func RunProbes(ctx context.Context, probes []*Probe, dialer *Failover, stats *RunStats, data *ProbeData, alternativeRequest *http.Request) {
+	for _, p := range probes {
+		status, err := runProbe(ctx, p, dialer, data, alternativeRequest)
+		passed := err == nil && p.Passed(status)
+		stats.Probe(p.Name, passed)
+		switch {
+		case err != nil:
+			fmt.Printf("Probe %s after %s %s failed: %v\n", p.Name, data.Request.Method, data.Request.URL, err)
+		case !passed:
+			fmt.Printf("Probe %s after %s %s was answered with %d\n", p.Name, data.Request.Method, data.Request.URL, status)
+		}
+	}
+}
+
+func runProbe(ctx context.Context, p *Probe, dialer *Failover, data *ProbeData, alternativeRequest *http.Request) (int, error) {
+	req, err := p.NewRequest(data, alternativeRequest)
+	if err != nil {
+		return 0, err
+	}
+	resp, _, err := dialer.Exchange(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	DrainBody(resp.Body)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// RecentResponse is an alternate response kept by RecentResponses, as a
+// record without the production response
+type RecentResponse struct {
+	ID string `json:"id,omitempty"` // of the -b.keep.id header of the request
+	*Record
+}
+
+// size is roughly the memory an entry takes
+func (r *RecentResponse) size() int {
+	size := len(r.ID) + len(r.Request.URL) + len(r.Request.Body)
+	if r.Alternate != nil {
+		size += len(r.Alternate.Body)
+	}
+	return size
+}
+
+// RecentResponses keeps the most recent alternate responses, at most Max of
+// them and MaxBytes of their requests and bodies, so developers can look up
+// what the alternate target returned for a request shortly after, see
+// -b.keep. The oldest ones are dropped first.
+type RecentResponses struct {
+	Max      int
+	MaxBytes int
+
+	mu        sync.Mutex
+	responses []*RecentResponse // oldest first
+	bytes     int
+}
+
+// Add keeps the alternate response of r, identified by id; nothing for a nil
+// RecentResponses. The body of r must not be released afterwards.
+func (c *RecentResponses) Add(id string, r *Record) {
+	if c == nil {
+		return
+	}
+	response := &RecentResponse{ID: id, Record: r}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responses = append(c.responses, response)
+	c.bytes += response.size()
+	for len(c.responses) > c.Max || (c.bytes > c.MaxBytes && len(c.responses) > 1) {
+		c.bytes -= c.responses[0].size()
+		c.responses[0] = nil
+		c.responses = c.responses[1:]
+	}
+}
+
+// Find returns the kept responses to the requests with the request key or
+// the id, newest first, at most limit of them. Without either it returns the
+// newest ones.
+func (c *RecentResponses) Find(key, id string, limit int) []*RecentResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found := []*RecentResponse{}
+	for i := len(c.responses) - 1; i >= 0 && len(found) < limit; i-- {
+		r := c.responses[i]
+		if (key == "" || r.Request.Key == key) && (id == "" || r.ID == id) {
+			found = append(found, r)
+		}
+	}
+	return found
+}
+
+// ServeHTTP answers GET /responses?key=request_key&id=id&limit=n with the
+// kept responses found as a JSON array, 404 if none are
+func (c *RecentResponses) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	limit := 20
+	if n, err := strconv.Atoi(req.FormValue("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	key, id := req.FormValue("key"), req.FormValue("id")
+	found := c.Find(key, id, limit)
+	if len(found) == 0 && (key != "" || id != "") {
+		http.Error(w, "no response kept for the request", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(found)
+}
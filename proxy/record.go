@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is one mirrored exchange as kept by a RecordStore
+type Record struct {
+	Time       time.Time         `json:"time"`
+	Experiment string            `json:"experiment,omitempty"`
+	Request    RecordedRequest   `json:"request"`
+	Production *RecordedResponse `json:"production,omitempty"`
+	Alternate  *RecordedResponse `json:"alternate,omitempty"`
+	Diff       *Diff             `json:"diff,omitempty"`
+}
+
+// RecordedRequest is the request as received from the client
+type RecordedRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Host       string      `json:"host"`
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+	Key        string      `json:"key"` // see RequestKey
+}
+
+// RecordedResponse is a response of one of the targets. Body is nil if the
+// body was streamed without being buffered.
+type RecordedResponse struct {
+	Status  int           `json:"status"`
+	Header  http.Header   `json:"header"`
+	Body    []byte        `json:"body,omitempty"`
+	Latency time.Duration `json:"latency"`
+}
+
+// NewRecord captures the exchange of req. The responses may be nil if the
+// respective target did not answer.
+func NewRecord(req *http.Request, production *http.Response, productionBody []byte, productionLatency time.Duration,
+	alternate *http.Response, alternateBody []byte, alternateLatency time.Duration, diff *Diff) *Record {
+	r := &Record{
+		Time: time.Now(),
+		Request: RecordedRequest{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			Host:       req.Host,
+			RemoteAddr: req.RemoteAddr,
+			Header:     RedactHeader(req.Header),
+			Key:        RequestKey(req),
+		},
+		Diff: diff,
+	}
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			r.Request.Body, _ = ioutil.ReadAll(body)
+		}
+	}
+	if production != nil {
+		r.Production = &RecordedResponse{Status: production.StatusCode, Header: RedactHeader(production.Header), Body: productionBody, Latency: productionLatency}
+	}
+	if alternate != nil {
+		r.Alternate = &RecordedResponse{Status: alternate.StatusCode, Header: RedactHeader(alternate.Header), Body: alternateBody, Latency: alternateLatency}
+	}
+	return r
+}
+
+// RecordStore keeps records of mirrored exchanges. Implementations must be
+// safe for concurrent use; Close is called once on shutdown.
+type RecordStore interface {
+	Store(r *Record) error
+	Close() error
+}
+
+// RecordStoreOpener opens a RecordStore from the location given by -record
+type RecordStoreOpener func(location *url.URL) (RecordStore, error)
+
+var recordStores = map[string]RecordStoreOpener{}
+
+// RegisterRecordStore makes a RecordStore available for -record locations
+// with the given URL scheme. It is meant to be called from init functions.
+func RegisterRecordStore(scheme string, open RecordStoreOpener) {
+	recordStores[scheme] = open
+}
+
+// OpenRecordStore opens the store for location. A location without a scheme
+// is a file path.
+func OpenRecordStore(location string) (RecordStore, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" {
+		u = &url.URL{Scheme: "file", Path: location}
+	}
+	open, ok := recordStores[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("no record store for %q", u.Scheme)
+	}
+	return open(u)
+}
+
+func init() {
+	RegisterRecordStore("file", OpenFileStore)
+}
+
+// FileStore appends records as JSON lines to a file
+type FileStore struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// OpenFileStore opens the FileStore at the path of location, e.g. file:///var/lib/teeproxy/records.jsonl
+func OpenFileStore(location *url.URL) (RecordStore, error) {
+	f, err := os.OpenFile(location.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *FileStore) Store(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(r)
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	runtimedebug "runtime/debug"
+)
+
+// Recover wraps next so a panic while serving a request is logged with its
+// stack trace, counted and answered with a 500 instead of dropping the
+// connection
+func Recover(next http.Handler, stats *RunStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			if r == http.ErrAbortHandler {
+				panic(r) // deliberate abort, let net/http handle it
+			}
+			stats.Panic()
+			fmt.Printf("Panic serving %s %s: %v\n%s", req.Method, req.URL, r, runtimedebug.Stack())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, req)
+	})
+}
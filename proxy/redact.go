@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// redactedValue replaces the values of sensitive headers and session ids in
+// logs, recordings and other artifacts
+const redactedValue = "[REDACTED]"
+
+// defaultRedacted are the headers always redacted unless -redact=false
+var defaultRedacted = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redacts reports whether the values of the header name are redacted
+func redacts(name string) bool {
+	if !*redact {
+		return false
+	}
+	for _, redacted := range defaultRedacted {
+		if strings.EqualFold(name, redacted) {
+			return true
+		}
+	}
+	for _, redacted := range redactHeaders {
+		if strings.EqualFold(name, redacted) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactHeader returns header with the values of Authorization, Cookie,
+// Set-Cookie and the headers of -redact.header masked, for artifacts written
+// or sent elsewhere. header itself is returned if nothing is masked, a copy
+// otherwise; requests and responses are left as they are.
+func RedactHeader(header http.Header) http.Header {
+	var redacted http.Header
+	for name, values := range header {
+		if !redacts(name) {
+			continue
+		}
+		if redacted == nil {
+			redacted = header.Clone()
+		}
+		masked := make([]string, len(values))
+		for i := range masked {
+			masked[i] = redactedValue
+		}
+		redacted[name] = masked
+	}
+	if redacted == nil {
+		return header
+	}
+	return redacted
+}
+
+// Redact returns a session id or other credential masked for a log line,
+// unless -redact=false
+func Redact(value string) string {
+	if !*redact || value == "" {
+		return value
+	}
+	return redactedValue
+}
+
+// RedactURL returns u for a log line with the password of its user info and
+// the values of its query masked, unless -redact=false
+func RedactURL(u *url.URL) string {
+	if !*redact {
+		return u.String()
+	}
+	masked := *u
+	if _, ok := u.User.Password(); ok {
+		masked.User = url.UserPassword(u.User.Username(), redactedValue)
+	}
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			name, _, _ := strings.Cut(param, "=")
+			params[i] = name + "=" + redactedValue
+		}
+		masked.RawQuery = strings.Join(params, "&")
+	}
+	return masked.String()
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// RedirectHops returns how many redirects to follow for a request to path,
+// given by -redirects and overridden by -redirects.route
+func RedirectHops(path string) int {
+	if value, ok := redirectRoutes.Lookup(path); ok {
+		if hops, err := strconv.Atoi(value); err == nil {
+			return hops
+		}
+	}
+	return *redirectHops
+}
+
+// FollowRedirects follows up to hops redirects the target dialed by dialer
+// answered request with, as long as they stay on the target, and returns the
+// final response. Cookies set along the way are kept in the final response.
+// The redirects are sent with ctx.
+func FollowRedirects(ctx context.Context, dialer *Failover, request *http.Request, resp *http.Response, hops int) (*http.Response, error) {
+	var cookies []string
+	for ; hops > 0; hops-- {
+		next := redirectRequest(dialer, request, resp)
+		if next == nil {
+			break
+		}
+		cookies = append(cookies, resp.Header["Set-Cookie"]...)
+		DrainBody(resp.Body)
+
+		var err error
+		if resp, _, err = dialer.Exchange(next.WithContext(ctx)); err != nil {
+			return nil, err
+		}
+		request = next
+	}
+	if len(cookies) > 0 {
+		resp.Header["Set-Cookie"] = append(cookies, resp.Header["Set-Cookie"]...)
+	}
+	return resp, nil
+}
+
+// redirectRequest returns the request following the redirect resp, or nil if
+// resp is not a redirect to be followed
+func redirectRequest(dialer *Failover, request *http.Request, resp *http.Response) *http.Request {
+	method := request.Method
+	keepBody := false
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		if method != "GET" && method != "HEAD" {
+			method = "GET"
+		}
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		keepBody = true
+	default:
+		return nil
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return nil
+	}
+	if location.Host != "" && !dialer.Serves(location.Host) && location.Host != request.Host {
+		return nil // leaves the target, let the client decide
+	}
+
+	next := &http.Request{
+		Method:     method,
+		URL:        &url.URL{Path: location.Path, RawPath: location.RawPath, RawQuery: location.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     request.Header.Clone(),
+		Host:       request.Host,
+		GetBody:    request.GetBody,
+	}
+	if keepBody && request.GetBody != nil {
+		next.Body, _ = request.GetBody()
+		next.ContentLength = request.ContentLength
+	} else {
+		next.Header.Del("Content-Length")
+		next.Header.Del("Content-Type")
+	}
+	return next
+}
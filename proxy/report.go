@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	_ "embed"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DiffWriter receives every Diff computed by the handler. Close is called once
+// on shutdown so formats that summarize a whole run can be rendered.
+type DiffWriter interface {
+	Write(d *Diff) error
+	Close() error
+}
+
+// NewDiffWriter returns a DiffWriter for the given format writing to path, or
+// to stdout if path is empty. Supported formats are jsonl, junit and html.
+func NewDiffWriter(format, path string) (DiffWriter, error) {
+	var out io.WriteCloser = nopWriteCloser{os.Stdout}
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	switch format {
+	case "jsonl":
+		return &jsonlWriter{out: out, enc: json.NewEncoder(out)}, nil
+	case "junit":
+		return newSummaryWriter(out, renderJUnit), nil
+	case "html":
+		return newSummaryWriter(out, renderHTML), nil
+	}
+	out.Close()
+	return nil, fmt.Errorf("unknown diff format %q", format)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// jsonlWriter emits one JSON object per line as soon as a diff is known
+type jsonlWriter struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+	enc *json.Encoder
+}
+
+func (j *jsonlWriter) Write(d *Diff) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.enc.Encode(d)
+}
+
+func (j *jsonlWriter) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.out.Close()
+}
+
+// RouteSummary aggregates the diffs seen for one route
+type RouteSummary struct {
+	Route      string
+	Total      int
+	Mismatches int
+	Last       *Diff // last mismatch, if any
+}
+
+// Summary aggregates all diffs of a run
+type Summary struct {
+	Started    time.Time
+	Finished   time.Time
+	Total      int
+	Mismatches int
+	Routes     map[string]*RouteSummary
+}
+
+// Add accounts d in the summary. Routes of experiments are prefixed with
+// the experiment name.
+func (s *Summary) Add(d *Diff) {
+	route := d.Route
+	if d.Experiment != "" {
+		route = d.Experiment + ": " + route
+	}
+	r, ok := s.Routes[route]
+	if !ok {
+		r = &RouteSummary{Route: route}
+		s.Routes[route] = r
+	}
+	s.Total++
+	r.Total++
+	if d.Regression() {
+		s.Mismatches++
+		r.Mismatches++
+		r.Last = d
+	}
+}
+
+// SortedRoutes returns the route summaries ordered by route
+func (s *Summary) SortedRoutes() []*RouteSummary {
+	routes := make([]*RouteSummary, 0, len(s.Routes))
+	for _, r := range s.Routes {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Route < routes[j].Route })
+	return routes
+}
+
+// summaryWriter collects diffs and renders them once on Close
+type summaryWriter struct {
+	mu      sync.Mutex
+	out     io.WriteCloser
+	render  func(io.Writer, *Summary) error
+	summary Summary
+}
+
+func newSummaryWriter(out io.WriteCloser, render func(io.Writer, *Summary) error) *summaryWriter {
+	return &summaryWriter{
+		out:     out,
+		render:  render,
+		summary: Summary{Started: time.Now(), Routes: map[string]*RouteSummary{}},
+	}
+}
+
+func (s *summaryWriter) Write(d *Diff) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.summary.Add(d)
+	return nil
+}
+
+func (s *summaryWriter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.summary.Finished = time.Now()
+	err := s.render(s.out, &s.summary)
+	if cerr := s.out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+// renderJUnit writes one test case per route, failing if any response differed
+func renderJUnit(w io.Writer, s *Summary) error {
+	suite := junitTestSuite{
+		Name: "teeproxy",
+		Time: fmt.Sprintf("%.3f", s.Finished.Sub(s.Started).Seconds()),
+	}
+	for _, r := range s.SortedRoutes() {
+		tc := junitTestCase{ClassName: "teeproxy", Name: r.Route}
+		if r.Mismatches > 0 {
+			suite.Failures++
+			tc.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d of %d responses differed", r.Mismatches, r.Total),
+				Text:    fmt.Sprintf("last mismatch: %s status %d vs %d, body match %t", r.Last.URL, r.Last.ProductionStatus, r.Last.AlternateStatus, r.Last.BodyMatch),
+			}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+	suite.Tests = len(suite.TestCases)
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// reportHTML is the template of the HTML report, embedded so the binary
+// needs no files at runtime
+//
+//go:embed assets/report.html
+var reportHTML string
+
+var htmlReport = template.Must(template.New("report").Parse(reportHTML))
+
+// renderHTML writes a self-contained HTML page summarizing the run
+func renderHTML(w io.Writer, s *Summary) error {
+	return htmlReport.Execute(w, s)
+}
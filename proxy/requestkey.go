@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Names is a repeatable command line flag of comma separated names
+type Names []string
+
+func (n *Names) String() string {
+	return strings.Join(*n, ",")
+}
+
+func (n *Names) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*n = append(*n, name)
+		}
+	}
+	return nil
+}
+
+// RequestKey returns a key identifying the logical request req, to correlate
+// the diffs and records of identical requests. Requests that differ only in
+// representation get the same key: the order of query parameters and form
+// fields, the case of header names and the formatting and key order of JSON
+// bodies make no difference. Query parameters of -request.key.ignore are
+// left out, and of the headers only the ones of -request.key.header count.
+func RequestKey(req *http.Request) string {
+	hash := sha256.New()
+	hash.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+	query := req.URL.Query()
+	for _, name := range requestKeyIgnore {
+		query.Del(name)
+	}
+	hash.Write([]byte(query.Encode() + "\n")) // sorted by name
+	names := make([]string, 0, len(requestKeyHeaders))
+	for _, name := range requestKeyHeaders {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range req.Header.Values(name) {
+			hash.Write([]byte(name + ": " + strings.TrimSpace(value) + "\n"))
+		}
+	}
+	hash.Write([]byte("\n"))
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := ioutil.ReadAll(body)
+			body.Close()
+			hash.Write(canonicalBody(req.Header.Get("Content-Type"), data))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// canonicalBody returns JSON and form bodies in a canonical form, others as
+// they are
+func canonicalBody(contentType string, body []byte) []byte {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			return []byte(form.Encode())
+		}
+	case strings.HasSuffix(mediaType, "json"):
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var v interface{}
+		if err := decoder.Decode(&v); err == nil {
+			if canonical, err := json.Marshal(canonicalNumbers(v)); err == nil {
+				return canonical // objects are marshalled with sorted keys
+			}
+		}
+	}
+	return body
+}
+
+// canonicalNumbers formats the fractional numbers and exponents of a decoded
+// JSON value the same way, so 1.50 and 1.5e0 are alike. Integers are kept as
+// they are, they may exceed the precision of a float.
+func canonicalNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = canonicalNumbers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = canonicalNumbers(value)
+		}
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			if f, err := v.Float64(); err == nil {
+				return f
+			}
+		}
+	}
+	return v
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AlternateExchange is one attempt at sending the alternative request. It
+// has to be closed by the caller once done with the response.
+type AlternateExchange struct {
+	Address  string
+	Response *http.Response
+	Err      error
+	Sent     bool // the request may have reached the target
+	Attempts int  // requests sent including retries and hedges
+
+	ctx    context.Context // of the request, until closed
+	cancel context.CancelFunc
+}
+
+// transient reports whether the exchange failed on a connection error that
+// is worth retrying. Timeouts are the target being slow, not a flake, and a
+// write that may have been sent is never repeated.
+func (e *AlternateExchange) transient(method string) bool {
+	var netErr net.Error
+	if e.Err == nil || errors.As(e.Err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return !e.Sent || !isWrite(method)
+}
+
+// close cancels the exchange, which closes its connection unless the body
+// of the response was read to its end and the connection went back to the pool
+func (e *AlternateExchange) close() {
+	if e.Response != nil {
+		e.Response.Body.Close()
+	}
+	e.cancel()
+}
+
+// ExchangeAlternate sends alternativeRequest to the target dialed by dialer.
+// Failures on connection errors are retried -b.retries times, and reads that
+// aren't answered within -b.hedge are hedged with a second copy on a new
+// connection, the first response wins. The counts tell flakes of the network
+// apart from errors of the alternate target in the comparison data.
+func (h handler) ExchangeAlternate(ctx context.Context, dialer *Failover, req *http.Request, alternativeRequest *http.Request) *AlternateExchange {
+	if *altRetries <= 0 && *altHedge <= 0 {
+		return h.sendAlternate(ctx, dialer, req, alternativeRequest)
+	}
+	// every attempt needs its own copy of the body
+	var body []byte
+	if alternativeRequest.Body != nil && alternativeRequest.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(alternativeRequest.Body)
+		alternativeRequest.Body.Close()
+		if err != nil {
+			return &AlternateExchange{Err: err, Attempts: 1, ctx: ctx, cancel: func() {}}
+		}
+	}
+	attempt := func() *http.Request {
+		r := *alternativeRequest
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		return &r
+	}
+
+	attempts := 0
+	var exchange *AlternateExchange
+	for retry := 0; ; retry++ {
+		exchange = h.hedgeAlternate(ctx, dialer, req, attempt)
+		attempts += exchange.Attempts
+		if retry >= *altRetries || !exchange.transient(req.Method) || ctx.Err() != nil {
+			break
+		}
+		h.Stats.Retry()
+		if debugging(req) {
+			fmt.Printf("Retrying %s %s on the alternate target after: %v\n", req.Method, req.URL, exchange.Err)
+		}
+		exchange.close()
+	}
+	exchange.Attempts = attempts
+	return exchange
+}
+
+// hedgeAlternate sends a request made by attempt, and a second one if the
+// first isn't answered within -b.hedge. Writes aren't hedged.
+func (h handler) hedgeAlternate(ctx context.Context, dialer *Failover, req *http.Request, attempt func() *http.Request) *AlternateExchange {
+	if *altHedge <= 0 || isWrite(req.Method) {
+		return h.sendAlternate(ctx, dialer, req, attempt())
+	}
+	type hedged struct {
+		i        int
+		exchange *AlternateExchange
+	}
+	exchanges := make(chan hedged, 2)
+	var cancels []context.CancelFunc // of the attempts, to drop the slower one
+	send := func() {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		alternativeRequest := attempt()
+		go func() { exchanges <- hedged{i, h.sendAlternate(attemptCtx, dialer, req, alternativeRequest)} }()
+	}
+	send()
+	hedge := time.NewTimer(*altHedge)
+	defer hedge.Stop()
+	pending, wasHedged := 1, false
+	for {
+		select {
+		case <-hedge.C:
+			h.Stats.Hedge()
+			if debugging(req) {
+				fmt.Printf("Hedging %s %s on the alternate target, no response after %s\n", req.Method, req.URL, *altHedge)
+			}
+			pending, wasHedged = pending+1, true
+			send()
+		case done := <-exchanges:
+			pending--
+			exchange := done.exchange
+			exchange.cancel = cancels[done.i] // cancels its exchange too
+			if exchange.Err != nil && pending > 0 {
+				exchange.close() // the other one may still succeed
+				continue
+			}
+			if pending > 0 {
+				// the slower one isn't used, its connection is closed right away
+				for i, cancel := range cancels {
+					if i != done.i {
+						cancel()
+					}
+				}
+				go func() { (<-exchanges).exchange.close() }()
+			}
+			if wasHedged {
+				exchange.Attempts = 2
+			}
+			return exchange
+		}
+	}
+}
+
+// sendAlternate sends alternativeRequest to the target dialed by dialer and
+// reads the response headers
+func (h handler) sendAlternate(ctx context.Context, dialer *Failover, req *http.Request, alternativeRequest *http.Request) *AlternateExchange {
+	exchange := &AlternateExchange{Attempts: 1}
+	exchange.ctx, exchange.cancel = context.WithCancel(ctx)
+	exchange.Response, exchange.Address, exchange.Err = dialer.Exchange(alternativeRequest.WithContext(exchange.ctx))
+	exchange.Sent = exchange.Address != ""
+	if exchange.Err != nil && debugging(req) {
+		if exchange.Sent {
+			fmt.Printf("Failed to exchange with %s: %v\n", exchange.Address, exchange.Err)
+		} else {
+			fmt.Printf("Failed to connect to %s\n", strings.Join(dialer.Addresses, ", "))
+		}
+	}
+	return exchange
+}
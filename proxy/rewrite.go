@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RewriteRule maps an internal URL prefix to its public equivalent
+type RewriteRule struct {
+	From string
+	To   string
+}
+
+// RewriteRules is a repeatable from=to command line flag
+type RewriteRules []RewriteRule
+
+func (r *RewriteRules) String() string {
+	rules := make([]string, len(*r))
+	for i, rule := range *r {
+		rules[i] = rule.From + "=" + rule.To
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *RewriteRules) Set(value string) error {
+	from, to, ok := strings.Cut(value, "=")
+	if !ok || from == "" {
+		return fmt.Errorf("want from=to, got %q", value)
+	}
+	*r = append(*r, RewriteRule{From: from, To: to})
+	return nil
+}
+
+// Location rewrites a Location header value with the first rule whose From
+// is a prefix of it. Relative locations are returned unchanged.
+func (r RewriteRules) Location(location string) string {
+	for _, rule := range r {
+		if strings.HasPrefix(location, rule.From) {
+			return rule.To + location[len(rule.From):]
+		}
+	}
+	return location
+}
+
+// Body replaces internal URLs in a textual response body by their public
+// equivalents, including the escaped form used in JSON. Compressed bodies and
+// bodies bigger than -body.limit are left alone.
+func (r RewriteRules) Body(resp *http.Response) {
+	if len(r) == 0 || resp.Header.Get("Content-Encoding") != "" || !textual(resp.Header.Get("Content-Type")) {
+		return
+	}
+	var body []byte
+	if *bodyLimit > 0 {
+		body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, *bodyLimit+1))
+		if int64(len(body)) > *bodyLimit {
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return
+		}
+	} else {
+		body, _ = ioutil.ReadAll(resp.Body)
+	}
+	resp.Body.Close()
+
+	for _, rule := range r {
+		body = bytes.ReplaceAll(body, []byte(rule.From), []byte(rule.To))
+		escapedFrom := strings.ReplaceAll(rule.From, "/", `\/`)
+		escapedTo := strings.ReplaceAll(rule.To, "/", `\/`)
+		body = bytes.ReplaceAll(body, []byte(escapedFrom), []byte(escapedTo))
+	}
+	resp.Body = nopCloser{bytes.NewReader(body)}
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// textual reports whether a content type may carry absolute URLs worth rewriting
+func textual(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RouteRule assigns a value to all request paths starting with Prefix
+type RouteRule struct {
+	Prefix string
+	Value  string
+}
+
+// RouteRules is a repeatable prefix=value command line flag used for per route
+// overrides of global settings. The longest matching prefix wins.
+type RouteRules []RouteRule
+
+func (r *RouteRules) String() string {
+	rules := make([]string, len(*r))
+	for i, rule := range *r {
+		rules[i] = rule.Prefix + "=" + rule.Value
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *RouteRules) Set(value string) error {
+	prefix, v, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("want /path/prefix=value, got %q", value)
+	}
+	*r = append(*r, RouteRule{Prefix: prefix, Value: v})
+	return nil
+}
+
+// Lookup returns the value of the longest prefix matching path
+func (r RouteRules) Lookup(path string) (value string, ok bool) {
+	longest := -1
+	for _, rule := range r {
+		if strings.HasPrefix(path, rule.Prefix) && len(rule.Prefix) > longest {
+			value, ok, longest = rule.Value, true, len(rule.Prefix)
+		}
+	}
+	return value, ok
+}
+
+// Rewrite replaces the longest prefix matching path by its value
+func (r RouteRules) Rewrite(path string) (rewritten string, ok bool) {
+	longest := -1
+	for _, rule := range r {
+		if strings.HasPrefix(path, rule.Prefix) && len(rule.Prefix) > longest {
+			rewritten, ok, longest = rule.Value+path[len(rule.Prefix):], true, len(rule.Prefix)
+		}
+	}
+	return rewritten, ok
+}
+
+// ParseTimeout parses a route timeout given in seconds, like -a.timeout, or
+// as a duration like 90s
+func ParseTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("want a positive number of seconds or duration, got %q", value)
+	}
+	return timeout, nil
+}
+
+// Timeout returns the timeout of the longest prefix matching path, if any
+func (r RouteRules) Timeout(path string) (time.Duration, bool) {
+	if value, ok := r.Lookup(path); ok {
+		if timeout, err := ParseTimeout(value); err == nil {
+			return timeout, true
+		}
+	}
+	return 0, false
+}
+
+// LongestTimeout returns the longest timeout of any route, at least least
+func (r RouteRules) LongestTimeout(least time.Duration) time.Duration {
+	longest := least
+	for _, rule := range r {
+		if timeout, err := ParseTimeout(rule.Value); err == nil && timeout > longest {
+			longest = timeout
+		}
+	}
+	return longest
+}
+
+// Prefixes is a repeatable command line flag of path prefixes
+type Prefixes []string
+
+func (p *Prefixes) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *Prefixes) Set(value string) error {
+	if !strings.HasPrefix(value, "/") {
+		return fmt.Errorf("want /path/prefix, got %q", value)
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+// Match reports whether path starts with one of the prefixes
+func (p Prefixes) Match(path string) bool {
+	for _, prefix := range p {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sampleBacklog is how many sampled records a slow analyzer may fall behind
+// before further ones are dropped for it
+const sampleBacklog = 256
+
+// PairSampler streams a sample of the exchanges both targets answered, as
+// records with the request and both responses, to external analyzers
+// connected to the /samples endpoint of the admin API. Nothing is sampled
+// while no analyzer is connected.
+type PairSampler struct {
+	Percent float64
+
+	mu        sync.Mutex
+	analyzers map[*sampleAnalyzer]bool
+}
+
+type sampleAnalyzer struct {
+	route   string // path prefix of the requests sampled for it
+	records chan []byte
+}
+
+// NewPairSampler returns a PairSampler sampling percent of the exchanges
+func NewPairSampler(percent float64) *PairSampler {
+	return &PairSampler{Percent: percent, analyzers: map[*sampleAnalyzer]bool{}}
+}
+
+// Sampled reports whether the exchange of req is to be published; false for
+// a nil PairSampler
+func (s *PairSampler) Sampled(req *http.Request) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for a := range s.analyzers {
+		if strings.HasPrefix(req.URL.Path, a.route) {
+			return rand.Float64()*100 < s.Percent
+		}
+	}
+	return false
+}
+
+// Publish passes r on to the connected analyzers sampling its route. It is
+// encoded right away, the bodies are released after the request.
+func (s *PairSampler) Publish(r *Record) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	path := r.Request.URL
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for a := range s.analyzers {
+		if !strings.HasPrefix(path, a.route) {
+			continue
+		}
+		select {
+		case a.records <- line:
+		default: // the analyzer fell behind
+		}
+	}
+}
+
+// ServeHTTP streams the sampled records as JSON lines until the analyzer
+// disconnects, or limit records were sent. Only requests to paths starting
+// with route are sampled for it.
+func (s *PairSampler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	limit, err := strconv.Atoi(req.FormValue("limit"))
+	if err != nil {
+		limit = 0
+	}
+	a := &sampleAnalyzer{route: req.FormValue("route"), records: make(chan []byte, sampleBacklog)}
+	s.mu.Lock()
+	s.analyzers[a] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.analyzers, a)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for sent := 0; limit <= 0 || sent < limit; sent++ {
+		select {
+		case line := <-a.records:
+			if _, err := w.Write(line); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
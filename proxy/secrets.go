@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// secretSchemes prefix references to secrets kept elsewhere than on the
+// command line: env:NAME for an environment variable, file:/path for a file
+// and vault:path#field for a field of a HashiCorp Vault secret, read from
+// $VAULT_ADDR with $VAULT_TOKEN
+var secretSchemes = []string{"env:", "file:", "vault:"}
+
+// vaultClient reads secrets from Vault
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// cachedSecret is a secret and when it was fetched
+type cachedSecret struct {
+	value   []byte
+	fetched time.Time
+}
+
+var secretCache = struct {
+	sync.Mutex
+	secrets map[string]cachedSecret
+}{secrets: map[string]cachedSecret{}}
+
+// secretFetches lets concurrent misses of a secret share one fetch, so an
+// expired secret doesn't send a request to Vault for every caller
+var secretFetches singleflight.Group
+
+// IsSecretRef reports whether s references a secret
+func IsSecretRef(s string) bool {
+	for _, scheme := range secretSchemes {
+		if strings.HasPrefix(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Secret returns the secret referenced by ref. It is fetched again once it
+// is older than -secrets.refresh, so rotated secrets are picked up; if that
+// fails the previous value is kept.
+func Secret(ref string) ([]byte, error) {
+	secretCache.Lock()
+	cached, ok := secretCache.secrets[ref]
+	secretCache.Unlock()
+	if ok && time.Since(cached.fetched) < *secretsRefresh {
+		return cached.value, nil
+	}
+	value, err := refreshSecret(ref)
+	if err != nil {
+		if ok {
+			fmt.Printf("Failed to refresh secret %s, keeping the previous one: %v\n", ref, err)
+			return cached.value, nil
+		}
+		return nil, err
+	}
+	return value, nil
+}
+
+// refreshSecret fetches the secret referenced by ref and caches it
+func refreshSecret(ref string) ([]byte, error) {
+	value, err, _ := secretFetches.Do(ref, func() (interface{}, error) {
+		value, err := fetchSecret(ref)
+		if err != nil {
+			return nil, err
+		}
+		secretCache.Lock()
+		secretCache.secrets[ref] = cachedSecret{value: value, fetched: time.Now()}
+		secretCache.Unlock()
+		return value, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]byte), nil
+}
+
+func fetchSecret(ref string) ([]byte, error) {
+	scheme, name, _ := strings.Cut(ref, ":")
+	switch scheme {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return []byte(value), nil
+	case "file":
+		return ioutil.ReadFile(name)
+	case "vault":
+		return vaultSecret(name)
+	}
+	return nil, fmt.Errorf("unknown secret reference %q, want env:, file: or vault:", ref)
+}
+
+// vaultSecret reads a field of a secret from Vault, given as path#field. The
+// path is the API path below /v1, like secret/data/teeproxy for version 2 of
+// the key/value engine, whose fields are nested in data.
+func vaultSecret(ref string) ([]byte, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || field == "" {
+		return nil, fmt.Errorf("want vault:path#field, got vault:%s", ref)
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is not set")
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault answered %s for %s", resp.Status, path)
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+	return []byte(value), nil
+}
+
+// secretFuncs are the template funcs of templates that may contain secrets
+var secretFuncs = map[string]interface{}{
+	"secret": func(ref string) (string, error) {
+		value, err := Secret(ref)
+		return strings.TrimRight(string(value), "\r\n"), err
+	},
+}
+
+// KeyPair is a TLS certificate and key, each given as a file name or a
+// secret reference. They are loaded again every -secrets.refresh in the
+// background, so rotated certificates are used for new connections without
+// a restart and handshakes never wait for Vault.
+type KeyPair struct {
+	Cert string
+	Key  string
+
+	mu          sync.Mutex
+	certPEM     []byte
+	keyPEM      []byte
+	certificate *tls.Certificate
+	loads       singleflight.Group
+}
+
+// LoadKeyPair loads the certificate and key from cert and key, and keeps
+// loading them again every -secrets.refresh
+func LoadKeyPair(cert, key string) (*KeyPair, error) {
+	k := &KeyPair{Cert: cert, Key: key}
+	if _, err := k.load(); err != nil {
+		return nil, err
+	}
+	if *secretsRefresh > 0 {
+		go func() {
+			for range time.Tick(*secretsRefresh) {
+				k.load()
+			}
+		}()
+	}
+	return k, nil
+}
+
+// Certificate returns the last certificate loaded. It is only loaded here if
+// none was yet.
+func (k *KeyPair) Certificate() (*tls.Certificate, error) {
+	k.mu.Lock()
+	certificate := k.certificate
+	k.mu.Unlock()
+	if certificate != nil {
+		return certificate, nil
+	}
+	return k.load()
+}
+
+// load fetches the certificate and key, and parses them if they changed.
+// Concurrent loads share one fetch. If they can't be fetched or parsed, the
+// last good certificate is kept.
+func (k *KeyPair) load() (*tls.Certificate, error) {
+	certificate, err, _ := k.loads.Do("", func() (interface{}, error) {
+		certificate, err := k.fetch()
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if err != nil {
+			if k.certificate != nil {
+				fmt.Printf("Failed to reload certificate %s, keeping the previous one: %v\n", k.Cert, err)
+				return k.certificate, nil
+			}
+			return nil, err
+		}
+		return certificate, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return certificate.(*tls.Certificate), nil
+}
+
+// fetch reads the certificate and key, and parses them if they changed
+func (k *KeyPair) fetch() (*tls.Certificate, error) {
+	certPEM, err := refreshSecret(secretRef(k.Cert))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := refreshSecret(secretRef(k.Key))
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.certificate != nil && bytes.Equal(certPEM, k.certPEM) && bytes.Equal(keyPEM, k.keyPEM) {
+		return k.certificate, nil
+	}
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if k.certificate != nil {
+		fmt.Printf("Reloaded certificate %s\n", k.Cert)
+	}
+	k.certPEM, k.keyPEM, k.certificate = certPEM, keyPEM, &certificate
+	return k.certificate, nil
+}
+
+// secretRef returns s if it references a secret, else a reference to the
+// file it names
+func secretRef(s string) string {
+	if IsSecretRef(s) {
+		return s
+	}
+	return "file:" + s
+}
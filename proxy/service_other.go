@@ -0,0 +1,21 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+)
+
+// runService does nothing where there are no Windows services
+func runService() (stopped func()) {
+	return func() {}
+}
+
+// notifyService does nothing where signals control teeproxy
+func notifyService(stop, dump chan<- os.Signal) {}
+
+func serviceMain(args []string) int {
+	fmt.Fprintln(os.Stderr, "teeproxy runs as a service on Windows only")
+	return 1
+}
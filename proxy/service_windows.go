@@ -0,0 +1,190 @@
+//go:build windows
+
+package proxy
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	serviceName = "teeproxy"
+	// dumpControl is the user-defined service control that dumps the state
+	// like SIGUSR1 does on unix: sc control teeproxy 128
+	dumpControl = svc.Cmd(128)
+)
+
+// The service controls replacing the signals of unix, relayed by notifyService
+var (
+	serviceStop = make(chan os.Signal, 1)
+	serviceDump = make(chan os.Signal, 1)
+)
+
+// service reports the state of teeproxy to the service control manager
+type service struct {
+	exited chan struct{} // closed once Main is done draining
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepted}
+	for {
+		select {
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				serviceStop <- os.Interrupt
+			case dumpControl:
+				serviceDump <- os.Interrupt
+			}
+		case <-s.exited:
+			return false, 0
+		}
+	}
+}
+
+// runService runs teeproxy as a Windows service if it was started as one,
+// logging to the event log instead of stdout. stopped must be called once
+// teeproxy is done.
+func runService() (stopped func()) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return func() {}
+	}
+	if log, err := eventlog.Open(serviceName); err == nil {
+		logToEventLog(log)
+	}
+	s := &service{exited: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := svc.Run(serviceName, s); err != nil {
+			fmt.Printf("Failed to run as service: %v\n", err)
+		}
+	}()
+	return func() {
+		close(s.exited)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// notifyService relays the stop and dump controls of the service to stop and dump
+func notifyService(stop, dump chan<- os.Signal) {
+	go func() {
+		for {
+			select {
+			case s := <-serviceStop:
+				stop <- s
+			case s := <-serviceDump:
+				dump <- s
+			}
+		}
+	}()
+}
+
+// logToEventLog sends the lines written to stdout to the event log, panics
+// and failures as errors
+func logToEventLog(log *eventlog.Log) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	os.Stdout = w
+	go func() {
+		lines := bufio.NewScanner(r)
+		for lines.Scan() {
+			line := lines.Text()
+			if strings.HasPrefix(line, "Panic") || strings.HasPrefix(line, "Failed") {
+				log.Error(1, line)
+			} else {
+				log.Info(1, line)
+			}
+		}
+	}()
+}
+
+// serviceMain implements "teeproxy service install|remove". Install
+// registers teeproxy as a service started with the remaining arguments.
+func serviceMain(args []string) int {
+	flags := flag.NewFlagSet("service", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: teeproxy service install [teeproxy flags] | remove")
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	var err error
+	switch flags.Arg(0) {
+	case "install":
+		err = installService(flags.Args()[1:])
+	case "remove":
+		err = removeService()
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "teeproxy",
+		Description: "Reverse HTTP proxy duplicating requests to an alternate target",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("registering the event log source: %v", err)
+	}
+	return nil
+}
+
+func removeService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
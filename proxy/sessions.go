@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// LoadSessions adds the production to alternate session pairs read from r to
+// the session cache. Every line holds a production session id followed by the
+// matching alternate session id, separated by whitespace. Empty lines and
+// lines starting with # are ignored.
+func LoadSessions(r io.Reader, sessions *cache.Cache) (int, error) {
+	n := 0
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return n, fmt.Errorf("line %d: want production and alternate session, got %q", line, text)
+		}
+		sessions.Set(fields[0], fields[1], cache.DefaultExpiration)
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// LoadSessionsFile is LoadSessions reading from the file at path
+func LoadSessionsFile(path string, sessions *cache.Cache) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return LoadSessions(f, sessions)
+}
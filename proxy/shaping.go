@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket limiting the bytes per second passed through it.
+// It allows bursts of up to one second worth of bytes.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter passing rate bytes per second
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// Burst is the largest number of bytes Wait may be called with
+func (l *Limiter) Burst() int {
+	return int(l.rate)
+}
+
+// Wait blocks until n bytes may pass
+func (l *Limiter) Wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+// Bandwidth caps the traffic to a target, separately in each direction
+type Bandwidth struct {
+	In  *Limiter
+	Out *Limiter
+}
+
+// NewBandwidth returns a Bandwidth of rate bytes per second in each direction
+func NewBandwidth(rate int64) *Bandwidth {
+	return &Bandwidth{In: NewLimiter(rate), Out: NewLimiter(rate)}
+}
+
+// Conn returns conn with its reads and writes shaped to the bandwidth
+func (b *Bandwidth) Conn(conn net.Conn) net.Conn {
+	return &shapedConn{Conn: conn, bandwidth: b}
+}
+
+type shapedConn struct {
+	net.Conn
+	bandwidth *Bandwidth
+}
+
+// NetConn returns the connection being shaped
+func (c *shapedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if burst := c.bandwidth.In.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := c.Conn.Read(p)
+	c.bandwidth.In.Wait(n)
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if burst := c.bandwidth.Out.Burst(); len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+		c.bandwidth.Out.Wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
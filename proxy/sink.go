@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Sink is the HTTP server of "teeproxy sink": it answers every request after
+// a simulated latency, with the request echoed back or a fixed body, and
+// fails a share of the requests on purpose
+type Sink struct {
+	Status       int
+	Body         string // answered instead of the echo if not empty
+	Latency      time.Duration
+	Jitter       time.Duration // added to Latency at random, up to this much
+	ErrorPercent float64       // answered with 500 instead
+	Log          bool
+}
+
+func (s *Sink) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return // the client went away
+	}
+	delay := s.Latency
+	if s.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(s.Jitter)))
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	status := s.Status
+	if s.ErrorPercent > 0 && rand.Float64()*100 < s.ErrorPercent {
+		status = http.StatusInternalServerError
+	}
+	if s.Log {
+		fmt.Printf("%s %s %s %d bytes: %d after %s\n", req.RemoteAddr, req.Method, req.URL, len(body), status, delay)
+	}
+	if s.Body != "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.Body)))
+		w.WriteHeader(status)
+		io.WriteString(w, s.Body)
+		return
+	}
+	// the echo is the request as received, in HTTP/1.1 form
+	w.Header().Set("Content-Type", "message/http")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s %s %s\r\nHost: %s\r\n", req.Method, req.RequestURI, req.Proto, req.Host)
+	req.Header.Write(w)
+	io.WriteString(w, "\r\n")
+	w.Write(body)
+}
+
+// sinkMain implements "teeproxy sink", an echo server standing in for either
+// target to try mirroring setups and benchmark the proxy with
+func sinkMain(args []string) int {
+	flags := flag.NewFlagSet("sink", flag.ExitOnError)
+	listen := flags.String("l", ":9000", "address to listen to")
+	sink := &Sink{}
+	flags.IntVar(&sink.Status, "status", http.StatusOK, "status of the responses")
+	flags.StringVar(&sink.Body, "body", "", "body of the responses instead of the echoed request")
+	flags.DurationVar(&sink.Latency, "latency", 0, "how long every request takes")
+	flags.DurationVar(&sink.Jitter, "latency.jitter", 0, "up to how much longer a request takes at random, on top of -latency")
+	flags.Float64Var(&sink.ErrorPercent, "error.percent", 0, "percentage of the requests answered with 500 instead of -status")
+	flags.BoolVar(&sink.Log, "log", false, "log every request")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: teeproxy sink [-l address] [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 || sink.Status < 100 || sink.Status > 999 {
+		flags.Usage()
+		return 2
+	}
+	fmt.Printf("Sink listening on %s\n", *listen)
+	if err := http.ListenAndServe(*listen, sink); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,321 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sloBuckets is the number of buckets an objective's window is counted in
+const sloBuckets = 60
+
+// sloShortWindow is how much shorter the second window checked for burn
+// rate alerts is, so alerts resolve soon after the burning stops
+const sloShortWindow = 12
+
+// Objective is a service level objective over the shadow results of an
+// experiment, like status_match>=99.5%/1h or latency_delta.p95<=20ms/1h.
+// Every objective sorts requests into good and bad ones and is met while the
+// share of bad ones stays within its error budget.
+type Objective struct {
+	Name       string // as given to -slo
+	Experiment string // the experiment whose outcomes count, see -experiments
+	Metric     string
+	Budget     float64       // share of requests allowed to be bad
+	Delta      time.Duration // latency_delta: largest latency delta of a good request
+	Window     time.Duration
+
+	mu      sync.Mutex
+	buckets [sloBuckets]sloBucket
+	firing  bool
+}
+
+type sloBucket struct {
+	start     time.Time
+	good, bad int
+}
+
+// NewObjective parses an objective: [experiment:]metric>=percent/window for
+// the metrics status_match, body_match, match and alternate_success,
+// [experiment:]alternate_errors<=percent/window, or
+// [experiment:]latency_delta.pNN<=duration/window.
+func NewObjective(value string) (*Objective, error) {
+	o := &Objective{Name: value, Experiment: defaultExperiment}
+	spec := value
+	if i := strings.Index(spec, ":"); i >= 0 && !strings.ContainsAny(spec[:i], "<=>") {
+		o.Experiment, spec = spec[:i], spec[i+1:]
+	}
+	i := strings.LastIndex(spec, "/")
+	if i < 0 {
+		return nil, fmt.Errorf("want metric>=percent/window, got %q", value)
+	}
+	var err error
+	if o.Window, err = time.ParseDuration(spec[i+1:]); err != nil || o.Window < sloBuckets*time.Second {
+		return nil, fmt.Errorf("want a window of at least a minute, got %q", spec[i+1:])
+	}
+	spec = spec[:i]
+	op := ">="
+	i = strings.Index(spec, op)
+	if i < 0 {
+		op = "<="
+		if i = strings.Index(spec, op); i < 0 {
+			return nil, fmt.Errorf("want metric>=percent or metric<=limit, got %q", spec)
+		}
+	}
+	o.Metric, spec = spec[:i], spec[i+len(op):]
+	switch {
+	case o.Metric == "status_match" || o.Metric == "body_match" || o.Metric == "match" || o.Metric == "alternate_success":
+		if op != ">=" {
+			return nil, fmt.Errorf("want %s>=percent, got %q", o.Metric, value)
+		}
+		good, err := parsePercent(spec)
+		if err != nil {
+			return nil, err
+		}
+		o.Budget = 1 - good
+	case o.Metric == "alternate_errors":
+		if op != "<=" {
+			return nil, fmt.Errorf("want %s<=percent, got %q", o.Metric, value)
+		}
+		if o.Budget, err = parsePercent(spec); err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(o.Metric, "latency_delta.p"):
+		quantile, err := strconv.ParseFloat(strings.TrimPrefix(o.Metric, "latency_delta.p"), 64)
+		if err != nil || quantile <= 0 || quantile >= 100 || op != "<=" {
+			return nil, fmt.Errorf("want latency_delta.pNN<=duration, got %q", value)
+		}
+		if o.Delta, err = time.ParseDuration(spec); err != nil {
+			return nil, fmt.Errorf("want latency_delta.pNN<=duration, got %q", value)
+		}
+		o.Budget = 1 - quantile/100
+	default:
+		return nil, fmt.Errorf("unknown objective metric %q", o.Metric)
+	}
+	return o, nil
+}
+
+// parsePercent parses a percentage like 99.5% into a share from 0 to 1
+func parsePercent(s string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || p < 0 || p > 100 {
+		return 0, fmt.Errorf("want a percentage like 99.5%%, got %q", s)
+	}
+	return p / 100, nil
+}
+
+// classify reports whether o counts and whether it's bad
+func (o *Objective) classify(outcome *Outcome) (counted, bad bool) {
+	switch o.Metric {
+	case "status_match":
+		return outcome.Diff != nil, outcome.Diff != nil && !outcome.Diff.StatusMatch
+	case "body_match":
+		return outcome.Diff != nil, outcome.Diff != nil && !outcome.Diff.BodyMatch
+	case "match":
+		return outcome.Diff != nil, outcome.Diff != nil && outcome.Diff.Regression()
+	case "alternate_success", "alternate_errors":
+		return true, outcome.AlternateFailed()
+	}
+	answered := outcome.ProductionStatus != 0 && outcome.AlternateStatus != 0
+	return answered, answered && outcome.AlternateLatency-outcome.ProductionLatency > o.Delta
+}
+
+// Add counts outcome if it belongs to the experiment of o
+func (o *Objective) Add(outcome *Outcome, now time.Time) {
+	if outcome.Experiment != o.Experiment {
+		return
+	}
+	counted, bad := o.classify(outcome)
+	if !counted {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	b := o.bucket(now)
+	if bad {
+		b.bad++
+	} else {
+		b.good++
+	}
+}
+
+// bucket returns the bucket of now, emptying it if it was last used a window ago
+func (o *Objective) bucket(now time.Time) *sloBucket {
+	width := o.Window / sloBuckets
+	start := now.Truncate(width)
+	b := &o.buckets[start.UnixNano()/int64(width)%sloBuckets]
+	if !b.start.Equal(start) {
+		*b = sloBucket{start: start}
+	}
+	return b
+}
+
+// BurnRate returns how many times faster than allowed the error budget was
+// spent over the last window, 1 spends it exactly within the window
+func (o *Objective) BurnRate(window time.Duration, now time.Time) float64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	good, bad := 0, 0
+	for _, b := range o.buckets {
+		if !b.start.IsZero() && now.Sub(b.start) < window {
+			good, bad = good+b.good, bad+b.bad
+		}
+	}
+	if bad == 0 {
+		return 0
+	}
+	if o.Budget == 0 {
+		return math.Inf(1)
+	}
+	return float64(bad) / float64(good+bad) / o.Budget
+}
+
+// SLOAlert is posted to -slo.webhook when an objective starts or stops burning
+// its error budget too fast
+type SLOAlert struct {
+	Time       time.Time `json:"time"`
+	Objective  string    `json:"objective"`
+	Experiment string    `json:"experiment,omitempty"`
+	Firing     bool      `json:"firing"`
+	BurnRate   float64   `json:"burn_rate"`       // over the window of the objective
+	ShortBurn  float64   `json:"short_burn_rate"` // over a twelfth of it
+}
+
+// Evaluate returns an alert if o started or stopped burning its budget at
+// least burn times faster than allowed, both over its window and over a
+// twelfth of it
+func (o *Objective) Evaluate(burn float64, now time.Time) *SLOAlert {
+	long, short := o.BurnRate(o.Window, now), o.BurnRate(o.Window/sloShortWindow, now)
+	firing := long >= burn && short >= burn && long > 0
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if firing == o.firing {
+		return nil
+	}
+	o.firing = firing
+	alert := &SLOAlert{Time: now, Objective: o.Name, Firing: firing, BurnRate: jsonFloat(long), ShortBurn: jsonFloat(short)}
+	if o.Experiment != defaultExperiment {
+		alert.Experiment = o.Experiment
+	}
+	return alert
+}
+
+// Firing reports whether an alert of o is firing
+func (o *Objective) Firing() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.firing
+}
+
+// jsonFloat caps an infinite burn rate, JSON has no infinity
+func jsonFloat(f float64) float64 {
+	if math.IsInf(f, 1) {
+		return math.MaxFloat64
+	}
+	return f
+}
+
+// SLOs are the objectives given by -slo
+type SLOs []*Objective
+
+func (s *SLOs) String() string {
+	names := make([]string, len(*s))
+	for i, o := range *s {
+		names[i] = o.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func (s *SLOs) Set(value string) error {
+	o, err := NewObjective(value)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, o)
+	return nil
+}
+
+// Add counts the outcome of a mirrored request
+func (s SLOs) Add(outcome *Outcome) {
+	now := time.Now()
+	for _, o := range s {
+		o.Add(outcome, now)
+	}
+}
+
+// Watch evaluates the objectives every interval, logging alerts and posting
+// them as JSON to webhook unless it's empty
+func (s SLOs) Watch(interval time.Duration, burn float64, webhook string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for now := range time.Tick(interval) {
+		for _, o := range s {
+			alert := o.Evaluate(burn, now)
+			if alert == nil {
+				continue
+			}
+			state := "resolved"
+			if alert.Firing {
+				state = "firing"
+			}
+			fmt.Printf("SLO %s %s: burn rate %.2f over %s, %.2f over %s\n", o.Name, state, alert.BurnRate, o.Window, alert.ShortBurn, o.Window/sloShortWindow)
+			if webhook != "" {
+				if err := postAlert(client, webhook, alert); err != nil {
+					fmt.Printf("Failed to post SLO alert to %s: %v\n", webhook, err)
+				}
+			}
+		}
+	}
+}
+
+// postAlert posts alert as JSON to url
+func postAlert(client *http.Client, url string, alert *SLOAlert) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.SetEscapeHTML(false) // keep the objectives readable
+	if err := enc.Encode(alert); err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// writeSLOMetrics writes the burn rates and alert states of the objectives
+// to w in the Prometheus text format
+func writeSLOMetrics(w io.Writer, s SLOs) {
+	if len(s) == 0 {
+		return
+	}
+	now := time.Now()
+	fmt.Fprintln(w, "# HELP teeproxy_slo_burn_rate How many times faster than allowed an objective spends its error budget.")
+	fmt.Fprintln(w, "# TYPE teeproxy_slo_burn_rate gauge")
+	for _, o := range s {
+		for _, window := range []time.Duration{o.Window, o.Window / sloShortWindow} {
+			fmt.Fprintf(w, "teeproxy_slo_burn_rate{slo=%s,window=%s} %g\n", labelValue(o.Name), labelValue(window.String()), o.BurnRate(window, now))
+		}
+	}
+	fmt.Fprintln(w, "# HELP teeproxy_slo_firing Whether the burn rate alert of an objective is firing.")
+	fmt.Fprintln(w, "# TYPE teeproxy_slo_firing gauge")
+	for _, o := range s {
+		firing := 0
+		if o.Firing() {
+			firing = 1
+		}
+		fmt.Fprintf(w, "teeproxy_slo_firing{slo=%s} %d\n", labelValue(o.Name), firing)
+	}
+}
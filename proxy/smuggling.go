@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// net/http resolves requests with conflicting framing on its own, e.g. by
+// letting Transfer-Encoding override Content-Length, and forwards them
+// normalized. Backends behind other proxies may have resolved them
+// differently, so instead of picking a side such requests are rejected. As
+// net/http hides the conflicting headers, the connections are watched below
+// it: GuardListener follows the framing of the requests on each connection
+// like net/http does and marks the connection once one is ambiguous.
+
+// maxGuardedHeader is the largest request header watched, net/http rejects
+// larger ones by default anyway
+const maxGuardedHeader = http.DefaultMaxHeaderBytes + 4096
+
+type guardContextKey struct{}
+
+// GuardListener wraps the connections accepted by l so that RejectAmbiguous
+// can tell when a request on them had ambiguous framing. The server must use
+// GuardContext as its ConnContext.
+func GuardListener(l net.Listener) net.Listener {
+	return guardListener{l}
+}
+
+// GuardContext makes the guard of conn available to RejectAmbiguous
+func GuardContext(ctx context.Context, conn net.Conn) context.Context {
+	if g, ok := conn.(*guardConn); ok {
+		return context.WithValue(ctx, guardContextKey{}, g)
+	}
+	return ctx
+}
+
+// RejectAmbiguous answers requests on a connection that carried an ambiguous
+// request with 400 Bad Request and closes the connection
+func RejectAmbiguous(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if g, ok := req.Context().Value(guardContextKey{}).(*guardConn); ok {
+			if reason, _ := g.ambiguous.Load().(string); reason != "" {
+				fmt.Printf("Rejected request from %s: %s\n", req.RemoteAddr, reason)
+				w.Header().Set("Connection", "close")
+				http.Error(w, "ambiguous request: "+reason, http.StatusBadRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+type guardListener struct {
+	net.Listener
+}
+
+func (l guardListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &guardConn{Conn: conn}, nil
+}
+
+// guardConn follows the requests read from it. It is only read from by the
+// goroutine net/http serves the connection with.
+type guardConn struct {
+	net.Conn
+	ambiguous atomic.Value // string, why a request was ambiguous
+	closed    atomic.Value // string, how the client closed the connection
+
+	state     int // guardHeader, guardBody, guardChunkSize, guardChunk or guardTrailer
+	line      []byte
+	header    []byte
+	remaining int64 // of the body or the chunk being skipped
+	stopped   bool  // lost track of the framing, net/http will give up too
+}
+
+const (
+	guardHeader = iota
+	guardBody
+	guardChunkSize
+	guardChunk
+	guardTrailer
+)
+
+func (c *guardConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.stopped {
+		c.follow(p[:n])
+	}
+	if err != nil && c.closed.Load() == nil {
+		if kind := closeKind(err); kind != "" {
+			c.closed.Store(kind)
+		}
+	}
+	return n, err
+}
+
+// follow advances through the requests by the bytes read
+func (c *guardConn) follow(data []byte) {
+	for len(data) > 0 && !c.stopped {
+		switch c.state {
+		case guardBody, guardChunk:
+			skip := int64(len(data))
+			if skip > c.remaining {
+				skip = c.remaining
+			}
+			data = data[skip:]
+			c.remaining -= skip
+			if c.remaining == 0 {
+				if c.state == guardBody {
+					c.state = guardHeader
+				} else {
+					c.state = guardChunkSize
+				}
+			}
+		default:
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				c.line = append(c.line, data...)
+				data = nil
+			} else {
+				c.line = append(c.line, data[:i+1]...)
+				data = data[i+1:]
+				c.endLine(bytes.TrimRight(c.line, "\r\n"))
+				c.line = c.line[:0]
+			}
+			if len(c.line)+len(c.header) > maxGuardedHeader {
+				c.stopped = true
+			}
+		}
+	}
+}
+
+func (c *guardConn) endLine(line []byte) {
+	switch c.state {
+	case guardHeader:
+		if len(line) > 0 {
+			c.header = append(append(c.header, line...), '\n')
+			return
+		}
+		if len(c.header) > 0 { // empty lines before a request are skipped
+			c.endHeader()
+		}
+	case guardChunkSize:
+		size := line
+		if i := bytes.IndexByte(size, ';'); i >= 0 {
+			size = size[:i]
+		}
+		n, err := strconv.ParseInt(string(bytes.TrimSpace(size)), 16, 64)
+		switch {
+		case len(size) == 0:
+			// the CRLF closing the previous chunk
+		case err != nil || n < 0:
+			c.stopped = true
+		case n == 0:
+			c.state = guardTrailer
+		default:
+			c.state, c.remaining = guardChunk, n
+		}
+	case guardTrailer:
+		if len(line) == 0 {
+			c.state = guardHeader
+		}
+	}
+}
+
+// endHeader decides on the framing of the request whose header was read
+func (c *guardConn) endHeader() {
+	lines := strings.Split(strings.TrimSuffix(string(c.header), "\n"), "\n")
+	c.header = c.header[:0]
+	http11 := strings.HasSuffix(lines[0], " HTTP/1.1")
+	var contentLengths, transferEncodings []string
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(name) {
+		case "content-length":
+			contentLengths = append(contentLengths, value)
+		case "transfer-encoding":
+			transferEncodings = append(transferEncodings, value)
+		}
+	}
+
+	switch {
+	case len(transferEncodings) > 0 && len(contentLengths) > 0:
+		c.reject("both Content-Length and Transfer-Encoding")
+	case len(transferEncodings) > 0 && !http11:
+		c.reject("Transfer-Encoding in an HTTP/1.0 request")
+	case len(transferEncodings) > 1 || len(transferEncodings) == 1 && !strings.EqualFold(transferEncodings[0], "chunked"):
+		c.reject("Transfer-Encoding other than chunked")
+	case len(contentLengths) > 1:
+		c.reject("more than one Content-Length")
+	}
+	if c.stopped {
+		return
+	}
+
+	switch {
+	case len(transferEncodings) > 0:
+		c.state = guardChunkSize
+	case len(contentLengths) == 1:
+		n, err := strconv.ParseInt(contentLengths[0], 10, 64)
+		if err != nil || n < 0 {
+			c.stopped = true // rejected by net/http
+			return
+		}
+		if n > 0 {
+			c.state, c.remaining = guardBody, n
+		}
+	}
+}
+
+// reject marks the connection, the framing of what follows can't be trusted
+func (c *guardConn) reject(reason string) {
+	c.ambiguous.Store(reason)
+	c.stopped = true
+}
+
+// hopHeaders only apply to the connection they were sent on
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// RemoveHopHeaders removes the hop-by-hop headers from a request or response
+// to be forwarded, including the ones named by its Connection header
+func RemoveHopHeaders(header http.Header) {
+	for _, connection := range header["Connection"] {
+		for _, name := range strings.Split(connection, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// SNIRoute sends the requests of TLS connections for Host, as named by the
+// client with SNI, to a pair of targets of its own. The connections are
+// terminated with the certificate in Cert and Key, files or secret references.
+type SNIRoute struct {
+	Host string `json:"host"`
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	A    string `json:"a"` // production target
+	B    string `json:"b"` // alternate target, comma separated addresses tried in order
+
+	keyPair *KeyPair
+}
+
+// LoadSNIRoutes reads a JSON array of SNI routes from path and loads their certificates
+func LoadSNIRoutes(path string) ([]*SNIRoute, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var routes []*SNIRoute
+	if err := json.NewDecoder(f).Decode(&routes); err != nil {
+		return nil, err
+	}
+	hosts := map[string]bool{}
+	for _, r := range routes {
+		r.Host = strings.ToLower(r.Host)
+		switch {
+		case r.Host == "":
+			return nil, fmt.Errorf("route without a host")
+		case hosts[r.Host]:
+			return nil, fmt.Errorf("more than one route for %s", r.Host)
+		case r.A == "" || r.B == "":
+			return nil, fmt.Errorf("route for %s needs both targets", r.Host)
+		}
+		hosts[r.Host] = true
+		r.keyPair, err = LoadKeyPair(r.Cert, r.Key)
+		if err != nil {
+			return nil, fmt.Errorf("route for %s: %v", r.Host, err)
+		}
+	}
+	return routes, nil
+}
+
+// ListenerTLS returns the configuration terminating TLS with the certificate
+// of the route for the server name the client asked for, or with
+// defaultCertificate if there is none. Without a default, connections for
+// other server names fail.
+func ListenerTLS(defaultCertificate *KeyPair, routes []*SNIRoute) *tls.Config {
+	certificates := map[string]*KeyPair{}
+	for _, r := range routes {
+		certificates[r.Host] = r.keyPair
+	}
+	return &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if c, ok := certificates[strings.ToLower(hello.ServerName)]; ok {
+				return c.Certificate()
+			}
+			if defaultCertificate == nil {
+				return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+			}
+			return defaultCertificate.Certificate()
+		},
+	}
+}
+
+// SNIRouter serves requests with the handler of the server name their TLS
+// connection was made for, and all others with Default
+type SNIRouter struct {
+	Routes  map[string]http.Handler
+	Default http.Handler
+}
+
+func (s SNIRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h, ok := s.Routes[strings.ToLower(ServerName(req))]; ok {
+		h.ServeHTTP(w, req)
+		return
+	}
+	s.Default.ServeHTTP(w, req)
+}
+
+// ServerName returns the name the client asked for with SNI, if req came in
+// over TLS. Connections below GuardListener are not seen as TLS by net/http,
+// their state is looked up from the guard.
+func ServerName(req *http.Request) string {
+	if req.TLS != nil {
+		return req.TLS.ServerName
+	}
+	if g, ok := req.Context().Value(guardContextKey{}).(*guardConn); ok {
+		if tlsConn, ok := g.Conn.(*tls.Conn); ok {
+			return tlsConn.ConnectionState().ServerName
+		}
+	}
+	return ""
+}
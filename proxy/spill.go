@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// bufferedBytes and mappedBytes are the sizes of the bodies returned by Spool
+// and not released yet, kept in memory and in memory-mapped files
+var bufferedBytes, mappedBytes int64
+
+// BufferedBytes returns the bytes of the buffered bodies in memory and mapped
+func BufferedBytes() (memory, mapped int64) {
+	return atomic.LoadInt64(&bufferedBytes), atomic.LoadInt64(&mappedBytes)
+}
+
+// counted adds n to counter until release is called
+func counted(counter *int64, n int, release func()) func() {
+	atomic.AddInt64(counter, int64(n))
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(counter, -int64(n))
+			release()
+		})
+	}
+}
+
+// Spool reads r like ioutil.ReadAll, but once more than -body.spill bytes
+// have been read the body is moved to a temporary file in -body.spill.dir,
+// which is memory-mapped and removed right away so nothing is left behind.
+// release must be called once the returned bytes are no longer used. As with
+// ioutil.ReadAll, what was read before an error is returned along with it.
+func Spool(r io.Reader) (data []byte, release func(), err error) {
+	release = func() {}
+	if *bodySpill <= 0 {
+		data, err = ioutil.ReadAll(r)
+		return data, counted(&bufferedBytes, len(data), release), err
+	}
+	data, err = ioutil.ReadAll(io.LimitReader(r, *bodySpill+1))
+	if err != nil || int64(len(data)) <= *bodySpill {
+		return data, counted(&bufferedBytes, len(data), release), err
+	}
+
+	file, err := ioutil.TempFile(*bodySpillDir, "teeproxy-body-")
+	if err != nil {
+		fmt.Printf("Failed to spill body to disk, keeping it in memory: %v\n", err)
+		rest, err := ioutil.ReadAll(r)
+		data = append(data, rest...)
+		return data, counted(&bufferedBytes, len(data), release), err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	size, err := file.Write(data)
+	if err == nil {
+		var n int64
+		n, err = io.Copy(file, r)
+		size += int(n)
+	}
+	mapped, release, mapErr := mapFile(file, size)
+	if mapErr != nil {
+		return nil, func() {}, mapErr
+	}
+	return mapped, counted(&mappedBytes, len(mapped), release), err
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// mapFile reads the first size bytes of file into memory where mapping it
+// is not supported, so spilled bodies at least don't pile up on disk
+func mapFile(file *os.File, size int) ([]byte, func(), error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(file, int64(size)))
+	return data, func() {}, err
+}
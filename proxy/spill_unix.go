@@ -0,0 +1,18 @@
+//go:build unix
+
+package proxy
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first size bytes of file read-only. The mapping stays
+// valid after the file is closed and removed.
+func mapFile(file *os.File, size int) ([]byte, func(), error) {
+	data, err := syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() { syscall.Munmap(data) }, nil
+}
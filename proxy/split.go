@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Split sends the mirrored traffic of a consistent share of the clients to a
+// second candidate build instead of -b, so both get the same client over and
+// over for a side by side comparison. Its diffs, records and metrics are
+// labeled with Name like those of an experiment.
+type Split struct {
+	Name    string
+	Source  IdentitySource
+	Percent float64 // of the clients sent to Dialer
+	Dialer  *Failover
+}
+
+// Selects reports whether the client of req belongs to the cohort of the
+// split target. Clients without an identity stay with -b.
+func (s *Split) Selects(req *http.Request) bool {
+	identity := s.Source.Identity(req)
+	if identity == "" {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(identity))
+	return float64(h.Sum32()%10000) < s.Percent*100
+}
+
+// Sample mirrors a fixed share of the requests, to keep an alternate system
+// smaller than production from being overwhelmed. Clients with an identity
+// are consistently in or out of the sample by a hash of it, independent of
+// the hash of Split; of the other requests every so many are taken, which
+// keeps the share exact without a random pick.
+type Sample struct {
+	Percent float64
+	Source  IdentitySource
+
+	anonymous uint64 // requests without an identity, accessed atomically
+}
+
+// Sampled reports whether req is to be mirrored; everything for a nil Sample
+func (s *Sample) Sampled(req *http.Request) bool {
+	if s == nil {
+		return true
+	}
+	if identity := s.Source.Identity(req); identity != "" {
+		h := fnv.New32a()
+		h.Write([]byte("sample:" + identity)) // salted, not to pick the same clients as Split
+		return float64(h.Sum32()%10000) < s.Percent*100
+	}
+	n := atomic.AddUint64(&s.anonymous, 1)
+	return uint64(float64(n)*s.Percent/100) > uint64(float64(n-1)*s.Percent/100)
+}
+
+// Head mirrors only the first Requests requests of each session, so the
+// alternate system sees many different users without bearing the whole
+// volume of each. Sessions are told apart by their identity and start over
+// once first seen longer than TTL ago. Requests without an identity, like
+// the logins starting a session, are all mirrored.
+type Head struct {
+	Requests int
+	Source   IdentitySource
+
+	sessions *cache.Cache // requests seen by identity
+}
+
+// NewHead returns a Head for sessions of ttl
+func NewHead(requests int, source IdentitySource, ttl time.Duration) *Head {
+	return &Head{Requests: requests, Source: source, sessions: cache.New(ttl, ttl)}
+}
+
+// Sampled reports whether req is among the first requests of its session;
+// everything for a nil Head
+func (s *Head) Sampled(req *http.Request) bool {
+	if s == nil {
+		return true
+	}
+	identity := s.Source.Identity(req)
+	if identity == "" {
+		return true
+	}
+	if s.sessions.Add(identity, 1, cache.DefaultExpiration) == nil {
+		return s.Requests > 0
+	}
+	n, err := s.sessions.IncrementInt(identity, 1)
+	return err == nil && n <= s.Requests
+}
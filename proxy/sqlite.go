@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS requests (
+	id                    INTEGER PRIMARY KEY,
+	time                  TIMESTAMP NOT NULL,
+	method                TEXT NOT NULL,
+	url                   TEXT NOT NULL,
+	host                  TEXT NOT NULL,
+	remote_addr           TEXT NOT NULL,
+	request_size          INTEGER NOT NULL,
+	production_status     INTEGER,
+	production_latency_ms REAL,
+	production_size       INTEGER,
+	alternate_status      INTEGER,
+	alternate_latency_ms  REAL,
+	alternate_size        INTEGER
+);
+CREATE TABLE IF NOT EXISTS diffs (
+	request_id         INTEGER PRIMARY KEY REFERENCES requests(id),
+	route              TEXT NOT NULL,
+	production_version TEXT,
+	alternate_version  TEXT,
+	status_match       BOOLEAN NOT NULL,
+	body_match         BOOLEAN NOT NULL,
+	match              BOOLEAN NOT NULL
+);
+CREATE INDEX IF NOT EXISTS diffs_route ON diffs(route);
+`
+
+func init() {
+	RegisterRecordStore("sqlite", OpenSQLiteStore)
+}
+
+// SQLiteStore keeps summaries of the recorded exchanges and their diffs in
+// an SQLite database that can be inspected with "teeproxy query". Bodies and
+// headers are not stored.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// sqlitePath returns the database file of sqlite:///abs/path or sqlite:rel/path
+func sqlitePath(location *url.URL) string {
+	if location.Opaque != "" {
+		return location.Opaque
+	}
+	return location.Path
+}
+
+// OpenSQLiteStore opens or creates the database at location, e.g. sqlite:///var/lib/teeproxy/records.db
+func OpenSQLiteStore(location *url.URL) (RecordStore, error) {
+	db, err := sql.Open("sqlite", sqlitePath(location))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Store(r *Record) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var productionStatus, productionSize, alternateStatus, alternateSize sql.NullInt64
+	var productionLatency, alternateLatency sql.NullFloat64
+	if r.Production != nil {
+		productionStatus = sql.NullInt64{Int64: int64(r.Production.Status), Valid: true}
+		productionSize = sql.NullInt64{Int64: int64(len(r.Production.Body)), Valid: true}
+		productionLatency = sql.NullFloat64{Float64: r.Production.Latency.Seconds() * 1000, Valid: true}
+	}
+	if r.Alternate != nil {
+		alternateStatus = sql.NullInt64{Int64: int64(r.Alternate.Status), Valid: true}
+		alternateSize = sql.NullInt64{Int64: int64(len(r.Alternate.Body)), Valid: true}
+		alternateLatency = sql.NullFloat64{Float64: r.Alternate.Latency.Seconds() * 1000, Valid: true}
+	}
+	result, err := tx.Exec(`INSERT INTO requests
+		(time, method, url, host, remote_addr, request_size,
+		 production_status, production_latency_ms, production_size,
+		 alternate_status, alternate_latency_ms, alternate_size)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Time, r.Request.Method, r.Request.URL, r.Request.Host, r.Request.RemoteAddr, len(r.Request.Body),
+		productionStatus, productionLatency, productionSize,
+		alternateStatus, alternateLatency, alternateSize)
+	if err != nil {
+		return err
+	}
+	if d := r.Diff; d != nil {
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO diffs
+			(request_id, route, production_version, alternate_version, status_match, body_match, match)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			id, d.Route, d.ProductionVersion, d.AlternateVersion, d.StatusMatch, d.BodyMatch, d.Match())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// queryMain implements "teeproxy query", running ad-hoc SQL against a
+// database written with -record sqlite:...
+func queryMain(args []string) int {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	dbPath := flags.String("db", "teeproxy.db", "SQLite database written with -record sqlite:...")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: teeproxy query [-db file] SQL")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	db, err := sql.Open("sqlite", *dbPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+	rows, err := db.Query(strings.Join(flags.Args(), " "))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, strings.Join(columns, "\t"))
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fields := make([]string, len(values))
+		for i, v := range values {
+			switch v := v.(type) {
+			case nil:
+				fields[i] = "NULL"
+			case []byte:
+				fields[i] = string(v)
+			default:
+				fields[i] = fmt.Sprint(v)
+			}
+		}
+		fmt.Fprintln(out, strings.Join(fields, "\t"))
+	}
+	out.Flush()
+	if err := rows.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
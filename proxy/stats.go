@@ -0,0 +1,531 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outcome is what the handler learned about one mirrored request
+type Outcome struct {
+	Experiment        string
+	Tenant            string // empty unless -metrics.tenant is set
+	Route             string
+	ProductionStatus  int // 0 if the production request failed
+	ProductionLatency time.Duration
+	AlternateLatency  time.Duration
+	AlternateStatus   int    // 0 if the alternate request failed
+	Version           string // the alternate target reported in -version.header, if any
+	Diff              *Diff  // nil unless the responses were compared
+	Discarded         bool   // sent to -b.blackhole, which never answers
+}
+
+// AlternateFailed reports whether the alternate request failed or was
+// answered with a server error
+func (o *Outcome) AlternateFailed() bool {
+	return !o.Discarded && (o.AlternateStatus == 0 || o.AlternateStatus >= 500)
+}
+
+// RunStats aggregates the outcomes of all mirrored requests of a run. Once
+// Limit requests have finished Done is closed.
+type RunStats struct {
+	Limit    int
+	Done     chan struct{}
+	Statuses *StatusTable
+	SLOs     SLOs
+	Digest   *DigestCollector // nil unless -digest.interval is set
+
+	ProductionLatencies *Histogram
+	AlternateLatencies  *Histogram
+
+	once sync.Once
+
+	productionInFlight int64 // accessed atomically
+	alternatePending   int64 // accessed atomically
+	panics             int64 // accessed atomically
+	retries            int64 // accessed atomically
+	hedges             int64 // accessed atomically
+	cookieLeaks        int64 // accessed atomically
+	productionRequests int64 // accessed atomically
+	skipped            int64 // accessed atomically
+	sessionHits        int64 // accessed atomically
+	sessionMisses      int64 // accessed atomically
+
+	mu                sync.Mutex
+	requests          int
+	errors            int
+	compared          int
+	matches           int
+	expected          int           // mismatches accepted by -diff.expected
+	answered          int           // requests both targets answered
+	productionLatency time.Duration // summed over answered requests
+	alternateLatency  time.Duration // summed over answered requests
+	experiments       map[LabelKey]*LabelStats
+	tenants           map[LabelKey]*LabelStats
+	probes            map[string]*ProbeStats
+	fuzz              map[string]*FuzzStats
+	stubs             map[string]int
+	rejections        map[string]int    // by reason, see -strict
+	versions          map[string]string // last version of -version.header by target
+	fields            map[string]*FieldStats
+}
+
+// FieldStats counts the comparisons of a field, see -diff.field
+type FieldStats struct {
+	Matches    int
+	Mismatches int
+}
+
+// ProbeStats counts the follow-ups of a probe
+type ProbeStats struct {
+	Passed int
+	Failed int
+}
+
+// FuzzStats counts the variants of a mutation of -fuzz
+type FuzzStats struct {
+	Sent     int
+	Failures int // answered with a 5xx or not at all
+}
+
+// LabelKey is the experiment or tenant counted by LabelStats, and the version
+// of the alternate target that answered. Keeping the version apart keeps
+// the counts of each build instead of mixing them into one series.
+type LabelKey struct {
+	Label   string
+	Version string
+}
+
+// LabelStats counts the outcomes of the requests mirrored for one experiment
+// or tenant
+type LabelStats struct {
+	Requests   int
+	Errors     int
+	Compared   int
+	Mismatches int // regressions, not counting the expected differences
+	Expected   int // mismatches accepted by -diff.expected
+}
+
+func (l *LabelStats) add(o *Outcome) {
+	l.Requests++
+	if o.AlternateFailed() {
+		l.Errors++
+	}
+	if o.Diff != nil {
+		l.Compared++
+		if o.Diff.Regression() {
+			l.Mismatches++
+		} else if !o.Diff.Match() {
+			l.Expected++
+		}
+	}
+}
+
+// NewRunStats returns RunStats for a run bounded to limit requests, 0 for no
+// bound, with latency histograms of DefaultBuckets
+func NewRunStats(limit int) *RunStats {
+	return &RunStats{
+		Limit:               limit,
+		Done:                make(chan struct{}),
+		Statuses:            NewStatusTable(),
+		ProductionLatencies: NewHistogram(DefaultBuckets),
+		AlternateLatencies:  NewHistogram(DefaultBuckets),
+		experiments:         map[LabelKey]*LabelStats{},
+		tenants:             map[LabelKey]*LabelStats{},
+		probes:              map[string]*ProbeStats{},
+		fuzz:                map[string]*FuzzStats{},
+		stubs:               map[string]int{},
+		rejections:          map[string]int{},
+		versions:            map[string]string{},
+		fields:              map[string]*FieldStats{},
+	}
+}
+
+// ProductionStart must be called when a request is received
+func (s *RunStats) ProductionStart() {
+	atomic.AddInt64(&s.productionInFlight, 1)
+	atomic.AddInt64(&s.productionRequests, 1)
+}
+
+// Skip counts a request passed on to production but not mirrored, like one
+// left out of -b.percent or of a production only method
+func (s *RunStats) Skip() {
+	atomic.AddInt64(&s.skipped, 1)
+}
+
+// SessionLookup counts a lookup of a production session in the session
+// cache, found or not
+func (s *RunStats) SessionLookup(found bool) {
+	if found {
+		atomic.AddInt64(&s.sessionHits, 1)
+	} else {
+		atomic.AddInt64(&s.sessionMisses, 1)
+	}
+}
+
+// Traffic returns the requests received, those not mirrored and the session
+// cache hits and misses
+func (s *RunStats) Traffic() (requests, skipped, hits, misses int64) {
+	return atomic.LoadInt64(&s.productionRequests), atomic.LoadInt64(&s.skipped), atomic.LoadInt64(&s.sessionHits), atomic.LoadInt64(&s.sessionMisses)
+}
+
+// ProductionDone must be called once the production response has been written
+func (s *RunStats) ProductionDone() {
+	atomic.AddInt64(&s.productionInFlight, -1)
+}
+
+// Start must be called before the alternate request is sent
+func (s *RunStats) Start() {
+	atomic.AddInt64(&s.alternatePending, 1)
+}
+
+// Finish records the outcome of a request passed to Start
+func (s *RunStats) Finish(o *Outcome) {
+	defer atomic.AddInt64(&s.alternatePending, -1)
+	route := o.Route
+	if o.Experiment != defaultExperiment {
+		route = o.Experiment + ": " + route
+	}
+	s.Statuses.Add(route, o.ProductionStatus, o.AlternateStatus)
+	s.SLOs.Add(o)
+	s.Digest.Add(o)
+	if o.AlternateStatus != 0 || o.Discarded {
+		s.AlternateLatencies.Observe(o.AlternateLatency)
+	}
+	s.mu.Lock()
+	labelStats(s.experiments, LabelKey{o.Experiment, o.Version}).add(o)
+	if o.Tenant != "" {
+		labelStats(s.tenants, LabelKey{o.Tenant, o.Version}).add(o)
+	}
+	s.requests++
+	if o.AlternateFailed() {
+		s.errors++
+	}
+	if o.AlternateStatus != 0 {
+		s.answered++
+		s.productionLatency += o.ProductionLatency
+		s.alternateLatency += o.AlternateLatency
+	}
+	if o.Diff != nil {
+		s.compared++
+		if o.Diff.Match() {
+			s.matches++
+		} else if !o.Diff.Regression() {
+			s.expected++
+		}
+	}
+	limitReached := s.Limit > 0 && s.requests >= s.Limit
+	s.mu.Unlock()
+
+	if limitReached {
+		s.once.Do(func() { close(s.Done) })
+	}
+}
+
+// labelStats returns the counts of key, adding them to labels if new
+func labelStats(labels map[LabelKey]*LabelStats, key LabelKey) *LabelStats {
+	l, ok := labels[key]
+	if !ok {
+		l = &LabelStats{}
+		labels[key] = l
+	}
+	return l
+}
+
+// Experiments returns a copy of the counts by experiment name and version
+func (s *RunStats) Experiments() map[LabelKey]LabelStats {
+	return s.copyLabels(s.experiments)
+}
+
+// Tenants returns a copy of the counts by tenant and version, see
+// -metrics.tenant
+func (s *RunStats) Tenants() map[LabelKey]LabelStats {
+	return s.copyLabels(s.tenants)
+}
+
+func (s *RunStats) copyLabels(labels map[LabelKey]*LabelStats) map[LabelKey]LabelStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := make(map[LabelKey]LabelStats, len(labels))
+	for label, l := range labels {
+		copied[label] = *l
+	}
+	return copied
+}
+
+// Probe counts a follow-up of the named probe
+func (s *RunStats) Probe(name string, passed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.probes[name]
+	if !ok {
+		p = &ProbeStats{}
+		s.probes[name] = p
+	}
+	if passed {
+		p.Passed++
+	} else {
+		p.Failed++
+	}
+}
+
+// Fuzz counts a variant of the named mutation sent by -fuzz
+func (s *RunStats) Fuzz(mutation string, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.fuzz[mutation]
+	if !ok {
+		f = &FuzzStats{}
+		s.fuzz[mutation] = f
+	}
+	f.Sent++
+	if failed {
+		f.Failures++
+	}
+}
+
+// Fuzzed returns a copy of the counts by mutation
+func (s *RunStats) Fuzzed() map[string]FuzzStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fuzzed := make(map[string]FuzzStats, len(s.fuzz))
+	for mutation, f := range s.fuzz {
+		fuzzed[mutation] = *f
+	}
+	return fuzzed
+}
+
+// Stub counts a request answered by the named stub of -stubs
+func (s *RunStats) Stub(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stubs[name]++
+}
+
+// Reject counts a request rejected by -strict for reason
+func (s *RunStats) Reject(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejections[reason]++
+}
+
+// Rejections returns a copy of the counts of rejected requests by reason
+func (s *RunStats) Rejections() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rejections := make(map[string]int, len(s.rejections))
+	for reason, n := range s.rejections {
+		rejections[reason] = n
+	}
+	return rejections
+}
+
+// Version notes the version a target reported in -version.header, the
+// target being production, alternate or the name of an experiment
+func (s *RunStats) Version(target, version string) {
+	if version == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versions[target] = version
+}
+
+// Versions returns a copy of the last version reported by each target
+func (s *RunStats) Versions() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := make(map[string]string, len(s.versions))
+	for target, version := range s.versions {
+		versions[target] = version
+	}
+	return versions
+}
+
+// Stubbed returns a copy of the counts by stub name
+func (s *RunStats) Stubbed() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stubbed := make(map[string]int, len(s.stubs))
+	for name, n := range s.stubs {
+		stubbed[name] = n
+	}
+	return stubbed
+}
+
+// Probes returns a copy of the counts by probe name
+func (s *RunStats) Probes() map[string]ProbeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	probes := make(map[string]ProbeStats, len(s.probes))
+	for name, p := range s.probes {
+		probes[name] = *p
+	}
+	return probes
+}
+
+// Field counts a comparison of the named field
+func (s *RunStats) Field(name string, match bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.fields[name]
+	if !ok {
+		f = &FieldStats{}
+		s.fields[name] = f
+	}
+	if match {
+		f.Matches++
+	} else {
+		f.Mismatches++
+	}
+}
+
+// Fields returns a copy of the counts by field name
+func (s *RunStats) Fields() map[string]FieldStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fields := make(map[string]FieldStats, len(s.fields))
+	for name, f := range s.fields {
+		fields[name] = *f
+	}
+	return fields
+}
+
+// Panic counts a recovered panic
+func (s *RunStats) Panic() {
+	atomic.AddInt64(&s.panics, 1)
+}
+
+// Panics returns the number of recovered panics
+func (s *RunStats) Panics() int64 {
+	return atomic.LoadInt64(&s.panics)
+}
+
+// Retry counts an alternate request sent again after a connection error
+func (s *RunStats) Retry() {
+	atomic.AddInt64(&s.retries, 1)
+}
+
+// Hedge counts an alternate request sent a second time because the first
+// wasn't answered in time
+func (s *RunStats) Hedge() {
+	atomic.AddInt64(&s.hedges, 1)
+}
+
+// CookieLeak counts n cookies of the alternate target suppressed in a
+// response to a client
+func (s *RunStats) CookieLeak(n int) {
+	atomic.AddInt64(&s.cookieLeaks, int64(n))
+}
+
+// CookieLeaks returns the number of alternate cookies suppressed in
+// responses to clients
+func (s *RunStats) CookieLeaks() int64 {
+	return atomic.LoadInt64(&s.cookieLeaks)
+}
+
+// Retries returns the number of retried and hedged alternate requests
+func (s *RunStats) Retries() (retries, hedges int64) {
+	return atomic.LoadInt64(&s.retries), atomic.LoadInt64(&s.hedges)
+}
+
+// InFlight returns the number of production requests being served and of
+// alternate requests not finished yet
+func (s *RunStats) InFlight() (production, alternate int64) {
+	return atomic.LoadInt64(&s.productionInFlight), atomic.LoadInt64(&s.alternatePending)
+}
+
+// Drain shuts server down and waits up to timeout for the requests in flight
+// to finish, logging the progress every second
+func (s *RunStats) Drain(server *http.Server, timeout time.Duration) {
+	production, alternate := s.InFlight()
+	fmt.Printf("Draining %d production requests in flight and %d pending alternate requests\n", production, alternate)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go server.Shutdown(ctx)
+
+	poll := time.NewTicker(50 * time.Millisecond)
+	defer poll.Stop()
+	lastLog := time.Now()
+	for {
+		production, alternate := s.InFlight()
+		if production == 0 && alternate == 0 {
+			fmt.Println("Drained")
+			return
+		}
+		select {
+		case <-poll.C:
+			if time.Since(lastLog) >= time.Second {
+				fmt.Printf("Draining: %d production requests in flight, %d alternate requests pending\n", production, alternate)
+				lastLog = time.Now()
+			}
+		case <-ctx.Done():
+			fmt.Printf("Gave up draining: %d production requests in flight, %d alternate requests pending\n", production, alternate)
+			return
+		}
+	}
+}
+
+// MatchRate is the percentage of compared responses that matched, leaving
+// out the expected differences
+func (s *RunStats) MatchRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return percent(s.matches, s.compared-s.expected)
+}
+
+// ErrorRate is the percentage of alternate requests that failed or answered with a 5xx
+func (s *RunStats) ErrorRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return percent(s.errors, s.requests)
+}
+
+// LatencyDelta is how much slower the alternate target answered on average
+func (s *RunStats) LatencyDelta() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.answered == 0 {
+		return 0
+	}
+	return (s.alternateLatency - s.productionLatency) / time.Duration(s.answered)
+}
+
+// Summary is a one line description of the run
+func (s *RunStats) Summary() string {
+	match, errs, delta := s.MatchRate(), s.ErrorRate(), s.LatencyDelta()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary := fmt.Sprintf("requests: %d, compared: %d, match rate: %.2f%%, alternate error rate: %.2f%%, latency delta: %v",
+		s.requests, s.compared, match, errs, delta)
+	if s.expected > 0 {
+		summary += fmt.Sprintf(", expected differences: %d", s.expected)
+	}
+	return summary
+}
+
+// Violations lists the thresholds the run did not meet. A zero minMatch or
+// maxLatencyDelta and a maxErrors of 100 disable the respective check.
+func (s *RunStats) Violations(minMatch, maxErrors float64, maxLatencyDelta time.Duration) []string {
+	var violations []string
+	if match := s.MatchRate(); minMatch > 0 && match < minMatch {
+		violations = append(violations, fmt.Sprintf("match rate %.2f%% is below %.2f%%", match, minMatch))
+	}
+	if errs := s.ErrorRate(); errs > maxErrors {
+		violations = append(violations, fmt.Sprintf("alternate error rate %.2f%% is above %.2f%%", errs, maxErrors))
+	}
+	if delta := s.LatencyDelta(); maxLatencyDelta > 0 && delta > maxLatencyDelta {
+		violations = append(violations, fmt.Sprintf("latency delta %v is above %v", delta, maxLatencyDelta))
+	}
+	return violations
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// maxStatusRoutes bounds the routes a StatusTable tells apart, further routes
+// are counted as "other"
+const maxStatusRoutes = 1000
+
+// StatusTable counts the status codes both targets answered with, by route
+type StatusTable struct {
+	mu     sync.Mutex
+	routes map[string]map[int]*[2]int // production and alternate count by status
+}
+
+// NewStatusTable returns an empty StatusTable
+func NewStatusTable() *StatusTable {
+	return &StatusTable{routes: map[string]map[int]*[2]int{}}
+}
+
+// Add counts the statuses of one request to route; 0 stands for a target
+// that did not answer
+func (t *StatusTable) Add(route string, production, alternate int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	statuses, ok := t.routes[route]
+	if !ok {
+		if len(t.routes) >= maxStatusRoutes {
+			route = "other"
+			statuses = t.routes[route]
+		}
+		if statuses == nil {
+			statuses = map[int]*[2]int{}
+			t.routes[route] = statuses
+		}
+	}
+	for i, status := range []int{production, alternate} {
+		if statuses[status] == nil {
+			statuses[status] = &[2]int{}
+		}
+		statuses[status][i]++
+	}
+}
+
+// Render writes the table to w, one line per route and status
+func (t *StatusTable) Render(w io.Writer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	routes := make([]string, 0, len(t.routes))
+	for route := range t.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTE\tSTATUS\tPRODUCTION\tALTERNATE")
+	for _, route := range routes {
+		statuses := make([]int, 0, len(t.routes[route]))
+		for status := range t.routes[route] {
+			statuses = append(statuses, status)
+		}
+		sort.Ints(statuses)
+		for _, status := range statuses {
+			label := strconv.Itoa(status)
+			if status == 0 {
+				label = "failed"
+			}
+			counts := t.routes[route][status]
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", route, label, counts[0], counts[1])
+		}
+	}
+	return tw.Flush()
+}
+
+// StatusSet is a flag of comma separated status codes and classes like 4xx
+type StatusSet []string
+
+func (s *StatusSet) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *StatusSet) Set(value string) error {
+	for _, status := range strings.Split(value, ",") {
+		status = strings.ToLower(strings.TrimSpace(status))
+		valid := len(status) == 3 && status[0] >= '1' && status[0] <= '5'
+		if strings.HasSuffix(status, "xx") {
+			valid = valid && status[1:] == "xx"
+		} else {
+			_, err := strconv.Atoi(status)
+			valid = valid && err == nil
+		}
+		if !valid {
+			return fmt.Errorf("want status codes like 404 or classes like 5xx, got %q", status)
+		}
+		*s = append(*s, status)
+	}
+	return nil
+}
+
+// Contains reports whether status is one of the codes or in one of the classes
+func (s StatusSet) Contains(status int) bool {
+	code := strconv.Itoa(status)
+	for _, v := range s {
+		if v == code || strings.HasSuffix(v, "xx") && v[0] == code[0] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Stub answers matching requests in place of production, e.g. with a
+// maintenance page during an outage or a fixed response for an endpoint
+// production doesn't have yet. The header values and the body are templates
+// executed on the request, like {{.URL.Query.Get "id"}} or
+// {{.Header.Get "X-Request-Id"}}. With Mirror the requests are still sent to
+// the alternate target and compared with the stub response.
+type Stub struct {
+	Name     string            `json:"name"`
+	Method   string            `json:"method,omitempty"` // method of the requests answered, all if empty
+	Path     string            `json:"path"`             // path prefix of the requests answered
+	Status   int               `json:"status,omitempty"` // 200 if 0
+	Header   map[string]string `json:"header,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	BodyFile string            `json:"body_file,omitempty"` // read instead of Body, relative to the stubs file
+	Mirror   bool              `json:"mirror,omitempty"`
+
+	body   *template.Template
+	header map[string]*template.Template
+}
+
+// Stubs are the stubs of -stubs, the first matching one answers
+type Stubs []*Stub
+
+// LoadStubs reads a JSON array of stubs from path
+func LoadStubs(path string) (Stubs, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var stubs Stubs
+	if err := json.NewDecoder(f).Decode(&stubs); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, s := range stubs {
+		switch {
+		case s.Name == "":
+			return nil, fmt.Errorf("stub without a name")
+		case names[s.Name]:
+			return nil, fmt.Errorf("stub name %q is taken", s.Name)
+		case !strings.HasPrefix(s.Path, "/"):
+			return nil, fmt.Errorf("stub %s needs a path starting with /", s.Name)
+		case s.Status == 0:
+			s.Status = http.StatusOK
+		case s.Status < 100 || s.Status > 999:
+			return nil, fmt.Errorf("stub %s: %d is no status code", s.Name, s.Status)
+		}
+		names[s.Name] = true
+		if s.BodyFile != "" {
+			file := s.BodyFile
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(filepath.Dir(path), file)
+			}
+			body, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("stub %s: %v", s.Name, err)
+			}
+			s.Body = string(body)
+		}
+		parse := func(text string) *template.Template {
+			if err == nil {
+				var t *template.Template
+				t, err = template.New(s.Name).Parse(text)
+				return t
+			}
+			return nil
+		}
+		s.body = parse(s.Body)
+		s.header = map[string]*template.Template{}
+		for name, value := range s.Header {
+			s.header[name] = parse(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stub %s: %v", s.Name, err)
+		}
+	}
+	return stubs, nil
+}
+
+// Match returns the first stub answering req, nil if there is none
+func (s Stubs) Match(req *http.Request) *Stub {
+	for _, stub := range s {
+		if (stub.Method == "" || strings.EqualFold(stub.Method, req.Method)) && strings.HasPrefix(req.URL.Path, stub.Path) {
+			return stub
+		}
+	}
+	return nil
+}
+
+// Response executes the templates of the stub on req and returns the
+// response to answer it with, as if production had sent it
+func (s *Stub) Response(req *http.Request) (*http.Response, error) {
+	var body bytes.Buffer
+	if err := s.body.Execute(&body, req); err != nil {
+		return nil, err
+	}
+	resp := &http.Response{
+		Status:        strconv.Itoa(s.Status) + " " + http.StatusText(s.Status),
+		StatusCode:    s.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		ContentLength: int64(body.Len()),
+		Body:          ioutil.NopCloser(&body),
+		Request:       req,
+	}
+	for name, t := range s.header {
+		var value bytes.Buffer
+		if err := t.Execute(&value, req); err != nil {
+			return nil, err
+		}
+		resp.Header.Set(name, value.String())
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+	return resp, nil
+}
@@ -0,0 +1,1530 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	runtimedebug "runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Console flags
+var (
+	listen            = flag.String("l", ":8888", "port to accept requests")
+	targetProduction  = flag.String("a", "localhost:8080", "where production traffic goes. http://localhost:8080/production")
+	debug             = flag.Bool("debug", false, "more logging, showing ignored output; same as -log.level debug")
+	logLevelName      = flag.String("log.level", "info", "log level: debug, info or warn; can be changed through the admin API")
+	productionTimeout = flag.Int("a.timeout", 3, "timeout in seconds for production traffic")
+	alternateTimeout  = flag.Int("b.timeout", 1, "timeout in seconds for alternate site traffic")
+	altDrain          = flag.Int64("b.drain", 256<<10, "how much of an unread alternate response body is read and discarded before its connection is closed")
+	altOrdered        = flag.Bool("b.ordered", false, "send the mirrored requests of a session one after the other, in the order production received them")
+	altDeadline       = flag.Duration("b.deadline", 10*time.Second, "deadline for the whole alternate leg of a request, from connecting to reading the body")
+	altBlackHole      = flag.String("b.blackhole", "", "send mirrored requests without reading responses or comparing, to measure the overhead of mirroring: discard writes them to the alternate target and closes the connection, sink only writes them out in memory")
+	altKeep           = flag.Int("b.keep", 0, "most recent alternate responses kept to be looked up on /responses of the admin API by request_key or id, 0 to keep none")
+	altKeepBytes      = flag.Int("b.keep.bytes", 64<<20, "most bytes of requests and bodies kept by -b.keep, the oldest responses are dropped first")
+	altKeepID         = flag.String("b.keep.id", "X-Request-Id", "request header identifying the responses kept by -b.keep")
+	altRetries        = flag.Int("b.retries", 0, "how often an alternate request is sent again after a connection error; writes only if they weren't sent yet")
+	altHedge          = flag.Duration("b.hedge", 0, "send a second copy of an alternate read that wasn't answered after this long, the first response is used (0 disables)")
+	bodyLimit         = flag.Int64("body.limit", 0, "largest production response in bytes that is buffered; bigger ones are streamed to the client and never compared (0 buffers everything)")
+	bodySpill         = flag.Int64("body.spill", 0, "buffered response bodies larger than this many bytes are kept in memory-mapped temporary files instead of memory (0 keeps everything in memory)")
+	bodySpillDir      = flag.String("body.spill.dir", "", "directory for spilled response bodies (default the system temporary directory)")
+	altBandwidth      = flag.Int64("b.bandwidth", 0, "maximum bytes per second sent to and received from the alternate target, 0 for no limit")
+	prodHeaderBytes   = flag.Int64("a.header.bytes", 1<<20, "largest response header accepted from the production target, 0 for no limit")
+	prodHeaderFields  = flag.Int("a.header.fields", 1000, "most response header fields accepted from the production target, 0 for no limit")
+	altHeaderBytes    = flag.Int64("b.header.bytes", 1<<20, "largest response header accepted from the alternate target, 0 for no limit")
+	altHeaderFields   = flag.Int("b.header.fields", 1000, "most response header fields accepted from the alternate target, 0 for no limit")
+	prodHeaderWait    = flag.Duration("a.header.timeout", 0, "time to wait for the response header of the production target once the request was sent, 0 for no limit")
+	altHeaderWait     = flag.Duration("b.header.timeout", 0, "time to wait for the response header of the alternate target once the request was sent, 0 for no limit")
+	prodConnIdle      = flag.Duration("a.conn.idle", 0, "close connections to the production target that neither read nor wrote for this long, 0 for no limit")
+	prodConnLifetime  = flag.Duration("a.conn.lifetime", 0, "close connections to the production target, warm or in use, once they are this old, so they rotate across load balancers and DNS changes; 0 for no limit")
+	altConnIdle       = flag.Duration("b.conn.idle", 0, "close connections to the alternate target that neither read nor wrote for this long, 0 for no limit")
+	prodConnPool      = flag.Int("a.conn.pool", 32, "idle connections to the production target kept open for reuse by later requests, 0 for a new connection per request")
+	altConnPool       = flag.Int("b.conn.pool", 32, "idle connections to each alternate target kept open for reuse by later requests, 0 for a new connection per request")
+	connPoolAge       = flag.Duration("conn.pool.age", 4*time.Second, "close pooled connections idle for longer than this, below the keep-alive timeout of the targets")
+	altConnLifetime   = flag.Duration("b.conn.lifetime", 0, "close connections to the alternate target, warm or in use, once they are this old, so they rotate across load balancers and DNS changes; 0 for no limit")
+	pipeFrom          = flag.String("pipe", "", "read raw HTTP requests from this file or named pipe, - for stdin, instead of listening; stops at its end")
+	faultDelay        = flag.Duration("fault.delay", 0, "delay injected into -fault.delay.percent of the production requests")
+	faultDelayPercent = flag.Float64("fault.delay.percent", 0, "percentage of the production requests delayed by -fault.delay")
+	faultAbortPercent = flag.Float64("fault.abort.percent", 0, "percentage of the requests answered with -fault.abort.status instead of being passed on")
+	faultAbortStatus  = flag.Int("fault.abort.status", http.StatusServiceUnavailable, "status of the requests aborted by -fault.abort.percent")
+	tenantSource      = flag.String("metrics.tenant", "", "label mirrored requests on /metrics by client identity, from header:Name, cookie:Name or the claim of a bearer token as jwt:claim")
+	tenantMax         = flag.Int("metrics.tenants", 100, "tenants labeled on their own, further ones are counted as other")
+	tenantHash        = flag.Bool("metrics.tenant.hash", false, "label by a hash of the identity, for secrets like API keys")
+	metricsFile       = flag.String("metrics.file", "", "file the final metrics are written to on exit in the Prometheus text format, e.g. for the textfile collector of the node exporter")
+	metricsPush       = flag.String("metrics.push", "", "URL of a Prometheus Pushgateway the final metrics are pushed to on exit, like http://pushgateway:9091")
+	metricsPushJob    = flag.String("metrics.push.job", "teeproxy", "job the metrics are grouped by on the Pushgateway of -metrics.push")
+	warmConns         = flag.Int("warm", 0, "connections kept dialed ahead to each target, 0 to dial on demand")
+	warmAge           = flag.Duration("warm.age", 30*time.Second, "replace warm connections idle for longer than this, below the keep-alive timeout of the targets")
+	pipeFormat        = flag.String("pipe.format", "raw", "format of -pipe: raw HTTP requests or gor for a GoReplay file")
+	pipeWorkers       = flag.Int("pipe.workers", 1, "requests of -pipe served concurrently, each session in a lane of its own in the order of the stream")
+	pipeSession       = flag.String("pipe.session", "cookie:PHPSESSID", "session of the requests of -pipe kept in order with -pipe.workers, as header:Name, cookie:Name or jwt:claim")
+	pipeCheckpoint    = flag.String("pipe.checkpoint", "", "file keeping the position in -pipe after every request served, to resume an interrupted replay after it; removed at the end of the stream")
+	listenCert        = flag.String("l.tls.cert", "", "certificate file or secret reference to terminate TLS on the listener with, for SNI names without a route")
+	listenKey         = flag.String("l.tls.key", "", "key file or secret reference of -l.tls.cert")
+	secretsRefresh    = flag.Duration("secrets.refresh", time.Minute, "how long secrets and certificates are used before they are read again to pick up rotations")
+	listenHTTP3       = flag.Bool("l.http3", false, "experimental: also serve HTTP/3 on the UDP port of -l and advertise it with Alt-Svc, requires -l.tls.cert or -l.sni and a build with the http3 tag")
+	sniRoutes         = flag.String("l.sni", "", "JSON file of routes sending TLS connections for a server name to targets of their own, terminated with their own certificate")
+	productionTLS     = flag.Bool("a.tls", false, "connect to the production target with TLS")
+	alternateTLS      = flag.Bool("b.tls", false, "connect to the alternate target with TLS")
+	tlsALPN           = flag.String("tls.alpn", "http/1.1", "comma separated ALPN protocols offered to TLS targets; only http/1.1 is spoken")
+	tlsSessions       = flag.Int("tls.sessions", 256, "TLS sessions cached per target for resumption, 0 disables resumption")
+	tlsInsecure       = flag.Bool("tls.insecure", false, "don't verify the certificates of TLS targets")
+	altFailover       = flag.String("b.failover", "", "comma separated addresses of the alternate target tried in order when -b can't be connected to")
+	annotationsTTL    = flag.Duration("annotations.ttl", time.Hour, "how long values written to the annotation store are kept")
+	idRulesFile       = flag.String("ids", "", "JSON file of rules extracting the ids of created resources from both responses, to translate production ids in the requests mirrored later")
+	latencyFloor      = flag.Duration("latency.floor", 0, "hold back responses answered faster than this since the request was received, so clients don't adapt to changed timings; 0 disables it")
+	latencyBaseline   = flag.Int("latency.baseline", 0, "learn a floor per route as the median production latency of its first n requests, applied when longer than -latency.floor; 0 disables it")
+	transformsFile    = flag.String("b.transform", "", "JSON file of transforms re-encoding the bodies of mirrored requests, between JSON and forms and moving, deleting and setting JSON fields")
+	stubsFile         = flag.String("stubs", "", "JSON file of routes answered by teeproxy with static or templated responses instead of production, optionally still mirrored")
+	probesFile        = flag.String("probes", "", "JSON file of follow-up requests sent to the alternate target after it answered a matching request, templated from the responses")
+	experimentsFile   = flag.String("experiments", "", "JSON file of named experiments, each mirroring a sample of the matching requests to a target of its own")
+	altPercent        = flag.Float64("b.percent", 100, "percentage of the requests mirrored at all, the clients of -b.percent.by consistently in or out")
+	altPercentBy      = flag.String("b.percent.by", "cookie:PHPSESSID", "identity of the clients sampled by -b.percent as a whole, as header:Name, cookie:Name or jwt:claim")
+	altHead           = flag.Int("b.head", 0, "mirror only the first n requests of each session, told apart by -b.head.by; 0 mirrors them all")
+	altHeadBy         = flag.String("b.head.by", "cookie:PHPSESSID", "identity of the sessions of -b.head, as header:Name, cookie:Name or jwt:claim")
+	altHeadTTL        = flag.Duration("b.head.ttl", 24*time.Hour, "time after which a session of -b.head is mirrored again as a new one")
+	altSplit          = flag.String("b.split", "", "comma separated addresses of a second candidate build receiving the mirrored traffic of -b.split.percent of the clients instead of -b")
+	altSplitBy        = flag.String("b.split.by", "cookie:PHPSESSID", "identity of the clients split between -b and -b.split, as header:Name, cookie:Name or jwt:claim")
+	altSplitPercent   = flag.Float64("b.split.percent", 50, "percentage of the clients whose traffic is mirrored to -b.split")
+	altSplitName      = flag.String("b.split.name", "split", "experiment label of the traffic mirrored to -b.split")
+	altGreen          = flag.String("b.green", "", "comma separated addresses of a second alternate target the admin API can switch the mirrored traffic to")
+	altFailoverHold   = flag.Duration("b.failover.hold", 30*time.Second, "how long an alternate address that could not be connected to is skipped")
+	altDeferred       = flag.Bool("b.deferred", true, "send alternate requests once the production response is known; if false they are sent concurrently")
+	altMeta           = flag.Bool("b.meta", false, "add headers describing the original exchange to alternate requests: client IP, production status and latency")
+	altMetaPrefix     = flag.String("b.meta.prefix", "X-Teeproxy-", "prefix of the -b.meta headers")
+	altBaggage        = flag.String("b.baggage", "", "W3C baggage entry marking alternate requests as shadow traffic, as key=value, e.g. traffic=shadow")
+	altTraceState     = flag.String("b.tracestate", "", "tracestate entry marking alternate requests as shadow traffic, as key=value, e.g. shadow=1")
+	versionHeader     = flag.String("version.header", "", "response header carrying the backend build version, e.g. X-Build-Version")
+	showVersion       = flag.Bool("version", false, "print the version of teeproxy and exit")
+	versionResponse   = flag.String("version.response", "", "header carrying the version of teeproxy added to responses, e.g. X-Teeproxy-Version")
+	compare           = flag.Bool("compare", false, "compare alternate responses with production and report the differences")
+	diffFormat        = flag.String("diff.format", "jsonl", "format of the comparison results: jsonl, junit or html")
+	diffOut           = flag.String("diff.out", "", "file the comparison results are written to, stdout if empty")
+	diffExpected      = flag.String("diff.expected", "", "JSON file of known and accepted differences, like deprecated endpoints the alternate target answers with 404, counted apart from regressions and left out of the match rate")
+	diffOpenAPI       = flag.String("diff.openapi", "", "OpenAPI spec in JSON whose read-only response properties are ignored when comparing JSON responses")
+	recordTo          = flag.String("record", "", "store mirrored exchanges at this location, a file path or a URL like file:///var/lib/teeproxy/records.jsonl or sqlite:///var/lib/teeproxy/records.db")
+	diffExternal      = flag.String("diff.external", "", "command of a comparator process that decides whether bodies match, reading a JSON record per response pair on stdin and answering {\"match\":bool,\"reason\":string} per line on stdout")
+	diffExtTimeout    = flag.Duration("diff.external.timeout", time.Second, "how long the -diff.external comparator may take for a pair before it is restarted")
+	diffETag          = flag.Bool("diff.etag", false, "consider bodies equal without comparing them if both responses carry the same ETag")
+	runDuration       = flag.Duration("duration", 0, "stop after this long, print a summary and exit non-zero if a -gate threshold is violated")
+	runRequests       = flag.Int("requests", 0, "stop after this many mirrored requests, print a summary and exit non-zero if a -gate threshold is violated")
+	gateMatch         = flag.Float64("gate.match", 0, "minimum percentage of matching responses for a bounded run, requires -compare")
+	gateErrors        = flag.Float64("gate.errors", 100, "maximum percentage of failed alternate requests for a bounded run")
+	gateLatency       = flag.Duration("gate.latency", 0, "maximum average latency the alternate target may add for a bounded run")
+	sloBurn           = flag.Float64("slo.burn", 1, "burn rate of the error budget of an -slo objective, over its window and a twelfth of it, from which on its alert fires")
+	sloInterval       = flag.Duration("slo.interval", 10*time.Second, "how often the -slo objectives are evaluated")
+	sloWebhook        = flag.String("slo.webhook", "", "URL the alerts of the -slo objectives are posted to as JSON when they fire or resolve")
+	digestInterval    = flag.Duration("digest.interval", 0, "deliver a digest of the shadow results, volumes, match rates, the most mismatching routes and latency deltas, at this interval, like 24h; 0 disables it")
+	digestFormat      = flag.String("digest.format", "html", "format of the digests: html or markdown")
+	digestDir         = flag.String("digest.dir", "", "directory the digests are written to")
+	digestWebhook     = flag.String("digest.webhook", "", "URL the digests are posted to")
+	statusInterval    = flag.Duration("status.interval", 0, "log a table of the status codes of both targets by route at this interval, 0 disables it")
+	runAsUser         = flag.String("user", "", "user, or user:group, to switch to once the listeners are bound, e.g. to ports below 1024 as root; Unix only")
+	adminListen       = flag.String("admin.listen", "", "address of the admin API, disabled if empty")
+	metricsListen     = flag.String("metrics.listen", "", "address /metrics is served on alone, for scrapers without access to the admin API; disabled if empty")
+	redact            = flag.Bool("redact", true, "mask Authorization, Cookie, Set-Cookie, the headers of -redact.header and session ids in logs, recordings, samples and findings; -redact=false keeps them, e.g. for recordings replayed with their credentials")
+	fuzzPercent       = flag.Float64("fuzz", 0, "percentage of the mirrored requests followed by mutated variants sent to the alternate target only, to test its robustness")
+	fuzzVariants      = flag.Int("fuzz.variants", 3, "mutated variants sent per request sampled by -fuzz")
+	fuzzOut           = flag.String("fuzz.out", "", "file the variants of -fuzz the alternate target failed on, with a 5xx or no response, are appended to as JSON lines")
+	samplePairs       = flag.Float64("samples", 0, "percentage of the exchanges both targets answered streamed with both responses to the analyzers connected to /samples of the admin API")
+	credentialsFile   = flag.String("credentials", "", "file mapping production credentials to the shadow identities they are replaced with in mirrored requests, one kind production alternate per line")
+	credentialsStrip  = flag.Bool("credentials.strip", false, "remove credentials missing from the -credentials file from mirrored requests instead of passing them on")
+	sessionsFile      = flag.String("sessions.file", "", "file of production and alternate session id pairs to pre-populate the session cache with")
+	loginRequest      = flag.String("login.request", "", "template of a raw HTTP login request sent to the alternate target for unknown sessions")
+	loginUser         = flag.String("login.user", "", "request header identifying the user, available as {{.User}} in -login.request")
+	cookieDomain      = flag.String("cookie.domain", "", "domain set on production cookies returned to clients, \"-\" drops the attribute")
+	cookiePath        = flag.String("cookie.path", "", "rewrite the path prefix of production cookies returned to clients, as from=to")
+	rewriteBody       = flag.Bool("rewrite.body", false, "also apply the -rewrite rules to URLs in textual production response bodies")
+	corsMode          = flag.String("cors", "", "handling of CORS pre-flight requests: empty to mirror them like any request, pass to only forward them to production, local to answer them with the -cors.* headers")
+	corsOrigin        = flag.String("cors.origin", "", "comma-separated origins allowed by local pre-flight answers, any if empty; * answers with Access-Control-Allow-Origin: *")
+	corsMethods       = flag.String("cors.methods", "GET, HEAD, POST, PUT, PATCH, DELETE", "Access-Control-Allow-Methods of local pre-flight answers")
+	corsHeaders       = flag.String("cors.headers", "", "Access-Control-Allow-Headers of local pre-flight answers, the requested headers if empty")
+	corsCredentials   = flag.Bool("cors.credentials", false, "allow credentials in local pre-flight answers, requires -cors.origin to list the allowed origins")
+	corsMaxAge        = flag.Duration("cors.maxage", 0, "how long clients may cache local pre-flight answers")
+	graphqlManifest   = flag.String("graphql.queries", "", "persisted query manifest whose queries replace their hashes in requests to the -graphql endpoint before they are mirrored")
+	graphqlPath       = flag.String("graphql", "", "path of a GraphQL endpoint, like /graphql, whose requests are grouped, sampled and compared by operation")
+	redirectHops      = flag.Int("redirects", 0, "redirects from a target to itself followed before responding, 0 passes them through to the client")
+	rewrites          RewriteRules
+	redirectRoutes    RouteRules
+	productionRoutes  RouteRules
+	alternateRoutes   RouteRules
+	identityRoutes    Prefixes
+	floorRoutes       RouteRules
+	skipStatuses      StatusSet
+	objectives        SLOs
+	requestKeyHeaders Names
+	diffHeaders       Names
+	requestKeyIgnore  Names
+	redactHeaders     Names
+	altTargets        AlternateTargets
+	sandboxRoutes     RouteRules
+	responseHeaders   HeaderRules
+	diffFields        FieldRules
+	diffNormalize     NormalizeRules
+	diffJQ            JQRules
+	diffXMLIgnore     XPathRules
+	multipartRules    MultipartRules
+	graphqlSamples    = GraphQLSamples{}
+	graphqlIgnore     = GraphQLIgnoreRules{}
+	graphqlQueries    PersistedQueries
+	methodPolicies    = MethodPolicies{}
+	latencyBuckets    = append(Buckets(nil), DefaultBuckets...)
+)
+
+// Request validation flags
+var (
+	strict            = flag.Bool("strict", false, "reject malformed requests with 400 Bad Request before they reach either target: no valid Host, bad URL encoding, or headers beyond -strict.header.bytes and -strict.header.fields")
+	strictHeaderBytes = flag.Int("strict.header.bytes", 16384, "largest request header accepted by -strict, names and values summed up, 0 for no limit")
+	strictFields      = flag.Int("strict.header.fields", 100, "most request header fields accepted by -strict, 0 for no limit")
+)
+
+func init() {
+	flag.Var(&rewrites, "rewrite", "rewrite Location headers starting with an internal URL to a public one, as from=to; may be repeated")
+	flag.Var(methodPolicies, "method", "policy for an HTTP method, as METHOD=allow, deny (405) or production (not mirrored); may be repeated")
+	flag.Var(&multipartRules, "multipart", "change the parts of multipart bodies mirrored to the alternate target whose form name matches a glob, as [file:]name=drop, truncate:bytes or scrub[:replacement]; file: only matches file uploads; may be repeated")
+	flag.Var(&responseHeaders, "response.header", "set a header on responses to clients, as Name: value, or /prefix=Name: value for a path prefix; an empty value removes it; may be repeated")
+	flag.Var(&diffNormalize, "diff.normalize", "normalize a field of both JSON responses before comparing, as $.json.path=op with op lower, trim, round:decimals or time:skew; may be repeated")
+	flag.Var(&diffJQ, "diff.jq", "transform both JSON responses to requests to a path prefix with a jq expression before comparing them, as /prefix=expression like /orders=del(.meta); may be repeated")
+	flag.Var(&diffXMLIgnore, "diff.xml.ignore", "leave out the elements or attributes an XPath like //timestamp or /Envelope/Body/*/@id selects when comparing XML responses; may be repeated")
+	flag.Var(graphqlSamples, "graphql.sample", "percentage of the requests of a -graphql operation mirrored, as operation=percent, * for all others; may be repeated")
+	flag.Var(graphqlIgnore, "graphql.ignore", "leave out a field of the responses of a -graphql operation, * for all, when comparing them, as operation=$.json.path; may be repeated")
+	flag.Var(&diffHeaders, "diff.header", "comma separated response headers compared besides status and body, a difference fails the match; may be repeated")
+	flag.Var(&diffFields, "diff.field", "compare a field of the JSON responses, as name=$.json.path, counting its matches on /metrics; may be repeated")
+	flag.Var(&latencyBuckets, "metrics.buckets", "comma separated upper bounds in seconds of the latency histogram buckets on /metrics")
+	flag.Var(&sandboxRoutes, "b.sandbox", "send mirrored writes (all but GET, HEAD, OPTIONS and TRACE) to a path prefix to a sandbox endpoint instead, as /prefix=/sandbox/prefix; may be repeated")
+	flag.Var(&productionRoutes, "a.timeout.route", "timeout for requests to a path prefix, as /prefix=seconds or /prefix=duration, bounding the whole production exchange instead of connecting only; may be repeated")
+	flag.Var(&alternateRoutes, "b.timeout.route", "override -b.timeout and -b.deadline for requests to a path prefix, as /prefix=seconds or /prefix=duration; may be repeated")
+	flag.Var(&floorRoutes, "latency.floor.route", "override -latency.floor for requests to a path prefix, as /prefix=duration; may be repeated")
+	flag.Var(&identityRoutes, "identity", "remove Accept-Encoding from requests to a path prefix when responses are compared or recorded, so bodies are inspected uncompressed without decompressing them in teeproxy; may be repeated")
+	flag.Var(&skipStatuses, "skip.status", "production statuses, like 401,404 or 5xx, whose exchanges are neither compared nor recorded; may be repeated")
+	flag.Var(&requestKeyHeaders, "request.key.header", "comma separated request headers, besides method, path, query and body, that make requests different in the request_key of diffs and records; may be repeated")
+	flag.Var(&requestKeyIgnore, "request.key.ignore", "comma separated query parameters, like cache busters, left out of the request_key of diffs and records; may be repeated")
+	flag.Var(&objectives, "slo", "objective over the shadow results, like match>=99.5%/1h, alternate_errors<=1%/1h or latency_delta.p95<=20ms/1h, prefixed with experiment: for an experiment; may be repeated")
+	flag.Var(&redactHeaders, "redact.header", "comma separated headers, like X-Api-Key, masked like Authorization by -redact; may be repeated")
+	flag.Var(&altTargets, "b", "where testing traffic goes, localhost:8081 unless set; responses are skipped. May be repeated or a comma separated list, requests are then mirrored to all targets concurrently, each labeled by its address or name, with options like localhost:8082;name=release-b;timeout=2s;debug")
+	flag.Var(&redirectRoutes, "redirects.route", "override -redirects for requests to a path prefix, as /prefix=hops; may be repeated")
+}
+
+// handler contains the address of the main Target and the one for the Alternative target
+type handler struct {
+	Target       string
+	Alternative  string
+	AltTimeout   time.Duration // replaces -b.timeout and -b.deadline for Alternative unless 0
+	AltDebug     bool          // log every request mirrored to Alternative
+	SessionCache *cache.Cache
+	Diffs        DiffWriter // nil unless -compare is set
+	Stats        *RunStats
+	Login        *ShadowLogin        // nil unless -login.request is set
+	Records      RecordStore         // nil unless -record is set
+	Comparator   *ExternalComparator // nil unless -diff.external is set
+	Samples      *PairSampler        // nil unless -samples is set
+	Credentials  *CredentialMap      // nil unless -credentials is set
+	Fuzzer       *Fuzzer             // nil unless -fuzz is set
+	Recent       *RecentResponses    // nil unless -b.keep is set
+	Stubs        Stubs
+	Expected     ExpectedDifferences
+	Transforms   []*BodyTransform
+	Floor        *LatencyFloor // nil unless -latency.* is set
+	Cookies      *CookieGuard
+
+	TargetDialer      *Failover  // Target
+	AlternativeDialer *Failover  // Alternative followed by the -b.failover addresses
+	Alternatives      *BlueGreen // AlternativeDialer as blue and the -b.green target, nil without one
+	Experiments       []*Experiment
+	SessionOrder      *SessionQueue // nil unless -b.ordered
+	Tenants           *Tenants      // nil unless -metrics.tenant is set
+	Faults            *Faults       // nil unless -fault.* or -admin.listen is set
+	Split             *Split        // nil unless -b.split is set
+	Sample            *Sample       // nil unless -b.percent is below 100
+	Head              *Head         // nil unless -b.head is set
+	Probes            []*Probe
+	Annotations       *Annotations
+	IDRules           []*IDRule
+
+	CookieDomain   string
+	CookiePathFrom string
+	CookiePathTo   string
+}
+
+// ServeHTTP duplicates the incoming request (req) and does the request to the Target and the Alternate target discading the Alternate response
+func (h handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.Stats.ProductionStart()
+	defer h.Stats.ProductionDone()
+	received := time.Now()
+	emit(&RequestReceived{Time: received, Request: req})
+	responseHeaders.Apply(req.URL.Path, w.Header()) // for responses made up by teeproxy
+
+	mirror := true
+	switch methodPolicies.Policy(req.Method) {
+	case MethodDeny:
+		methodPolicies.DenyMethod(w, req)
+		return
+	case MethodProduction:
+		mirror = false
+	}
+	if IsPreflight(req) {
+		switch *corsMode {
+		case "local":
+			AnswerPreflight(w, req)
+			return
+		case "pass":
+			mirror = false
+		}
+	}
+
+	if h.Faults != nil && h.Faults.Inject(w) {
+		return // neither passed on nor mirrored
+	}
+	stub := h.Stubs.Match(req)
+	if stub != nil && !stub.Mirror {
+		mirror = false
+	}
+
+	alternativeRequest, productionRequest := DuplicateRequest(req)
+	RemoveHopHeaders(alternativeRequest.Header)
+	RemoveHopHeaders(productionRequest.Header)
+	// the body has been read already, which made net/http send a 100 Continue
+	// if asked for; the targets must not answer with another one
+	alternativeRequest.Header.Del("Expect")
+	productionRequest.Header.Del("Expect")
+	// Compressed bodies are inspected as they are, not decompressed; asking for
+	// identity keeps secret-bearing responses out of compression altogether,
+	// which CRIME and BREACH exploit
+	if (*compare || *recordTo != "") && identityRoutes.Match(req.URL.Path) {
+		alternativeRequest.Header.Del("Accept-Encoding")
+		productionRequest.Header.Del("Accept-Encoding")
+	}
+	if mirror && (!h.Sample.Sampled(req) || !h.Head.Sampled(req)) {
+		mirror = false
+	}
+	if mirror && len(graphqlSamples) > 0 {
+		if operation := GraphQLOperation(req); operation != "" && !graphqlSamples.Sampled(operation) {
+			mirror = false
+		}
+	}
+	var experiments []*Experiment
+	var experimentRequests []*http.Request
+	for _, e := range h.Experiments {
+		if mirror && e.Selects(req) {
+			experiments = append(experiments, e)
+			experimentRequests = append(experimentRequests, copyRequest(productionRequest))
+		}
+	}
+
+	cookieName := "PHPSESSID"
+	cookie, err := req.Cookie(cookieName)
+	if err != nil {
+		infof(req, "Failed to read cookie from request %s: %v\n", cookieName, err)
+	}
+	unmapped := false
+	if cookie != nil {
+		alternativeSessionId, found := h.SessionCache.Get(cookie.Value)
+		h.Stats.SessionLookup(found)
+		if found {
+			infof(req, "lookup HIT %s %s\n", Redact(cookie.Value), Redact(fmt.Sprint(alternativeSessionId)))
+			alternateCookie := &http.Cookie{
+				Name:     cookie.Name,
+				Value:    fmt.Sprintf("%s", alternativeSessionId),
+				Path:     cookie.Path,
+				Domain:   cookie.Domain,
+				Expires:  cookie.Expires,
+				MaxAge:   cookie.MaxAge,
+				Secure:   cookie.Secure,
+				HttpOnly: cookie.HttpOnly,
+			}
+			alternativeRequest.Header.Del("Cookie")
+			alternativeRequest.AddCookie(alternateCookie)
+		} else {
+			infof(req, "lookup MISS %s\n", Redact(cookie.Value))
+			unmapped = true
+		}
+	}
+
+	// The alternate legs learn about the production response through
+	// productionDone, which is closed without a result if production fails
+	mirrors := 0
+	if mirror {
+		mirrors = 1 + len(experiments)
+	} else {
+		h.Stats.Skip()
+	}
+	productionDone := make(chan *productionResult, mirrors)
+	defer close(productionDone)
+	// With -b.ordered the turn is taken now, in the order production receives
+	// the requests of a session, and handed on when the request won't be mirrored
+	var turn *SessionTurn
+	started := false
+	if mirror && cookie != nil && h.SessionOrder != nil {
+		turn = h.SessionOrder.Enqueue(cookie.Value)
+		defer func() {
+			if !started {
+				turn.Done()
+			}
+		}()
+	}
+	startMirrors := func(status int, latency time.Duration) {
+		started = true
+		if *altMeta {
+			AddMetadata(alternativeRequest, req, status, latency)
+			for _, r := range experimentRequests {
+				AddMetadata(r, req, status, latency)
+			}
+		}
+		h.Stats.Start()
+		go h.Mirror(req, alternativeRequest, cookie, unmapped, turn, nil, productionDone)
+		for i, e := range experiments {
+			h.Stats.Start()
+			go h.Mirror(req, experimentRequests[i], nil, false, nil, e, productionDone)
+		}
+	}
+	if mirror && !*altDeferred {
+		startMirrors(0, 0)
+	}
+
+	// Open new TCP connection to the server
+	productionStart := time.Now()
+	productionFailed := func(err error) {
+		emit(&ProductionDone{Request: req, Latency: time.Since(productionStart), Err: err})
+	}
+	var resp *http.Response
+	var bodyErr error
+	if stub != nil {
+		// answered in place of production, which is never asked
+		h.Stats.Stub(stub.Name)
+		resp, err = stub.Response(req)
+		if err != nil {
+			fmt.Printf("Failed to render stub %s for %s %s: %v\n", stub.Name, req.Method, req.URL, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			productionFailed(err)
+			return
+		}
+	} else {
+		// A route timeout bounds the whole production exchange, not just connecting
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if t, ok := productionRoutes.Timeout(req.URL.Path); ok {
+			ctx, cancel = context.WithTimeout(ctx, t)
+			defer cancel()
+		}
+		watch := WatchClient(req, cancel)
+		defer func() {
+			if resp != nil {
+				resp.Body.Close() // the connection is reused by later requests if the body was read to its end
+			}
+			watch.Stop()
+		}()
+		var address string
+		resp, address, err = h.TargetDialer.Exchange(productionRequest.WithContext(watch.Trace(ctx)))
+		if err != nil && watch.Cancelled() {
+			clientGone(req, h.Target)
+			productionFailed(err)
+			return
+		}
+		if err != nil {
+			if address == "" {
+				fmt.Printf("Failed to connect to %s: %v\n", h.Target, err)
+			} else {
+				fmt.Printf("Failed to exchange with %s: %v\n", h.Target, err)
+			}
+			if _, ok := err.(*ResponseLimitError); ok {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			} else {
+				badGateway(w)
+			}
+			productionFailed(err)
+			return
+		}
+		if hops := RedirectHops(req.URL.Path); hops > 0 {
+			resp, err = FollowRedirects(watch.Trace(ctx), h.TargetDialer, productionRequest, resp, hops)
+			if err != nil {
+				fmt.Printf("Failed to follow redirect from %s: %v\n", h.Target, err)
+				badGateway(w)
+				productionFailed(err)
+				return
+			}
+		}
+	}
+	productionLatency := time.Since(productionStart)
+	if stub == nil {
+		h.Stats.ProductionLatencies.Observe(productionLatency)
+		h.Floor.Learn(Route(req), productionLatency)
+	}
+
+	productionCookie := FindCookie(resp, cookieName)
+	productionVersion := BackendVersion(resp)
+	if stub == nil {
+		h.Stats.Version("production", productionVersion)
+	}
+	if *rewriteBody {
+		rewrites.Body(resp)
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	RemoveHopHeaders(w.Header())
+	if _, ok := resp.Header["Content-Type"]; !ok {
+		w.Header()["Content-Type"] = nil // don't let net/http sniff one
+	}
+	if setCookies := resp.Header["Set-Cookie"]; len(setCookies) > 0 && (h.CookieDomain != "" || h.CookiePathFrom != "") {
+		rewritten := make([]string, len(setCookies))
+		for i, c := range setCookies {
+			rewritten[i] = RewriteSetCookie(c, h.CookieDomain, h.CookiePathFrom, h.CookiePathTo)
+		}
+		w.Header()["Set-Cookie"] = rewritten
+	}
+	if location := resp.Header.Get("Location"); location != "" && len(rewrites) > 0 {
+		w.Header().Set("Location", rewrites.Location(location))
+	}
+	if *versionResponse != "" {
+		w.Header().Set(*versionResponse, version)
+	}
+	responseHeaders.Apply(req.URL.Path, w.Header()) // again, they override production's
+	if n := h.Cookies.Suppress(w.Header(), resp.Header); n > 0 {
+		h.Stats.CookieLeak(n)
+		fmt.Printf("Suppressed %d cookies of the alternate target in the response to %s %s\n", n, req.Method, req.URL)
+	}
+	h.Floor.Hold(req, received)
+	w.WriteHeader(resp.StatusCode)
+	var productionBody []byte
+	release, streamed := func() {}, false
+	if BodyAllowed(req.Method, resp.StatusCode) {
+		productionBody, release, streamed, bodyErr = BufferBody(w, resp.Body)
+	}
+	if bodyErr != nil {
+		// the client got part of the body only, nothing to compare
+		fmt.Printf("Failed to pass on the response from %s for %s %s: %v\n", h.Target, req.Method, req.URL, bodyErr)
+		release()
+		productionBody, release, streamed = nil, func() {}, true
+	}
+	emit(&ProductionDone{Request: req, Status: resp.StatusCode, Latency: productionLatency, Err: bodyErr})
+	if !mirror {
+		release()
+	}
+	release = releaseAfter(mirrors, release)
+	if streamed && debugging(req) {
+		fmt.Printf("Streamed response from %s for %s %s, body exceeds %d bytes\n", h.Target, req.Method, req.URL, *bodyLimit)
+	}
+
+	if mirror && *altDeferred {
+		startMirrors(resp.StatusCode, productionLatency)
+	}
+	result := &productionResult{
+		Response: resp,
+		Body:     productionBody,
+		Release:  release,
+		Streamed: streamed,
+		Latency:  productionLatency,
+		Cookie:   productionCookie,
+		Version:  productionVersion,
+	}
+	for i := 0; i < mirrors; i++ {
+		productionDone <- result
+	}
+	if bodyErr != nil {
+		// don't let net/http end the response as if it were complete, the
+		// client must see the connection break instead
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// badGateway answers for a production target that failed before sending a
+// response, so the client gets a well formed response on its connection
+func badGateway(w http.ResponseWriter) {
+	http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+}
+
+// clientGone logs a production request cancelled because the client went
+// away, there is no one left to answer
+func clientGone(req *http.Request, target string) {
+	infof(req, "Client %s went away, cancelled %s %s to %s\n", req.RemoteAddr, req.Method, req.URL, target)
+}
+
+// productionResult is what the alternate leg needs to know about the production exchange
+type productionResult struct {
+	Response *http.Response
+	Body     []byte // nil if Streamed
+	Release  func() // frees Body once all alternate legs are done with it
+	Streamed bool
+	Latency  time.Duration
+	Cookie   *http.Cookie
+	Version  string
+}
+
+// Mirror sends the alternative request to the Alternative target, or to the
+// target of experiment if not nil. If turn is not nil the request is sent
+// only after the previous one of its session got its response. Once the
+// production result is received from productionDone the responses are
+// compared and the session mapping is learned.
+func (h handler) Mirror(req *http.Request, alternativeRequest *http.Request, cookie *http.Cookie, unmapped bool, turn *SessionTurn, experiment *Experiment, productionDone <-chan *productionResult) {
+	outcome := &Outcome{Experiment: defaultExperiment, Route: Route(req)}
+	if h.Tenants != nil {
+		outcome.Tenant = h.Tenants.Label(req)
+	}
+	defer h.Stats.Finish(outcome)
+	var production *productionResult
+	defer func() {
+		if production == nil {
+			production = <-productionDone // wait for production to be done with it
+		}
+		if production != nil {
+			outcome.ProductionStatus = production.Response.StatusCode
+			production.Release()
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			h.Stats.Panic()
+			fmt.Printf("Panic mirroring %s %s to %s: %v\n%s", req.Method, req.URL, h.Alternative, r, runtimedebug.Stack())
+		}
+	}()
+
+	if turn != nil {
+		defer turn.Done()
+		select {
+		case <-turn.Wait:
+		case <-time.After(*altDeadline):
+			fmt.Printf("Gave up waiting for the previous request of session %s, sending %s %s out of order\n", Redact(cookie.Value), req.Method, req.URL)
+		}
+	}
+
+	// All connections of the alternate leg are bound to this deadline, so a
+	// slow alternate target can't hold on to the goroutine and its connection
+	timeout, deadline := time.Duration(*alternateTimeout)*time.Second, *altDeadline
+	if t, ok := alternateRoutes.Timeout(req.URL.Path); ok {
+		timeout, deadline = t, t
+	}
+	if experiment != nil && experiment.timeout > 0 {
+		timeout, deadline = experiment.timeout, experiment.timeout
+	} else if experiment == nil && h.AltTimeout > 0 {
+		timeout, deadline = h.AltTimeout, h.AltTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	dialer := h.AlternativeDialer
+	if experiment != nil {
+		dialer = experiment.Dialer
+		outcome.Experiment = experiment.Name
+	} else if h.Split != nil && h.Split.Selects(req) {
+		dialer = h.Split.Dialer
+		outcome.Experiment = h.Split.Name
+	} else if h.Alternatives != nil {
+		_, dialer = h.Alternatives.Active()
+	}
+	if unmapped && h.Login != nil {
+		h.LoginAlternative(ctx, dialer, req, cookie, alternativeRequest)
+	}
+	// the URL is shared with the production request, copy it before it's rewritten
+	alternateURL := *alternativeRequest.URL
+	alternativeRequest.URL = &alternateURL
+	if len(h.IDRules) > 0 && experiment == nil {
+		TranslateIDs(h.Annotations, alternativeRequest)
+	}
+	TagShadow(alternativeRequest)
+	if h.Credentials != nil {
+		if unmapped := h.Credentials.Map(alternativeRequest); unmapped > 0 && debugging(req) {
+			fmt.Printf("%d credentials of %s %s are not in %s\n", unmapped, req.Method, req.URL, *credentialsFile)
+		}
+	}
+	if len(sandboxRoutes) > 0 && isWrite(alternativeRequest.Method) {
+		if path, ok := sandboxRoutes.Rewrite(alternativeRequest.URL.Path); ok {
+			alternativeRequest.URL.Path, alternativeRequest.URL.RawPath = path, ""
+		}
+	}
+	if len(graphqlQueries) > 0 {
+		graphqlQueries.Expand(alternativeRequest)
+	}
+	if len(multipartRules) > 0 {
+		multipartRules.Scrub(alternativeRequest)
+	}
+	if len(h.Transforms) > 0 {
+		if err := TransformBody(h.Transforms, alternativeRequest); err != nil {
+			fmt.Printf("Failed to transform the body of %s %s: %v\n", req.Method, req.URL, err)
+		}
+	}
+
+	if *altBlackHole != "" {
+		start := time.Now()
+		err := h.BlackHole(ctx, dialer, timeout, req, alternativeRequest)
+		outcome.AlternateLatency, outcome.Discarded = time.Since(start), err == nil
+		emit(&AlternateDone{Request: req, Experiment: outcome.Experiment, Latency: outcome.AlternateLatency, Err: err})
+		return
+	}
+
+	// Open new TCP connection to the server
+	alternateStart := time.Now()
+	alternateDone := &AlternateDone{Request: req, Experiment: outcome.Experiment}
+	alternateFailed := func(err error) {
+		alternateDone.Latency, alternateDone.Err = time.Since(alternateStart), err
+		emit(alternateDone)
+	}
+	if experiment != nil && experiment.Debug || experiment == nil && h.AltDebug {
+		defer func() {
+			if alternateDone.Err != nil {
+				fmt.Printf("Experiment %s: %s %s to %s failed after %s: %v\n", outcome.Experiment, req.Method, RedactURL(req.URL), strings.Join(dialer.Addresses, ","), alternateDone.Latency, alternateDone.Err)
+			} else {
+				fmt.Printf("Experiment %s: %s %s answered by %s with %d in %s\n", outcome.Experiment, req.Method, RedactURL(req.URL), alternateDone.Address, alternateDone.Status, alternateDone.Latency)
+			}
+		}()
+	}
+	// variants of -fuzz need the body after it was sent
+	var fuzzBody []byte
+	fuzzed := h.Fuzzer.Sampled(req)
+	if fuzzed && alternativeRequest.Body != nil && alternativeRequest.Body != http.NoBody {
+		body, err := ioutil.ReadAll(alternativeRequest.Body)
+		alternativeRequest.Body.Close()
+		if err != nil {
+			alternateFailed(err)
+			return
+		}
+		fuzzBody = body
+		alternativeRequest.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	exchange := h.ExchangeAlternate(ctx, dialer, req, alternativeRequest)
+	defer exchange.close()
+	alternative := exchange.Address
+	alternateDone.Address = alternative
+	if exchange.Err == nil {
+		h.Cookies.Observe(exchange.Response.Header)
+	}
+	if exchange.Err != nil {
+		alternateFailed(exchange.Err)
+		return
+	}
+	alternativeResponse := exchange.Response
+	var err error
+	if hops := RedirectHops(req.URL.Path); hops > 0 {
+		alternativeResponse, err = FollowRedirects(exchange.ctx, dialer, alternativeRequest, alternativeResponse, hops)
+		if err != nil {
+			if debugging(req) {
+				fmt.Printf("Failed to follow redirect from %s: %v\n", alternative, err)
+			}
+			alternateFailed(err)
+			return
+		}
+		h.Cookies.Observe(alternativeResponse.Header)
+	}
+	defer func() { DrainBody(alternativeResponse.Body) }()
+	if turn != nil {
+		turn.Done() // the alternate target has processed the request
+	}
+	outcome.AlternateLatency = time.Since(alternateStart)
+	outcome.AlternateStatus = alternativeResponse.StatusCode
+	outcome.Version = BackendVersion(alternativeResponse)
+	alternateDone.Status, alternateDone.Latency = outcome.AlternateStatus, outcome.AlternateLatency
+	emit(alternateDone)
+
+	production = <-productionDone
+	if production == nil {
+		return // production failed, nothing to compare with
+	}
+	outcome.ProductionLatency = production.Latency
+
+	if *versionHeader != "" {
+		target := outcome.Experiment
+		if target == defaultExperiment {
+			target = "alternate"
+		}
+		h.Stats.Version(target, outcome.Version)
+		if debugging(req) {
+			fmt.Printf("%s %s: production version %q, alternate version %q\n", req.Method, req.URL, production.Version, outcome.Version)
+		}
+	}
+
+	// -skip.status keeps the comparisons and records to meaningful traffic
+	skipped := skipStatuses.Contains(production.Response.StatusCode)
+	recorded := h.Records != nil && !skipped
+	sampled := h.Samples.Sampled(req)
+	compared := h.Diffs != nil && !skipped && (!production.Streamed || ETagsMatch(production.Response, alternativeResponse))
+	var probes []*Probe
+	for _, p := range h.Probes {
+		if experiment == nil && p.Follows(req) {
+			probes = append(probes, p)
+		}
+	}
+	learnIDs := false
+	for _, r := range h.IDRules {
+		learnIDs = learnIDs || (experiment == nil && r.Matches(req))
+	}
+	var alternativeBody []byte
+	compareFields := compared && len(diffFields) > 0 && production.Body != nil
+	if recorded || sampled || h.Recent != nil || len(probes) > 0 || learnIDs || compareFields || (compared && (h.Comparator != nil || !ETagsMatch(production.Response, alternativeResponse))) {
+		var release func()
+		alternativeBody, release, err = Spool(alternativeResponse.Body)
+		defer release()
+		if err != nil {
+			if debugging(req) {
+				fmt.Printf("Failed to read body from %s: %v\n", alternative, err)
+			}
+			return
+		}
+	}
+	if compared {
+		outcome.Diff = Compare(req, production.Response, production.Body, alternativeResponse, alternativeBody)
+		if compareFields {
+			outcome.Diff.FieldMismatches = CompareFields(diffFields, h.Stats, production.Body, alternativeBody)
+		}
+		if h.Comparator != nil {
+			verdict, err := h.Comparator.Compare(NewRecord(req, production.Response, production.Body, production.Latency,
+				alternativeResponse, alternativeBody, outcome.AlternateLatency, outcome.Diff))
+			if err != nil {
+				fmt.Printf("Failed to compare %s %s with %s: %v\n", req.Method, req.URL, *diffExternal, err)
+			} else {
+				outcome.Diff.BodyMatch, outcome.Diff.ComparatorReason = verdict.Match, verdict.Reason
+			}
+		}
+		if !outcome.Diff.Match() {
+			outcome.Diff.Expected = h.Expected.Accepts(req, outcome.Diff)
+		}
+		if outcome.Experiment != defaultExperiment {
+			outcome.Diff.Experiment = outcome.Experiment
+		}
+		if exchange.Attempts > 1 {
+			outcome.Diff.AlternateAttempts = exchange.Attempts
+		}
+		emit(&DiffComputed{Request: req, Diff: outcome.Diff})
+		if err := h.Diffs.Write(outcome.Diff); err != nil {
+			fmt.Printf("Failed to write diff: %v\n", err)
+		}
+	}
+
+	if production.Cookie != nil && experiment == nil {
+		alternativeCookie := FindCookie(alternativeResponse, production.Cookie.Name)
+		if alternativeCookie != nil {
+			h.SessionCache.Set(production.Cookie.Value, alternativeCookie.Value, cache.DefaultExpiration)
+		}
+	}
+
+	if learnIDs {
+		LearnIDs(h.IDRules, h.Annotations, req, production.Response, production.Body, alternativeResponse, alternativeBody)
+	}
+	if len(probes) > 0 {
+		RunProbes(ctx, probes, dialer, h.Stats, &ProbeData{
+			Request:          req,
+			Production:       jsonBody(production.Body),
+			ProductionHeader: production.Response.Header,
+			Alternate:        jsonBody(alternativeBody),
+			AlternateHeader:  alternativeResponse.Header,
+		}, alternativeRequest)
+	}
+	if fuzzed {
+		h.Fuzzer.Run(dialer, timeout, deadline, h.Stats, req, alternativeRequest, fuzzBody)
+	}
+
+	if recorded || sampled {
+		record := NewRecord(req, production.Response, production.Body, production.Latency,
+			alternativeResponse, alternativeBody, outcome.AlternateLatency, outcome.Diff)
+		if outcome.Experiment != defaultExperiment {
+			record.Experiment = outcome.Experiment
+		}
+		if sampled {
+			h.Samples.Publish(record)
+		}
+		if recorded {
+			if err := h.Records.Store(record); err != nil {
+				fmt.Printf("Failed to store record: %v\n", err)
+			}
+		}
+	}
+	if h.Recent != nil {
+		// kept beyond the release of the spooled body
+		kept := NewRecord(req, nil, nil, 0, alternativeResponse, append([]byte(nil), alternativeBody...), outcome.AlternateLatency, outcome.Diff)
+		if outcome.Experiment != defaultExperiment {
+			kept.Experiment = outcome.Experiment
+		}
+		h.Recent.Add(req.Header.Get(*altKeepID), kept)
+	}
+}
+
+// alternateBandwidth is shared by the connections to all alternate targets,
+// nil unless -b.bandwidth is set
+var alternateBandwidth = sync.OnceValue(func() *Bandwidth {
+	if *altBandwidth <= 0 {
+		return nil
+	}
+	return NewBandwidth(*altBandwidth)
+})
+
+// newProductionDialer returns the dialer of a production target configured
+// by the -a.* flags
+func newProductionDialer(address string) *Failover {
+	dialer := NewFailover(0, address)
+	dialer.MaxHeaderBytes, dialer.MaxHeaderFields = *prodHeaderBytes, *prodHeaderFields
+	dialer.IdleTimeout, dialer.MaxLifetime = *prodConnIdle, *prodConnLifetime
+	dialer.DialTimeout, dialer.HeaderTimeout = time.Duration(*productionTimeout)*time.Second, *prodHeaderWait
+	dialer.MaxIdle, dialer.IdleAge = *prodConnPool, *connPoolAge
+	if *productionTLS {
+		dialer.TLS = NewUpstreamTLS(*tlsALPN, *tlsSessions, *tlsInsecure)
+	}
+	if *warmConns > 0 {
+		dialer.Prewarm(*warmConns, *warmAge, time.Duration(*productionTimeout)*time.Second)
+	}
+	return dialer
+}
+
+// newAlternativeDialer returns the dialer of an alternate target configured
+// by the -b.* flags
+func newAlternativeDialer(addresses []string) *Failover {
+	dialer := NewFailover(*altFailoverHold, addresses...)
+	dialer.MaxHeaderBytes, dialer.MaxHeaderFields = *altHeaderBytes, *altHeaderFields
+	dialer.IdleTimeout, dialer.MaxLifetime = *altConnIdle, *altConnLifetime
+	dialer.DialTimeout, dialer.HeaderTimeout = time.Duration(*alternateTimeout)*time.Second, *altHeaderWait
+	dialer.MaxIdle, dialer.IdleAge = *altConnPool, *connPoolAge
+	dialer.Bandwidth = alternateBandwidth()
+	if *alternateTLS {
+		dialer.TLS = NewUpstreamTLS(*tlsALPN, *tlsSessions, *tlsInsecure)
+	}
+	if *warmConns > 0 {
+		dialer.Prewarm(*warmConns, *warmAge, time.Duration(*alternateTimeout)*time.Second)
+	}
+	return dialer
+}
+
+// LoginAlternative mints an alternate session on the target dialed by dialer
+// for the unknown production session cookie and puts it on the alternative request
+func (h handler) LoginAlternative(ctx context.Context, dialer *Failover, req *http.Request, cookie *http.Cookie, alternativeRequest *http.Request) {
+	alternativeSessionId, err := h.Login.Login(ctx, dialer, req, cookie)
+	if err != nil {
+		if debugging(req) {
+			fmt.Printf("Failed to log in to %s for session %s: %v\n", strings.Join(dialer.Addresses, ", "), Redact(cookie.Value), err)
+		}
+		return
+	}
+	h.Cookies.ObserveCookie(cookie.Name, alternativeSessionId)
+	if debugging(req) {
+		fmt.Printf("login %s %s\n", Redact(cookie.Value), Redact(alternativeSessionId))
+	}
+	h.SessionCache.Set(cookie.Value, alternativeSessionId, cache.DefaultExpiration)
+	alternativeRequest.Header.Del("Cookie")
+	alternativeRequest.AddCookie(&http.Cookie{Name: cookie.Name, Value: alternativeSessionId})
+}
+
+// fatalf prints a configuration or startup error and exits with status 2
+func fatalf(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+	os.Exit(2)
+}
+
+// Main runs teeproxy as configured by the command line: one of the
+// subcommands, or the proxy itself, until it is shut down
+func Main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "query":
+			os.Exit(queryMain(os.Args[2:]))
+		case "service":
+			os.Exit(serviceMain(os.Args[2:]))
+		case "sink":
+			os.Exit(sinkMain(os.Args[2:]))
+		case "bench":
+			os.Exit(benchMain(os.Args[2:]))
+		}
+	}
+
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(Build())
+		return
+	}
+	if len(altTargets) == 0 {
+		altTargets.Set("localhost:8081")
+	}
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	stopped := runService()
+	defer stopped()
+
+	var local net.Listener
+	var err error
+	if *pipeFrom == "" {
+		local, err = net.Listen("tcp", *listen)
+		if err != nil {
+			fatalf("Failed to listen to %s: %v", *listen, err)
+		}
+		fmt.Printf("Starting %s on %s\n", Build(), local.Addr())
+	} else {
+		fmt.Printf("Starting %s reading requests from %s\n", Build(), *pipeFrom)
+	}
+	h := handler{
+		Target:       *targetProduction,
+		Alternative:  altTargets[0].Address,
+		AltTimeout:   altTargets[0].Timeout,
+		AltDebug:     altTargets[0].Debug,
+		SessionCache: cache.New(24*time.Hour, 60*time.Minute), // 24h expiry, run every hour
+		Stats:        NewRunStats(*runRequests),
+		CookieDomain: *cookieDomain,
+	}
+	h.Annotations = NewAnnotations(*annotationsTTL)
+	h.Cookies = NewCookieGuard(24 * time.Hour) // as long as the session cache
+	h.Floor = NewLatencyFloor(*latencyFloor, floorRoutes, *latencyBaseline)
+	h.Stats.ProductionLatencies = NewHistogram(latencyBuckets)
+	h.Stats.AlternateLatencies = NewHistogram(latencyBuckets)
+	if *faultDelayPercent > 0 || *faultAbortPercent > 0 || *adminListen != "" {
+		settings := FaultSettings{Delay: *faultDelay, DelayPercent: *faultDelayPercent, AbortPercent: *faultAbortPercent, AbortStatus: *faultAbortStatus}
+		if err := settings.Validate(); err != nil {
+			fatalf("Invalid -fault.*: %v", err)
+		}
+		h.Faults = NewFaults(settings)
+	}
+	if *tenantSource != "" {
+		tenants, err := NewTenants(*tenantSource, *tenantMax, *tenantHash)
+		if err != nil {
+			fatalf("Invalid -metrics.tenant: %v", err)
+		}
+		h.Tenants = tenants
+	}
+	if *cookiePath != "" {
+		from, to, ok := strings.Cut(*cookiePath, "=")
+		if !ok {
+			fatalf("Invalid -cookie.path %q, want from=to", *cookiePath)
+		}
+		h.CookiePathFrom, h.CookiePathTo = from, to
+	}
+	if *corsMode != "" && *corsMode != "pass" && *corsMode != "local" {
+		fatalf("Invalid -cors %q, want pass or local", *corsMode)
+	}
+	if *corsCredentials {
+		// reflecting any origin would let every site make credentialed requests
+		origins := corsOrigins()
+		if len(origins) == 0 {
+			fatalf("-cors.credentials needs -cors.origin to list the allowed origins")
+		}
+		for _, origin := range origins {
+			if origin == "*" {
+				fatalf("-cors.credentials can't be used with -cors.origin *")
+			}
+		}
+	}
+	if *warmConns > 0 && *warmAge <= 0 {
+		fatalf("-warm.age must be positive")
+	}
+	if (*prodConnPool > 0 || *altConnPool > 0) && *connPoolAge <= 0 {
+		fatalf("-conn.pool.age must be positive")
+	}
+	level, err := ParseLogLevel(*logLevelName)
+	if err != nil {
+		fatalf("Invalid -log.level: %v", err)
+	}
+	if *debug {
+		level = LogDebug
+	}
+	SetLogLevel(level)
+	if *altBlackHole != "" && *altBlackHole != "discard" && *altBlackHole != "sink" {
+		fatalf("Invalid -b.blackhole %q, want discard or sink", *altBlackHole)
+	}
+	if *pipeWorkers < 1 {
+		fatalf("-pipe.workers must be at least 1")
+	}
+	pipeLanes := PipeLanes{Workers: *pipeWorkers}
+	if pipeLanes.Session, err = ParseIdentitySource(*pipeSession); err != nil {
+		fatalf("Invalid -pipe.session: %v", err)
+	}
+	if *pipeFormat != "raw" && *pipeFormat != "gor" {
+		fatalf("Invalid -pipe.format %q, want raw or gor", *pipeFormat)
+	}
+	for name, routes := range map[string]RouteRules{"a.timeout.route": productionRoutes, "b.timeout.route": alternateRoutes} {
+		for _, r := range routes {
+			if _, err := ParseTimeout(r.Value); err != nil {
+				fatalf("Invalid -%s for %s: %v", name, r.Prefix, err)
+			}
+		}
+	}
+	for _, r := range floorRoutes {
+		if floor, err := time.ParseDuration(r.Value); err != nil || floor < 0 {
+			fatalf("Invalid -latency.floor.route for %s: want a duration, got %q", r.Prefix, r.Value)
+		}
+	}
+	for name, entry := range map[string]string{"b.baggage": *altBaggage, "b.tracestate": *altTraceState} {
+		if entry != "" && !ValidTraceEntry(entry) {
+			fatalf("Invalid -%s %q, want key=value", name, entry)
+		}
+	}
+	if *gateMatch > 0 && !*compare {
+		fatalf("-gate.match requires -compare")
+	}
+	if *digestInterval > 0 && (*digestFormat != "html" && *digestFormat != "markdown" || *digestDir == "" && *digestWebhook == "") {
+		fatalf("-digest.interval requires -digest.format html or markdown and -digest.dir or -digest.webhook")
+	}
+	if *diffExternal != "" && !*compare {
+		fatalf("-diff.external requires -compare")
+	}
+	h.TargetDialer = newProductionDialer(h.Target)
+	alternatives := []string{h.Alternative}
+	if *altFailover != "" {
+		alternatives = append(alternatives, strings.Split(*altFailover, ",")...)
+	}
+	h.AlternativeDialer = newAlternativeDialer(alternatives)
+	if *altGreen != "" {
+		h.Alternatives = &BlueGreen{Blue: h.AlternativeDialer, Green: newAlternativeDialer(strings.Split(*altGreen, ","))}
+	}
+	if !(*altPercent >= 0 && *altPercent <= 100) {
+		fatalf("Invalid -b.percent %v, want 0 to 100", *altPercent)
+	}
+	if *altPercent < 100 {
+		source, err := ParseIdentitySource(*altPercentBy)
+		if err != nil {
+			fatalf("Invalid -b.percent.by: %v", err)
+		}
+		h.Sample = &Sample{Percent: *altPercent, Source: source}
+	}
+	if *altHead > 0 {
+		source, err := ParseIdentitySource(*altHeadBy)
+		if err != nil {
+			fatalf("Invalid -b.head.by: %v", err)
+		}
+		if *altHeadTTL <= 0 {
+			fatalf("Invalid -b.head.ttl %v, want a positive duration", *altHeadTTL)
+		}
+		h.Head = NewHead(*altHead, source, *altHeadTTL)
+	}
+	if *altSplit != "" {
+		source, err := ParseIdentitySource(*altSplitBy)
+		if err != nil {
+			fatalf("Invalid -b.split.by: %v", err)
+		}
+		if *altSplitPercent < 0 || *altSplitPercent > 100 || *altSplitName == defaultExperiment {
+			fatalf("Invalid -b.split.percent %v or -b.split.name %q", *altSplitPercent, *altSplitName)
+		}
+		h.Split = &Split{Name: *altSplitName, Source: source, Percent: *altSplitPercent, Dialer: newAlternativeDialer(strings.Split(*altSplit, ","))}
+	}
+	if *diffOpenAPI != "" {
+		diffIgnore, err = LoadOpenAPIIgnoreRules(*diffOpenAPI)
+		if err != nil {
+			fatalf("Failed to load OpenAPI spec %s: %v", *diffOpenAPI, err)
+		}
+		fmt.Printf("Ignoring read-only fields of %d operations from %s\n", len(diffIgnore), *diffOpenAPI)
+	}
+	if *graphqlManifest != "" {
+		graphqlQueries, err = LoadPersistedQueries(*graphqlManifest)
+		if err != nil {
+			fatalf("Failed to load persisted queries %s: %v", *graphqlManifest, err)
+		}
+		fmt.Printf("Expanding %d persisted queries from %s\n", len(graphqlQueries), *graphqlManifest)
+	}
+	if *altOrdered {
+		h.SessionOrder = NewSessionQueue()
+	}
+	for _, target := range altTargets[1:] {
+		h.Experiments = append(h.Experiments, target.Experiment())
+	}
+	if *experimentsFile != "" {
+		experiments, err := LoadExperiments(*experimentsFile)
+		if err != nil {
+			fatalf("Failed to load experiments from %s: %v", *experimentsFile, err)
+		}
+		h.Experiments = append(h.Experiments, experiments...)
+	}
+	names := map[string]bool{}
+	for _, e := range h.Experiments {
+		if names[e.Name] {
+			fatalf("Experiment name %q is taken", e.Name)
+		}
+		names[e.Name] = true
+	}
+	if *idRulesFile != "" {
+		h.IDRules, err = LoadIDRules(*idRulesFile)
+		if err != nil {
+			fatalf("Failed to load id rules from %s: %v", *idRulesFile, err)
+		}
+	}
+	if *stubsFile != "" {
+		h.Stubs, err = LoadStubs(*stubsFile)
+		if err != nil {
+			fatalf("Failed to load stubs from %s: %v", *stubsFile, err)
+		}
+	}
+	if *diffExpected != "" {
+		h.Expected, err = LoadExpectedDifferences(*diffExpected)
+		if err != nil {
+			fatalf("Failed to load expected differences from %s: %v", *diffExpected, err)
+		}
+	}
+	if *transformsFile != "" {
+		h.Transforms, err = LoadBodyTransforms(*transformsFile)
+		if err != nil {
+			fatalf("Failed to load body transforms from %s: %v", *transformsFile, err)
+		}
+	}
+	if *probesFile != "" {
+		h.Probes, err = LoadProbes(*probesFile, h.Annotations)
+		if err != nil {
+			fatalf("Failed to load probes from %s: %v", *probesFile, err)
+		}
+	}
+	if *recordTo != "" {
+		h.Records, err = OpenRecordStore(*recordTo)
+		if err != nil {
+			fatalf("Failed to open record store %s: %v", *recordTo, err)
+		}
+	}
+	if *loginRequest != "" {
+		h.Login, err = LoadShadowLogin(*loginRequest, *loginUser)
+		if err != nil {
+			fatalf("Failed to load login request %s: %v", *loginRequest, err)
+		}
+	}
+	if *credentialsFile != "" {
+		h.Credentials, err = LoadCredentialsFile(*credentialsFile)
+		if err != nil {
+			fatalf("Failed to load credentials from %s: %v", *credentialsFile, err)
+		}
+		h.Credentials.Strip = *credentialsStrip
+	}
+	if *sessionsFile != "" {
+		n, err := LoadSessionsFile(*sessionsFile, h.SessionCache)
+		if err != nil {
+			fatalf("Failed to load sessions from %s: %v", *sessionsFile, err)
+		}
+		fmt.Printf("Loaded %d sessions from %s\n", n, *sessionsFile)
+	}
+	if *compare {
+		h.Diffs, err = NewDiffWriter(*diffFormat, *diffOut)
+		if err != nil {
+			fatalf("Failed to open diff output: %v", err)
+		}
+	}
+	if *diffExternal != "" {
+		h.Comparator, err = NewExternalComparator(*diffExternal, *diffExtTimeout)
+		if err != nil {
+			fatalf("Failed to start comparator %s: %v", *diffExternal, err)
+		}
+		defer h.Comparator.Close()
+	}
+
+	if len(objectives) > 0 {
+		h.Stats.SLOs = objectives
+		go objectives.Watch(*sloInterval, *sloBurn, *sloWebhook)
+	}
+
+	if *fuzzPercent > 0 {
+		if *fuzzVariants < 1 {
+			fatalf("-fuzz.variants must be at least 1")
+		}
+		h.Fuzzer = &Fuzzer{Percent: *fuzzPercent, Variants: *fuzzVariants}
+		if *fuzzOut != "" {
+			out, err := os.OpenFile(*fuzzOut, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				fatalf("Failed to open -fuzz.out: %v", err)
+			}
+			defer out.Close()
+			h.Fuzzer.Out = out
+		}
+	}
+	if *altKeep > 0 {
+		h.Recent = &RecentResponses{Max: *altKeep, MaxBytes: *altKeepBytes}
+	}
+	if *samplePairs > 0 {
+		h.Samples = NewPairSampler(*samplePairs)
+	}
+
+	digestSink := DigestSink{Format: *digestFormat, Dir: *digestDir, Webhook: *digestWebhook}
+	if *digestInterval > 0 {
+		h.Stats.Digest = NewDigestCollector()
+		go digestSink.Run(h.Stats.Digest, *digestInterval)
+	}
+
+	if *statusInterval > 0 {
+		go func() {
+			for range time.Tick(*statusInterval) {
+				var table strings.Builder
+				h.Stats.Statuses.Render(&table)
+				fmt.Printf("Status codes by route:\n%s", table.String())
+			}
+		}()
+	}
+
+	if *adminListen != "" {
+		// bound right away, before -user drops the privileges to
+		admin, err := net.Listen("tcp", *adminListen)
+		if err != nil {
+			fatalf("Failed to serve admin API on %s: %v", *adminListen, err)
+		}
+		go func() {
+			if err := http.Serve(admin, AdminHandler(h)); err != nil {
+				fmt.Printf("Failed to serve admin API on %s: %v\n", *adminListen, err)
+			}
+		}()
+	}
+	if *metricsListen != "" {
+		metrics, err := net.Listen("tcp", *metricsListen)
+		if err != nil {
+			fatalf("Failed to serve metrics on %s: %v", *metricsListen, err)
+		}
+		go func() {
+			if err := http.Serve(metrics, MetricsHandler(h)); err != nil {
+				fmt.Printf("Failed to serve metrics on %s: %v\n", *metricsListen, err)
+			}
+		}()
+	}
+
+	var root http.Handler = h
+	var listenerTLS *tls.Config
+	if *listenCert != "" || *sniRoutes != "" {
+		var defaultCertificate *KeyPair
+		if *listenCert != "" {
+			defaultCertificate, err = LoadKeyPair(*listenCert, *listenKey)
+			if err != nil {
+				fatalf("Failed to load certificate %s: %v", *listenCert, err)
+			}
+		}
+		var routes []*SNIRoute
+		if *sniRoutes != "" {
+			routes, err = LoadSNIRoutes(*sniRoutes)
+			if err != nil {
+				fatalf("Failed to load SNI routes from %s: %v", *sniRoutes, err)
+			}
+		}
+		router := SNIRouter{Routes: map[string]http.Handler{}, Default: h}
+		for _, r := range routes {
+			// each route is a service of its own, only the session cache and the
+			// reporting are shared
+			routed := h
+			routed.Target, routed.Alternative = r.A, strings.Split(r.B, ",")[0]
+			routed.TargetDialer = newProductionDialer(r.A)
+			routed.AlternativeDialer = newAlternativeDialer(strings.Split(r.B, ","))
+			routed.Alternatives, routed.Experiments, routed.Split = nil, nil, nil
+			router.Routes[r.Host] = routed
+		}
+		root = router
+		listenerTLS = ListenerTLS(defaultCertificate, routes)
+	}
+	if *strict {
+		root = (&RequestValidator{MaxHeaderBytes: *strictHeaderBytes, MaxHeaderFields: *strictFields, Stats: h.Stats}).Wrap(root)
+	}
+
+	if *listenHTTP3 {
+		if listenerTLS == nil {
+			fatalf("-l.http3 requires -l.tls.cert or -l.sni")
+		}
+		quic, err := ListenHTTP3(*listen, listenerTLS, Recover(RejectAmbiguous(root), h.Stats))
+		if err != nil {
+			fatalf("Failed to serve HTTP/3 on %s: %v", *listen, err)
+		}
+		defer quic.Close()
+		_, port, _ := net.SplitHostPort(*listen)
+		advertised := HeaderRule{Prefix: "/", Name: "Alt-Svc", Value: fmt.Sprintf("h3=\":%s\"; ma=86400", port)}
+		responseHeaders = append(HeaderRules{advertised}, responseHeaders...) // -response.header may override it
+	}
+
+	if *runAsUser != "" {
+		if err := DropPrivileges(*runAsUser); err != nil {
+			fatalf("Failed to switch to user %s: %v", *runAsUser, err)
+		}
+		fmt.Printf("Running as %s\n", *runAsUser)
+	}
+
+	server := &http.Server{Handler: Recover(RejectAmbiguous(root), h.Stats), ConnContext: GuardContext}
+	pipeDone := make(chan struct{})
+	if *pipeFrom != "" {
+		pipe, err := OpenPipe(*pipeFrom)
+		if err != nil {
+			fatalf("Failed to open %s: %v", *pipeFrom, err)
+		}
+		var checkpoint *Checkpoint
+		if *pipeCheckpoint != "" {
+			if checkpoint, err = LoadCheckpoint(*pipeCheckpoint); err != nil {
+				fatalf("Failed to read -pipe.checkpoint: %v", err)
+			}
+		}
+		go func() {
+			defer close(pipeDone)
+			defer pipe.Close()
+			requests := RawRequests(pipe)
+			if *pipeFormat == "gor" {
+				requests = GoReplayRequests(pipe)
+			}
+			if err := ServePipe(requests, Recover(root, h.Stats), checkpoint, pipeLanes); err != nil {
+				fmt.Printf("Stopped reading %s: %v\n", *pipeFrom, err)
+			}
+		}()
+	} else {
+		listener := local
+		if listenerTLS != nil {
+			listener = tls.NewListener(local, listenerTLS)
+		}
+		go func() {
+			if err := server.Serve(GuardListener(listener)); err != http.ErrServerClosed {
+				fmt.Printf("Failed to serve on %s: %v\n", *listen, err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	dumps := make(chan os.Signal, 1)
+	notifyDump(dumps)
+	go func() {
+		for range dumps {
+			DumpState(os.Stdout, h)
+		}
+	}()
+
+	// Serve until interrupted or the bounded run is over
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	notifyService(signals, dumps)
+	var deadline <-chan time.Time
+	if *runDuration > 0 {
+		deadline = time.After(*runDuration)
+	}
+	bounded := false
+	select {
+	case <-signals:
+	case <-deadline:
+		bounded = true
+	case <-h.Stats.Done:
+		bounded = true
+	case <-pipeDone:
+		bounded = true
+	}
+	h.Stats.Drain(server, productionRoutes.LongestTimeout(time.Duration(*productionTimeout)*time.Second)+alternateRoutes.LongestTimeout(*altDeadline))
+	if h.Diffs != nil {
+		if err := h.Diffs.Close(); err != nil {
+			fmt.Printf("Failed to write diff output: %v\n", err)
+		}
+	}
+	if h.Records != nil {
+		if err := h.Records.Close(); err != nil {
+			fmt.Printf("Failed to close record store: %v\n", err)
+		}
+	}
+	if h.Stats.Digest != nil {
+		digestSink.Flush(h.Stats.Digest) // the period cut short
+	}
+	if *metricsFile != "" || *metricsPush != "" {
+		export := MetricsExport{File: *metricsFile, Push: *metricsPush, Job: *metricsPushJob}
+		if err := export.Export(h); err != nil {
+			fmt.Printf("Failed to export the metrics: %v\n", err)
+		}
+	}
+	if !bounded {
+		return
+	}
+	fmt.Println(h.Stats.Summary())
+	violations := h.Stats.Violations(*gateMatch, *gateErrors, *gateLatency)
+	for _, v := range violations {
+		fmt.Println("FAIL:", v)
+	}
+	if len(violations) > 0 {
+		os.Exit(1)
+	}
+}
+
+type nopCloser struct {
+	io.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+func FindCookie(resp *http.Response, cookieName string) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if strings.EqualFold(c.Name, cookieName) {
+			return c
+		}
+	}
+	return nil
+}
+
+// BodyAllowed reports whether a response with status to a request with
+// method has a body. Content-Length and other headers of responses without
+// one still describe the representation and are passed on.
+func BodyAllowed(method string, status int) bool {
+	return method != "HEAD" && status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// BufferBody writes the body to w while holding on to at most -body.limit
+// bytes of it, spooled as described for Spool. If the body turns out to be
+// larger the remainder is streamed straight through, nil is returned and
+// streamed is true. release must be called once buffered is not used anymore.
+// An error reading the body or writing it to w leaves w with part of it only.
+func BufferBody(w io.Writer, body io.Reader) (buffered []byte, release func(), streamed bool, err error) {
+	if *bodyLimit <= 0 {
+		buffered, release, err = Spool(io.TeeReader(body, w))
+		return buffered, release, false, err
+	}
+	buffered, release, err = Spool(io.TeeReader(io.LimitReader(body, *bodyLimit+1), w))
+	if err != nil || int64(len(buffered)) <= *bodyLimit {
+		return buffered, release, false, err
+	}
+	release()
+	_, err = io.Copy(w, body)
+	return nil, func() {}, true, err
+}
+
+// DrainBody reads what is left of a response body, up to -b.drain bytes, and
+// closes it. For bodies that are larger the connection is closed instead,
+// as reading them would cost more than the connection is worth.
+func DrainBody(body io.ReadCloser) {
+	io.CopyN(ioutil.Discard, body, *altDrain)
+	body.Close()
+}
+
+// BackendVersion returns the build version a backend reported in the header
+// configured with -version.header, or an empty string if none was reported.
+func BackendVersion(resp *http.Response) string {
+	if *versionHeader == "" {
+		return ""
+	}
+	return resp.Header.Get(*versionHeader)
+}
+
+func DuplicateRequest(request *http.Request) (request1 *http.Request, request2 *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	b1 := bytes.NewReader(body)
+	b2 := bytes.NewReader(body)
+
+	// the original body is consumed, let later readers get a copy
+	request.GetBody = func() (io.ReadCloser, error) {
+		return nopCloser{bytes.NewReader(body)}, nil
+	}
+
+	// create separate headers because we want to modify them later
+	header1 := http.Header{}
+	header2 := http.Header{}
+	for k, v := range request.Header {
+		values1 := make([]string, len(v))
+		copy(values1, v)
+		header1[k] = values1
+		values2 := make([]string, len(v))
+		copy(values2, v)
+		header2[k] = values2
+	}
+
+	request1 = &http.Request{
+		Method:        request.Method,
+		URL:           request.URL,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header1,
+		Body:          nopCloser{b1},
+		GetBody:       request.GetBody,
+		Host:          request.Host,
+		ContentLength: request.ContentLength,
+	}
+	request2 = &http.Request{
+		Method:        request.Method,
+		URL:           request.URL,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header2,
+		Body:          nopCloser{b2},
+		GetBody:       request.GetBody,
+		Host:          request.Host,
+		ContentLength: request.ContentLength,
+	}
+	return
+}
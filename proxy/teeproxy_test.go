@@ -0,0 +1,1003 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// seedRequests are raw requests covering the edge cases hand-rolled HTTP
+// handling has broken on before
+var seedRequests = []string{
+	"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	"POST /form HTTP/1.1\r\nHost: example.com\r\nContent-Length: 7\r\n\r\na=1&b=2",
+	// zero-length chunked body
+	"POST /chunked HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	"POST /chunked HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\nTrailer: x\r\n\r\n",
+	// weird header encodings
+	"GET / HTTP/1.1\r\nHost: example.com\r\nX-Utf8: gr\xc3\xbc\xc3\x9fe\r\nX-Latin1: gr\xfc\xdfe\r\n\r\n",
+	"GET / HTTP/1.1\r\nHost: example.com\r\nX-Folded: a\r\n b\r\n\r\n",
+	"GET / HTTP/1.1\r\nHost: example.com\r\nX-Empty:\r\nX-Dup: 1\r\nx-dup: 2\r\n\r\n",
+	// malformed cookies
+	"GET / HTTP/1.1\r\nHost: example.com\r\nCookie: PHPSESSID\r\n\r\n",
+	"GET / HTTP/1.1\r\nHost: example.com\r\nCookie: PHPSESSID=\"unterminated\r\n\r\n",
+	"GET / HTTP/1.1\r\nHost: example.com\r\nCookie: ;;; =x; PHPSESSID=a; PHPSESSID=b\r\n\r\n",
+	"GET / HTTP/1.1\r\nHost: example.com\r\nCookie: PHPSESSID=\xff\xfe\r\n\r\n",
+}
+
+func readRequest(raw []byte) (*http.Request, []byte, bool) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, nil, false
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, nil, false
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:1234"
+	return req, body, true
+}
+
+func FuzzDuplicateRequest(f *testing.F) {
+	for _, raw := range seedRequests {
+		f.Add([]byte(raw))
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		req, body, ok := readRequest(raw)
+		if !ok {
+			t.Skip()
+		}
+		header := req.Header.Clone()
+
+		request1, request2 := DuplicateRequest(req)
+		for i, r := range []*http.Request{request1, request2} {
+			got, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatalf("request%d: reading body: %v", i+1, err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Fatalf("request%d: body %q, want %q", i+1, got, body)
+			}
+			if !reflect.DeepEqual(r.Header, header) {
+				t.Fatalf("request%d: header %v, want %v", i+1, r.Header, header)
+			}
+			if r.Method != req.Method || r.Host != req.Host || r.URL.String() != req.URL.String() {
+				t.Fatalf("request%d: %s %s %s, want %s %s %s", i+1, r.Method, r.Host, r.URL, req.Method, req.Host, req.URL)
+			}
+		}
+
+		// the duplicates must not share header storage
+		for k := range request1.Header {
+			request1.Header[k][0] = "modified"
+		}
+		if !reflect.DeepEqual(request2.Header, header) {
+			t.Fatalf("modifying request1 changed request2 header to %v", request2.Header)
+		}
+
+		// the original body stays available
+		again, err := req.GetBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadAll(again); !bytes.Equal(got, body) {
+			t.Fatalf("GetBody returned %q, want %q", got, body)
+		}
+
+		// must not panic on malformed cookies
+		req.Cookie("PHPSESSID")
+	})
+}
+
+// echoTarget answers every request with its body and reports what it received
+func echoTarget(t testing.TB, received chan<- []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("target reading body: %v", err)
+		}
+		select {
+		case received <- body:
+		default:
+		}
+		w.Write(body)
+	}))
+}
+
+func drain(received <-chan []byte) {
+	select {
+	case <-received:
+	default:
+	}
+}
+
+// FuzzHandler sends raw requests over the wire to a proxy in front of two
+// echoing targets and checks both targets get the body the client sent
+func FuzzHandler(f *testing.F) {
+	for _, raw := range seedRequests {
+		f.Add([]byte(raw))
+	}
+	productionReceived := make(chan []byte, 1)
+	alternateReceived := make(chan []byte, 1)
+	production := echoTarget(f, productionReceived)
+	defer production.Close()
+	alternate := echoTarget(f, alternateReceived)
+	defer alternate.Close()
+
+	h := handler{
+		Target:       production.Listener.Addr().String(),
+		Alternative:  alternate.Listener.Addr().String(),
+		SessionCache: cache.New(time.Minute, time.Minute),
+		Stats:        NewRunStats(0),
+	}
+	h.TargetDialer = NewFailover(0, h.Target)
+	h.AlternativeDialer = NewFailover(time.Second, h.Alternative)
+	proxy := httptest.NewServer(Recover(h, h.Stats))
+	defer proxy.Close()
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		req, body, ok := readRequest(raw)
+		if !ok || req.Method == "CONNECT" {
+			t.Skip()
+		}
+		drain(productionReceived)
+		drain(alternateReceived)
+
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write(raw); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusRequestHeaderFieldsTooLarge, http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+			t.Skip() // rejected by net/http before reaching the proxy
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, want 200", resp.StatusCode)
+		}
+		got, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading response body: %v", err)
+		}
+		if req.Method != "HEAD" && !bytes.Equal(got, body) {
+			t.Fatalf("client received %q, want %q", got, body)
+		}
+
+		for name, received := range map[string]chan []byte{"production": productionReceived, "alternate": alternateReceived} {
+			select {
+			case got := <-received:
+				if !bytes.Equal(got, body) {
+					t.Fatalf("%s received %q, want %q", name, got, body)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s received nothing", name)
+			}
+		}
+		if n := h.Stats.Panics(); n != 0 {
+			t.Fatalf("%d panics", n)
+		}
+	})
+}
+
+func FuzzParseJQ(f *testing.F) {
+	for _, source := range []string{`.a.b[0]`, `.items[] | select(.id > 1)`, `{a: .b, (.c): [1, "x"]}`, `.a |= . + 1`, `if .a then 1 else 2 end`, `×`, `.a == “x”`} {
+		f.Add(source)
+	}
+	f.Fuzz(func(t *testing.T, source string) {
+		q, err := ParseJQ(source) // must return, with an error or not
+		if err != nil {
+			return
+		}
+		q.Run(map[string]interface{}{"a": []interface{}{1.0, "x"}})
+	})
+}
+
+func TestJQ(t *testing.T) {
+	input := `{"a": {"b": 1, "c": "x"}, "items": [{"id": 2, "n": "B"}, {"id": 1, "n": "a"}], "k": "v", "t": true, "z": null}`
+	for _, c := range []struct {
+		source, want string
+	}{
+		{`.`, `[` + input + `]`},
+		{`.a.b`, `[1]`},
+		{`.["a"].c`, `["x"]`},
+		{`.items[0].id`, `[2]`},
+		{`.items[].id`, `[2,1]`},
+		{`.missing?`, `[null]`},
+		{`.a.b, .k`, `[1,"v"]`},
+		{`.a | .c`, `["x"]`},
+		{`[.a.b, .k]`, `[[1,"v"]]`},
+		{`{id: .a.b, "k": .k, t, (.k): 1}`, `[{"id":1,"k":"v","t":true,"v":1}]`},
+		{`1 + 2 * 3 - 4 / 2`, `[5]`},
+		{`"a" + "b"`, `["ab"]`},
+		{`[1] + [2]`, `[[1,2]]`},
+		{`{"a": 1} + {"b": 2}`, `[{"a":1,"b":2}]`},
+		{`.a.b == 1, .a.b != 1, .a.b < 2, .a.b >= 2`, `[true,false,true,false]`},
+		{`.t and false, .t or false`, `[false,true]`},
+		{`.z // "default"`, `["default"]`},
+		{`.a.b = 5 | .a.b`, `[5]`},
+		{`.a.b |= . + 1 | .a.b`, `[2]`},
+		{`if .t then "yes" elif .z then "maybe" else "no" end`, `["yes"]`},
+		{`if .z then 1 end`, `[` + input + `]`},
+		{`del(.a, .items, .k, .t, .z)`, `[{}]`},
+		{`.items | map(.id)`, `[[2,1]]`},
+		{`.items[] | select(.id > 1) | .n`, `["B"]`},
+		{`.a | with_entries(select(.key == "b"))`, `[{"b":1}]`},
+		{`.items | sort_by(.id) | map(.n)`, `[["a","B"]]`},
+		{`has("a"), (.items | length), (.a | keys), (.t | not)`, `[true,2,["b","c"],false]`},
+		{`.items[], empty | .id`, `[2,1]`},
+		{`.a.b | type, tostring, (tojson | fromjson)`, `["number","1",1]`},
+		{`"12" | tonumber`, `[12]`},
+		{`.a | to_entries | from_entries`, `[{"b":1,"c":"x"}]`},
+		{`[3, 1, 2] | sort, add`, `[[1,2,3],6]`},
+		{`.items[1].n | ascii_upcase, ascii_downcase`, `["A","a"]`},
+		{`env | length`, `[0]`},
+	} {
+		q, err := ParseJQ(c.source)
+		if err != nil {
+			t.Errorf("ParseJQ(%s): %v", c.source, err)
+			continue
+		}
+		var v interface{}
+		json.Unmarshal([]byte(input), &v)
+		outputs, err := q.Run(v)
+		if err != nil {
+			t.Errorf("%s: %v", c.source, err)
+			continue
+		}
+		if outputs == nil {
+			outputs = []interface{}{}
+		}
+		// numbers may come back as float64 or json.Number
+		var want bytes.Buffer
+		json.Compact(&want, []byte(c.want))
+		if got, _ := json.Marshal(outputs); string(got) != want.String() {
+			t.Errorf("%s gave %s, want %s", c.source, got, c.want)
+		}
+	}
+
+	// indexes past what an array can be padded to fail instead of running out of memory
+	for _, source := range []string{`.a[1e12] = 1`, `.a[infinite] = 1`, `.a[nan] = 1`, `.a[-1] = 1`} {
+		q, err := ParseJQ(source)
+		if err != nil {
+			t.Errorf("ParseJQ(%s): %v", source, err)
+			continue
+		}
+		if outputs, err := q.Run(map[string]interface{}{"a": []interface{}{}}); err == nil {
+			t.Errorf("%s gave %v, want an error", source, outputs)
+		}
+	}
+
+	for _, source := range []string{
+		``, `.a |`, `.[`, `{a: }`, `"unterminated`, `× 2`, `.a == “x”`, `€`, "\xff", `nosuchfunction`, `if .a then 1`, `(.a`, `input`,
+	} {
+		if _, err := ParseJQ(source); err == nil {
+			t.Errorf("ParseJQ(%s) succeeded, want an error", source)
+		}
+	}
+}
+
+func TestJSONBodiesMatch(t *testing.T) {
+	diffIgnore = IgnoreRules{{Method: "GET", Path: []string{"orders", "{id}"}, Fields: [][]string{{"updated"}}}}
+	defer func() { diffIgnore = nil }()
+	req := httptest.NewRequest("GET", "/orders/1", nil)
+	for _, c := range []struct {
+		production, alternate string
+		match                 bool
+	}{
+		{`{"id": 1, "updated": 1}`, `{"id": 1, "updated": 2}`, true},
+		{`{"id": 1, "updated": 1}`, `{"id": 2, "updated": 1}`, false},
+		// ids beyond 2^53, which a float64 would round to the same value
+		{`{"id": 9007199254740993}`, `{"id": 9007199254740992}`, false},
+		{`{"id": 12345678901234567891}`, `{"id": 12345678901234567891}`, true},
+		{`{"id": 12345678901234567891}`, `{"id": 12345678901234567890}`, false},
+		{`{"n": 1}`, `{"n": 1.0}`, true},
+		{`{"n": 1e2}`, `{"n": 100}`, true},
+		{`{"n": 1}`, `{"n": "1"}`, false},
+		{`[1, {"a": null}]`, `[1, {"a": null}]`, true},
+		{`{"id": 1} x`, `{"id": 1}`, false},
+	} {
+		if got := JSONBodiesMatch(req, []byte(c.production), []byte(c.alternate)); got != c.match {
+			t.Errorf("%s and %s matched: %v, want %v", c.production, c.alternate, got, c.match)
+		}
+	}
+}
+
+func TestRequestValidator(t *testing.T) {
+	stats := NewRunStats(0)
+	v := &RequestValidator{MaxHeaderBytes: 64, MaxHeaderFields: 3, Stats: stats}
+	passed := 0
+	handler := v.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { passed++ }))
+	for _, c := range []struct {
+		raw, reason string
+	}{
+		{"GET /a/b?c=1&d=%20 HTTP/1.1\r\nHost: example.com\r\n\r\n", ""},
+		{"GET / HTTP/1.1\r\nHost: [::1]:8080\r\n\r\n", ""},
+		{"OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n", ""},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n", RejectHeaderFields},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\nX-Long: " + strings.Repeat("x", 64) + "\r\n\r\n", RejectHeaderBytes},
+		{"GET / HTTP/1.1\r\n\r\n", RejectHost},
+		{"GET / HTTP/1.1\r\nHost: exa mple.com\r\n\r\n", RejectHost},
+		{"GET / HTTP/1.1\r\nHost: example.com:99999\r\n\r\n", RejectHost},
+		{"GET http://example.com HTTP/1.1\r\nHost: example.com\r\n\r\n", RejectPath},
+		{"GET /a%00b HTTP/1.1\r\nHost: example.com\r\n\r\n", RejectEncoding},
+		{"GET /?q=%zz HTTP/1.1\r\nHost: example.com\r\n\r\n", RejectEncoding},
+		{"GET /?q=%0a HTTP/1.1\r\nHost: example.com\r\n\r\n", RejectEncoding},
+		{"GET /?a=1;b=2 HTTP/1.1\r\nHost: example.com\r\n\r\n", RejectEncoding},
+	} {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(c.raw)))
+		if err != nil {
+			t.Fatalf("%q: %v", c.raw, err)
+		}
+		if reason, _ := v.Validate(req); reason != c.reason {
+			t.Errorf("%q rejected for %q, want %q", c.raw, reason, c.reason)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if want := map[bool]int{true: http.StatusOK, false: http.StatusBadRequest}[c.reason == ""]; w.Code != want {
+			t.Errorf("%q answered with %d, want %d", c.raw, w.Code, want)
+		}
+	}
+	if passed != 3 {
+		t.Errorf("%d requests passed, want 3", passed)
+	}
+	want := map[string]int{RejectHeaderFields: 1, RejectHeaderBytes: 1, RejectHost: 3, RejectPath: 1, RejectEncoding: 4}
+	if got := stats.Rejections(); !reflect.DeepEqual(got, want) {
+		t.Errorf("counted rejections %v, want %v", got, want)
+	}
+}
+
+func TestTenantLabels(t *testing.T) {
+	for value, want := range map[string]string{
+		"acme":         `"acme"`,
+		"a\tb €":       "\"a\tb €\"",
+		`say "hi" \o/`: `"say \"hi\" \\o/"`,
+		"two\nlines":   `"two\nlines"`,
+		"bad\xffutf8":  "\"bad\uFFFDutf8\"",
+	} {
+		if got := labelValue(value); got != want {
+			t.Errorf("labelValue(%q) = %s, want %s", value, got, want)
+		}
+	}
+
+	tenants, err := NewTenants("header:X-Tenant", 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	label := func(identity string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		if identity != "" {
+			req.Header.Set("X-Tenant", identity)
+		}
+		return tenants.Label(req)
+	}
+	if got := label(""); got != noTenant {
+		t.Errorf("no identity labeled %q, want %q", got, noTenant)
+	}
+	if got := label("acme"); got != "acme" {
+		t.Errorf("acme labeled %q", got)
+	}
+	for _, identity := range []string{"tab\tbed", strings.Repeat("x", tenantBytes+1)} {
+		if got := label(identity); got == identity || len(got) != 12 {
+			t.Errorf("%q labeled %q, want a hash", identity, got)
+		}
+	}
+	if got := label("globex"); got != otherTenant {
+		t.Errorf("tenant beyond the limit labeled %q, want %q", got, otherTenant)
+	}
+	if got := label("acme"); got != "acme" {
+		t.Errorf("acme labeled %q once the limit was reached", got)
+	}
+}
+
+func TestCookieGuardSuppress(t *testing.T) {
+	g := NewCookieGuard(time.Minute)
+	g.Observe(http.Header{"Set-Cookie": {"PHPSESSID=alt-1; Path=/; HttpOnly", "lang=en"}})
+	g.ObserveCookie("PHPSESSID", "alt-2")
+
+	production := http.Header{"Set-Cookie": {"PHPSESSID=prod-1; Path=/", "lang=en"}}
+	header := http.Header{"Set-Cookie": {"PHPSESSID=prod-1; Path=/; Domain=example.com", "PHPSESSID=alt-1; Path=/", "lang=en", "PHPSESSID=alt-2"}}
+	if n := g.Suppress(header, production); n != 2 {
+		t.Errorf("suppressed %d cookies, want 2", n)
+	}
+	want := []string{"PHPSESSID=prod-1; Path=/; Domain=example.com", "lang=en"}
+	if !reflect.DeepEqual(header["Set-Cookie"], want) {
+		t.Errorf("kept %q, want %q", header["Set-Cookie"], want)
+	}
+
+	header = http.Header{"Set-Cookie": {"PHPSESSID=alt-1"}}
+	if n := g.Suppress(header, http.Header{}); n != 1 || len(header["Set-Cookie"]) != 0 {
+		t.Errorf("suppressed %d cookies leaving %q, want 1 leaving none", n, header["Set-Cookie"])
+	}
+
+	var none *CookieGuard
+	none.Observe(production)
+	if n := none.Suppress(production, http.Header{}); n != 0 {
+		t.Errorf("nil guard suppressed %d cookies", n)
+	}
+}
+
+// cookieTarget answers with the Set-Cookie headers given and reports the
+// cookies it received
+func cookieTarget(received chan<- string, setCookies ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, c := range setCookies {
+			w.Header().Add("Set-Cookie", c)
+		}
+		io.WriteString(w, "ok")
+		received <- req.Header.Get("Cookie")
+	}))
+}
+
+// TestAlternateCookiesIsolated checks the invariant that cookies set by the
+// alternate target never reach the client, also when something puts them on
+// the response to it
+func TestAlternateCookiesIsolated(t *testing.T) {
+	productionReceived, alternateReceived := make(chan string, 10), make(chan string, 10)
+	production := cookieTarget(productionReceived, "PHPSESSID=prod-1; Path=/")
+	defer production.Close()
+	alternate := cookieTarget(alternateReceived, "PHPSESSID=alt-1; Path=/", "shadow=yes")
+	defer alternate.Close()
+
+	h := handler{
+		Target:       production.Listener.Addr().String(),
+		Alternative:  alternate.Listener.Addr().String(),
+		SessionCache: cache.New(time.Minute, time.Minute),
+		Stats:        NewRunStats(0),
+		Cookies:      NewCookieGuard(time.Minute),
+	}
+	h.TargetDialer = NewFailover(0, h.Target)
+	h.AlternativeDialer = NewFailover(time.Second, h.Alternative)
+	proxy := httptest.NewServer(Recover(h, h.Stats))
+	defer proxy.Close()
+
+	get := func(cookie string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", proxy.URL+"/", nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		select {
+		case <-alternateReceived: // the alternate response has been seen
+		case <-time.After(2 * time.Second):
+			t.Fatal("alternate target received nothing")
+		}
+		time.Sleep(50 * time.Millisecond) // for the session to be mapped
+		return resp
+	}
+
+	want := []string{"PHPSESSID=prod-1; Path=/"}
+	if resp := get(""); !reflect.DeepEqual(resp.Header["Set-Cookie"], want) {
+		t.Fatalf("client got Set-Cookie %q, want %q", resp.Header["Set-Cookie"], want)
+	}
+	if resp := get("PHPSESSID=prod-1"); !reflect.DeepEqual(resp.Header["Set-Cookie"], want) {
+		t.Fatalf("client got Set-Cookie %q, want %q", resp.Header["Set-Cookie"], want)
+	}
+	if got := <-productionReceived; got != "" {
+		t.Errorf("production received cookie %q on the first request", got)
+	}
+	if got := <-productionReceived; got != "PHPSESSID=prod-1" {
+		t.Errorf("production received cookie %q, want the production session", got)
+	}
+	if n := h.Stats.CookieLeaks(); n != 0 {
+		t.Fatalf("%d cookie leaks suppressed without a leak", n)
+	}
+
+	// a cookie of the alternate target put on the response to the client by
+	// mistake, here by a response header rule replacing production's, is
+	// suppressed and counted
+	saved := responseHeaders
+	defer func() { responseHeaders = saved }()
+	responseHeaders = HeaderRules{{Name: "Set-Cookie", Value: "shadow=yes"}}
+	if resp := get("PHPSESSID=prod-1"); len(resp.Header["Set-Cookie"]) != 0 {
+		t.Fatalf("client got Set-Cookie %q, want none", resp.Header["Set-Cookie"])
+	}
+	if n := h.Stats.CookieLeaks(); n != 1 {
+		t.Fatalf("%d cookie leaks suppressed, want 1", n)
+	}
+}
+
+// deadAddress returns an address nothing listens on
+func deadAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+	return address
+}
+
+func TestFailover(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.RemoteAddr)
+	}))
+	defer target.Close()
+	live, dead := target.Listener.Addr().String(), deadAddress(t)
+
+	tests := []struct {
+		name      string
+		maxIdle   int
+		wantConns int // distinct connections for three requests
+	}{
+		{"connections reused", 2, 1},
+		{"connections not kept", 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFailover(time.Minute, dead, live)
+			f.DialTimeout, f.MaxIdle = time.Second, tt.maxIdle
+			remotes := map[string]bool{}
+			for i := 0; i < 3; i++ {
+				req, _ := http.NewRequest("GET", "http://example.com/", nil)
+				resp, address, err := f.Exchange(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				remote, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if address != live {
+					t.Fatalf("exchanged with %s, want the live address %s", address, live)
+				}
+				remotes[string(remote)] = true
+			}
+			if _, ok := f.HeldDown()[dead]; !ok {
+				t.Errorf("the dead address %s isn't held down", dead)
+			}
+			if len(remotes) != tt.wantConns {
+				t.Errorf("requests came on %d connections, want %d", len(remotes), tt.wantConns)
+			}
+			if tt.maxIdle > 0 && f.Open() != 1 {
+				t.Errorf("%d connections open, want the idle one", f.Open())
+			}
+		})
+	}
+}
+
+// TestExchangeAlternate checks that only what is safe to send again is
+// retried or hedged, and that the slower hedged request is dropped
+func TestExchangeAlternate(t *testing.T) {
+	savedRetries, savedHedge := *altRetries, *altHedge
+	defer func() { *altRetries, *altHedge = savedRetries, savedHedge }()
+
+	tests := []struct {
+		name         string
+		method       string
+		retries      int
+		hedge        time.Duration
+		slow         bool // the first request is answered late, else its connection fails
+		wantAttempts int
+		wantRetries  int64
+		wantHedges   int64
+		wantBody     string
+	}{
+		{"read retried", "GET", 2, 0, false, 3, 2, 0, ""},
+		{"sent write not retried", "POST", 2, 0, false, 1, 0, 0, ""},
+		{"read hedged", "GET", 0, 50 * time.Millisecond, true, 2, 0, 1, "fast"},
+		{"write not hedged", "POST", 0, 50 * time.Millisecond, true, 1, 0, 0, "slow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*altRetries, *altHedge = tt.retries, tt.hedge
+			var requests int64
+			dropped := make(chan bool, 1) // whether the slow request saw its connection closed
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				ioutil.ReadAll(req.Body)
+				first := atomic.AddInt64(&requests, 1) == 1
+				switch {
+				case !tt.slow:
+					conn, _, _ := w.(http.Hijacker).Hijack()
+					conn.Close()
+				case first:
+					select {
+					case <-req.Context().Done():
+						dropped <- true
+					case <-time.After(300 * time.Millisecond):
+						dropped <- false
+						io.WriteString(w, "slow")
+					}
+				default:
+					io.WriteString(w, "fast")
+				}
+			}))
+			defer target.Close()
+
+			h := handler{Stats: NewRunStats(0)}
+			dialer := NewFailover(0, target.Listener.Addr().String())
+			req := httptest.NewRequest(tt.method, "/", strings.NewReader("a=1"))
+			alternativeRequest, _ := http.NewRequest(tt.method, "http://example.com/", strings.NewReader("a=1"))
+			exchange := h.ExchangeAlternate(context.Background(), dialer, req, alternativeRequest)
+			defer exchange.close()
+
+			if exchange.Attempts != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", exchange.Attempts, tt.wantAttempts)
+			}
+			if n := atomic.LoadInt64(&requests); n != int64(tt.wantAttempts) {
+				t.Errorf("the target got %d requests, want %d", n, tt.wantAttempts)
+			}
+			if retries, hedges := h.Stats.Retries(); retries != tt.wantRetries || hedges != tt.wantHedges {
+				t.Errorf("%d retries and %d hedges, want %d and %d", retries, hedges, tt.wantRetries, tt.wantHedges)
+			}
+			if tt.wantBody == "" {
+				if exchange.Err == nil {
+					t.Fatal("exchange succeeded on a failing connection")
+				}
+				return
+			}
+			if exchange.Err != nil {
+				t.Fatal(exchange.Err)
+			}
+			body, _ := ioutil.ReadAll(exchange.Response.Body)
+			if string(body) != tt.wantBody {
+				t.Errorf("got the %q response, want %q", body, tt.wantBody)
+			}
+			select {
+			case closed := <-dropped:
+				if want := tt.wantBody == "fast"; closed != want {
+					t.Errorf("connection of the slow request closed: %v, want %v", closed, want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Error("the slow request wasn't dropped")
+			}
+		})
+	}
+}
+
+func TestSessionQueue(t *testing.T) {
+	q := NewSessionQueue()
+	turns := make([]*SessionTurn, 4)
+	for i := range turns {
+		turns[i] = q.Enqueue("a")
+	}
+	other := q.Enqueue("b")
+	select {
+	case <-other.Wait:
+	default:
+		t.Fatal("a request of another session waits")
+	}
+
+	passed := func(turn *SessionTurn) bool {
+		select {
+		case <-turn.Wait:
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}
+	steps := []struct {
+		done       int // turn done before the step, -1 for none
+		wantPassed []bool
+	}{
+		{-1, []bool{true, false, false, false}},
+		{2, []bool{true, false, false, false}}, // done out of order, gave up waiting
+		{0, []bool{true, true, false, false}},
+		{1, []bool{true, true, true, true}}, // and so was 2 already
+	}
+	for i, step := range steps {
+		if step.done >= 0 {
+			turns[step.done].Done()
+		}
+		for j, want := range step.wantPassed {
+			if got := passed(turns[j]); got != want {
+				t.Errorf("step %d: request %d may go: %v, want %v", i, j, got, want)
+			}
+		}
+	}
+
+	turns[3].Done()
+	turns[3].Done() // more than once
+	other.Done()
+	for deadline := time.Now().Add(time.Second); q.Len() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions left in the queue", q.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	savedSpill, savedDir := *bodySpill, *bodySpillDir
+	defer func() { *bodySpill, *bodySpillDir = savedSpill, savedDir }()
+	*bodySpillDir = t.TempDir()
+
+	tests := []struct {
+		name       string
+		spill      int64
+		size       int
+		wantMapped bool
+	}{
+		{"spilling off", 0, 100, false},
+		{"below the limit", 16, 16, false},
+		{"spilled", 16, 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*bodySpill = tt.spill
+			body := strings.Repeat("x", tt.size)
+			memoryBefore, mappedBefore := BufferedBytes()
+			data, release, err := Spool(strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != body {
+				t.Fatalf("spooled %d bytes, want the %d of the body", len(data), len(body))
+			}
+			memory, mapped := BufferedBytes()
+			wantMemory, wantMapped := int64(tt.size), int64(0)
+			if tt.wantMapped {
+				wantMemory, wantMapped = 0, int64(tt.size)
+			}
+			if memory-memoryBefore != wantMemory || mapped-mappedBefore != wantMapped {
+				t.Errorf("%d bytes buffered and %d mapped, want %d and %d", memory-memoryBefore, mapped-mappedBefore, wantMemory, wantMapped)
+			}
+			if files, _ := ioutil.ReadDir(*bodySpillDir); len(files) != 0 {
+				t.Errorf("%d spilled files left behind", len(files))
+			}
+			release()
+			release() // more than once
+			if memory, mapped := BufferedBytes(); memory != memoryBefore || mapped != mappedBefore {
+				t.Errorf("%d bytes buffered and %d mapped after the release, want %d and %d", memory, mapped, memoryBefore, mappedBefore)
+			}
+		})
+	}
+}
+
+// goReplayStream is a GoReplay file of three requests and a response
+var goReplayStream = "1 a1 1 -1\nGET /1 HTTP/1.1\r\nHost: example.com\r\n\r\n" + goReplaySeparator +
+	"2 a1 2 1\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok" + goReplaySeparator +
+	"1 b2 3 -1\nPOST /2 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\n\r\na=1" + goReplaySeparator +
+	"1 c3 4 -1\nGET /3 HTTP/1.1\r\nHost: example.com\r\n\r\n" + goReplaySeparator
+
+// TestServePipe replays a GoReplay file, resuming after the position of a
+// checkpoint
+func TestServePipe(t *testing.T) {
+	tests := []struct {
+		name     string
+		position int
+		workers  int
+		want     []string
+		wantErr  bool
+	}{
+		{"from the start", 0, 1, []string{"GET /1", "POST /2 a=1", "GET /3"}, false},
+		{"resumed", 1, 1, []string{"POST /2 a=1", "GET /3"}, false},
+		{"resumed in lanes", 1, 2, []string{"POST /2 a=1", "GET /3"}, false},
+		{"all served", 3, 1, nil, false},
+		{"position past the end", 5, 1, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "checkpoint")
+			if tt.position > 0 {
+				ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", tt.position)), 0644)
+			}
+			checkpoint, err := LoadCheckpoint(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			var served []string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				mu.Lock()
+				defer mu.Unlock()
+				served = append(served, strings.TrimSpace(req.Method+" "+req.URL.Path+" "+string(body)))
+				if req.URL.Path == "/3" && tt.workers == 1 {
+					// the requests before were acknowledged
+					if position, _ := ioutil.ReadFile(path); string(position) != "2\n" {
+						t.Errorf("position %q while serving request 3, want 2", position)
+					}
+				}
+			})
+			err = ServePipe(GoReplayRequests(strings.NewReader(goReplayStream)), handler, checkpoint, PipeLanes{Workers: tt.workers})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			sort.Strings(served)
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(served, want) {
+				t.Errorf("served %q, want %q", served, want)
+			}
+			_, statErr := os.Stat(path)
+			if finished := os.IsNotExist(statErr); finished == tt.wantErr {
+				t.Errorf("checkpoint removed: %v, want %v", finished, !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRejectAmbiguous(t *testing.T) {
+	target := httptest.NewUnstartedServer(RejectAmbiguous(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		io.WriteString(w, "ok")
+	})))
+	target.Listener = GuardListener(target.Listener)
+	target.Config.ConnContext = GuardContext
+	target.Start()
+	defer target.Close()
+
+	tests := []struct {
+		name string
+		raw  string
+		want int
+	}{
+		{"content length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc", http.StatusOK},
+		{"chunked", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", http.StatusOK},
+		{"both", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", http.StatusBadRequest},
+		{"chunked HTTP/1.0", "POST / HTTP/1.0\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", http.StatusBadRequest},
+		{"two content lengths", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", target.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			io.WriteString(conn, tt.raw)
+			responses := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(responses, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusBadRequest {
+				// what follows on the connection isn't read as a request
+				if _, err := responses.ReadByte(); err != io.EOF {
+					t.Errorf("connection left open after an ambiguous request: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestAnswerPreflight(t *testing.T) {
+	saved := *corsOrigin
+	defer func() { *corsOrigin = saved }()
+
+	tests := []struct {
+		origins string
+		origin  string
+		want    string // Access-Control-Allow-Origin
+	}{
+		{"", "https://a.example", "https://a.example"},
+		{"https://a.example, https://b.example", "https://b.example", "https://b.example"},
+		{"https://a.example, https://b.example", "https://evil.example", ""},
+		{"*", "https://evil.example", "*"},
+	}
+	for _, tt := range tests {
+		*corsOrigin = tt.origins
+		req := httptest.NewRequest("OPTIONS", "/", nil)
+		req.Header.Set("Origin", tt.origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		w := httptest.NewRecorder()
+		AnswerPreflight(w, req)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+			t.Errorf("-cors.origin %q: origin %s allowed as %q, want %q", tt.origins, tt.origin, got, tt.want)
+		}
+		if tt.want == "" && w.Header().Get("Access-Control-Allow-Methods") != "" {
+			t.Errorf("-cors.origin %q: origin %s got the allowed methods", tt.origins, tt.origin)
+		}
+	}
+}
+
+// TestVersionLabel checks that the comparisons of each alternate build are
+// counted apart
+func TestVersionLabel(t *testing.T) {
+	stats := NewRunStats(0)
+	for _, version := range []string{"1.0", "1.0", "1.1"} {
+		stats.Finish(&Outcome{Experiment: defaultExperiment, ProductionStatus: 200, AlternateStatus: 200, Version: version, Diff: &Diff{}})
+	}
+	var metrics bytes.Buffer
+	writeLabelCounters(&metrics, "teeproxy_", "experiment", stats.Experiments())
+	for _, want := range []string{
+		`teeproxy_compared_total{experiment="` + defaultExperiment + `",version="1.0"} 2`,
+		`teeproxy_compared_total{experiment="` + defaultExperiment + `",version="1.1"} 1`,
+	} {
+		if !strings.Contains(metrics.String(), want+"\n") {
+			t.Errorf("metrics lack %s:\n%s", want, metrics.String())
+		}
+	}
+}
+
+// TestKeyPairVault checks that handshakes use the certificate fetched from
+// Vault before, and that it is kept when Vault fails
+func TestKeyPairVault(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	fields := map[string]string{
+		"cert": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		"key":  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+	var fetches int64
+	var failing int32
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "sealed", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": fields}})
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	saved := *secretsRefresh
+	defer func() { *secretsRefresh = saved }()
+	*secretsRefresh = 0 // refreshed by hand below
+
+	k, err := LoadKeyPair("vault:secret/data/tls#cert", "vault:secret/data/tls#key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := k.Certificate()
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Fatalf("%d fetches at startup, want the certificate and the key", n)
+	}
+	var handshakes sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		handshakes.Add(1)
+		go func() {
+			defer handshakes.Done()
+			if c, err := k.Certificate(); err != nil || c != first {
+				t.Errorf("got certificate %p, %v, want the one loaded", c, err)
+			}
+		}()
+	}
+	handshakes.Wait()
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Errorf("%d fetches after handshakes, want none during them", n-2)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	if c, err := k.load(); err != nil || c != first {
+		t.Errorf("refresh with Vault failing got %p, %v, want the last good certificate", c, err)
+	}
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	noTenant    = "none"  // label of requests without an identity
+	otherTenant = "other" // label of the tenants beyond the -metrics.tenants first
+	tenantBytes = 64      // longest identity used as its label, longer ones are labeled by a hash
+)
+
+// IdentitySource is where the identity of the client is taken from, one of
+// a header, a cookie or a claim of the bearer token
+type IdentitySource struct {
+	Header string
+	Cookie string
+	Claim  string // of the JWT in the Authorization header
+}
+
+// ParseIdentitySource parses a source like header:X-Api-Key, cookie:PHPSESSID or jwt:sub
+func ParseIdentitySource(source string) (IdentitySource, error) {
+	var s IdentitySource
+	kind, name, ok := strings.Cut(source, ":")
+	if !ok || name == "" {
+		return s, fmt.Errorf("want header:Name, cookie:Name or jwt:claim, got %q", source)
+	}
+	switch kind {
+	case "header":
+		s.Header = name
+	case "cookie":
+		s.Cookie = name
+	case "jwt":
+		s.Claim = name
+	default:
+		return s, fmt.Errorf("want header:Name, cookie:Name or jwt:claim, got %q", source)
+	}
+	return s, nil
+}
+
+// Identity returns the identity of the client sending req, empty if it has none
+func (s IdentitySource) Identity(req *http.Request) string {
+	switch {
+	case s.Header != "":
+		return req.Header.Get(s.Header)
+	case s.Cookie != "":
+		if c, err := req.Cookie(s.Cookie); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+	return bearerClaim(req, s.Claim)
+}
+
+// Tenants labels mirrored requests by the identity of the client for
+// metrics by customer. Only the first Max identities seen get a label of
+// their own, keeping the label cardinality bounded. Identities that are
+// longer than tenantBytes or not printable text are labeled by a hash.
+type Tenants struct {
+	Source IdentitySource
+	Hash   bool // label by a hash of the identity, for secrets like API keys
+	Max    int
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// NewTenants returns Tenants for a source as parsed by ParseIdentitySource
+func NewTenants(source string, max int, hash bool) (*Tenants, error) {
+	s, err := ParseIdentitySource(source)
+	if err != nil {
+		return nil, err
+	}
+	return &Tenants{Source: s, Hash: hash, Max: max, seen: map[string]bool{}}, nil
+}
+
+// Label returns the tenant label of req
+func (t *Tenants) Label(req *http.Request) string {
+	identity := t.Source.Identity(req)
+	if identity == "" {
+		return noTenant
+	}
+	if t.Hash || len(identity) > tenantBytes || !utf8.ValidString(identity) || strings.IndexFunc(identity, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+		sum := sha256.Sum256([]byte(identity))
+		identity = hex.EncodeToString(sum[:6])
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.seen[identity] {
+		if len(t.seen) >= t.Max {
+			return otherTenant
+		}
+		t.seen[identity] = true
+	}
+	return identity
+}
+
+// bearerClaim returns claim of the JWT in the Authorization header of req,
+// empty if there is none. The signature is not verified, the claim is only
+// used to label metrics.
+func bearerClaim(req *http.Request, claim string) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// NewUpstreamTLS returns the TLS configuration for connections to one target.
+// Connections made with it share a session cache of the given size, so
+// handshakes after the first resume the session; 0 disables resumption.
+func NewUpstreamTLS(alpn string, sessions int, insecure bool) *tls.Config {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if alpn != "" {
+		config.NextProtos = strings.Split(alpn, ",")
+	}
+	if sessions > 0 {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(sessions)
+	}
+	return config
+}
+
+// upstreamHandshake runs the TLS handshake with address over conn
+func upstreamHandshake(conn net.Conn, address string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if config.ServerName == "" {
+		config = config.Clone() // shares the session cache
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	// requests are written as HTTP/1.1 whatever else was offered
+	if protocol := tlsConn.ConnectionState().NegotiatedProtocol; protocol != "" && protocol != "http/1.1" {
+		tlsConn.Close()
+		return nil, fmt.Errorf("%s negotiated unsupported protocol %q", address, protocol)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,334 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Body encodings of transforms
+const (
+	EncodingJSON = "json"
+	EncodingForm = "form" // application/x-www-form-urlencoded
+)
+
+// BodyTransform re-encodes the bodies of matching mirrored requests for a
+// redesigned alternate API. The body, JSON or form-urlencoded, is decoded
+// into JSON, whose fields are moved, deleted and set, which is transformed
+// by the jq expression, and encoded as Encode, or as it was. Fields are
+// selected by JSONPaths like $.customer.name or $.items[0]; form fields are
+// the top-level fields, with the values of repeated fields in an array. Form
+// bodies are encoded from the top-level fields, nested ones named like
+// customer[name].
+type BodyTransform struct {
+	Name   string                 `json:"name"`
+	Method string                 `json:"method,omitempty"` // method of the requests transformed, all if empty
+	Path   string                 `json:"path,omitempty"`   // path prefix of the requests transformed
+	Encode string                 `json:"encode,omitempty"` // json or form, the encoding of the request if empty
+	Move   map[string]string      `json:"move,omitempty"`   // JSONPath of a field to its new JSONPath
+	Delete []string               `json:"delete,omitempty"` // JSONPaths of fields to remove
+	Set    map[string]interface{} `json:"set,omitempty"`    // JSONPaths of fields to their values
+	JQ     string                 `json:"jq,omitempty"`     // jq expression applied last, see JQ
+
+	moves   [][2][]string // in the order of their sources
+	deletes [][]string
+	sets    []bodyValue
+	jq      *JQ
+}
+
+// bodyValue is a value set at the steps of a JSONPath
+type bodyValue struct {
+	steps []string
+	value interface{}
+}
+
+// LoadBodyTransforms reads a JSON array of body transforms from path
+func LoadBodyTransforms(path string) ([]*BodyTransform, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var transforms []*BodyTransform
+	if err := json.NewDecoder(f).Decode(&transforms); err != nil {
+		return nil, err
+	}
+	for _, t := range transforms {
+		if t.Name == "" {
+			return nil, fmt.Errorf("body transform without a name")
+		}
+		if t.Encode != "" && t.Encode != EncodingJSON && t.Encode != EncodingForm {
+			return nil, fmt.Errorf("body transform %s: want encode json or form, got %q", t.Name, t.Encode)
+		}
+		if err := t.compile(); err != nil {
+			return nil, fmt.Errorf("body transform %s: %v", t.Name, err)
+		}
+	}
+	return transforms, nil
+}
+
+// compile parses the JSONPaths of the transform
+func (t *BodyTransform) compile() error {
+	parse := func(path string) ([]string, error) {
+		steps, err := parseJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(steps) == 0 {
+			return nil, fmt.Errorf("JSONPath %q selects the whole body", path)
+		}
+		for _, step := range steps {
+			if step == "*" {
+				return nil, fmt.Errorf("JSONPath %q must select a single field", path)
+			}
+		}
+		return steps, nil
+	}
+	sources := make([]string, 0, len(t.Move))
+	for from := range t.Move {
+		sources = append(sources, from)
+	}
+	sort.Strings(sources)
+	for _, from := range sources {
+		fromSteps, err := parse(from)
+		if err != nil {
+			return err
+		}
+		toSteps, err := parse(t.Move[from])
+		if err != nil {
+			return err
+		}
+		t.moves = append(t.moves, [2][]string{fromSteps, toSteps})
+	}
+	for _, path := range t.Delete {
+		steps, err := parse(path)
+		if err != nil {
+			return err
+		}
+		t.deletes = append(t.deletes, steps)
+	}
+	paths := make([]string, 0, len(t.Set))
+	for path := range t.Set {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		steps, err := parse(path)
+		if err != nil {
+			return err
+		}
+		t.sets = append(t.sets, bodyValue{steps: steps, value: t.Set[path]})
+	}
+	if t.JQ != "" {
+		var err error
+		if t.jq, err = ParseJQ(t.JQ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the transform applies to req
+func (t *BodyTransform) Matches(req *http.Request) bool {
+	return (t.Method == "" || strings.EqualFold(t.Method, req.Method)) && strings.HasPrefix(req.URL.Path, t.Path)
+}
+
+// TransformBody transforms the body of req, which is about to be sent to the
+// alternate target, with the first of transforms matching it. Bodies that
+// are neither JSON nor form-urlencoded are left as they are.
+func TransformBody(transforms []*BodyTransform, req *http.Request) error {
+	var t *BodyTransform
+	for _, candidate := range transforms {
+		if candidate.Matches(req) {
+			t = candidate
+			break
+		}
+	}
+	if t == nil || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	var v interface{}
+	encoding := t.Encode
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return err
+		}
+		v = formJSON(form)
+		if encoding == "" {
+			encoding = EncodingForm
+		}
+	case strings.Contains(mediaType, "json"):
+		if err := json.Unmarshal(body, &v); err != nil {
+			return err
+		}
+		if encoding == "" {
+			encoding = EncodingJSON
+		}
+	default:
+		return nil
+	}
+	if v, err = t.transform(v); err != nil {
+		return err
+	}
+
+	contentType := "application/json"
+	if encoding == EncodingForm {
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: a form can only be encoded from an object", t.Name)
+		}
+		body, contentType = []byte(jsonForm(fields).Encode()), "application/x-www-form-urlencoded"
+	} else if body, err = json.Marshal(v); err != nil {
+		return err
+	}
+	if (encoding == EncodingForm) != (mediaType == "application/x-www-form-urlencoded") {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// transform moves, deletes and sets the fields of v, in this order, and
+// runs the jq expression on the result
+func (t *BodyTransform) transform(v interface{}) (interface{}, error) {
+	for _, move := range t.moves {
+		if value, ok := jsonDelete(v, move[0]); ok {
+			v = jsonSet(v, move[1], value)
+		}
+	}
+	for _, steps := range t.deletes {
+		jsonDelete(v, steps)
+	}
+	for _, set := range t.sets {
+		v = jsonSet(v, set.steps, set.value)
+	}
+	if t.jq != nil {
+		return t.jq.RunOne(v)
+	}
+	return v, nil
+}
+
+// jsonDelete removes the field at steps from v and returns its value
+func jsonDelete(v interface{}, steps []string) (interface{}, bool) {
+	for i, step := range steps {
+		last := i == len(steps)-1
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, ok := node[step]
+			if !ok {
+				return nil, false
+			}
+			if last {
+				delete(node, step)
+				return child, true
+			}
+			v = child
+		case []interface{}:
+			n, err := strconv.Atoi(step)
+			if err != nil || n < 0 || n >= len(node) {
+				return nil, false
+			}
+			if last {
+				// elements are set to null, not removed, to keep the others in place
+				child := node[n]
+				node[n] = nil
+				return child, true
+			}
+			v = node[n]
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// jsonSet sets the field at steps of v to value, creating the objects and
+// arrays on the way, and returns v, replaced if it was no object or array.
+// Arrays are padded with nulls up to an index.
+func jsonSet(v interface{}, steps []string, value interface{}) interface{} {
+	if len(steps) == 0 {
+		return value
+	}
+	step, rest := steps[0], steps[1:]
+	node, isArray := v.([]interface{})
+	if n, err := strconv.Atoi(step); err == nil && n >= 0 && (isArray || v == nil) {
+		for len(node) <= n {
+			node = append(node, nil)
+		}
+		node[n] = jsonSet(node[n], rest, value)
+		return node
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		fields = map[string]interface{}{}
+	}
+	fields[step] = jsonSet(fields[step], rest, value)
+	return fields
+}
+
+// formJSON returns form as a JSON object, with the values of repeated fields
+// in an array
+func formJSON(form url.Values) map[string]interface{} {
+	v := make(map[string]interface{}, len(form))
+	for name, values := range form {
+		if len(values) == 1 {
+			v[name] = values[0]
+			continue
+		}
+		array := make([]interface{}, len(values))
+		for i, value := range values {
+			array[i] = value
+		}
+		v[name] = array
+	}
+	return v
+}
+
+// jsonForm returns the fields of a JSON object as a form. Arrays become
+// repeated fields and nested objects fields named like parent[child].
+func jsonForm(fields map[string]interface{}) url.Values {
+	form := url.Values{}
+	var add func(name string, v interface{})
+	add = func(name string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, child := range v {
+				add(name+"["+key+"]", child)
+			}
+		case []interface{}:
+			for _, element := range v {
+				add(name, element)
+			}
+		case nil:
+			form.Add(name, "")
+		case string:
+			form.Add(name, v)
+		default:
+			encoded, _ := json.Marshal(v)
+			form.Add(name, string(encoded))
+		}
+	}
+	for name, v := range fields {
+		add(name, v)
+	}
+	return form
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Reasons requests are rejected for by -strict, the labels of
+// teeproxy_rejected_requests_total
+const (
+	RejectHeaderBytes  = "header_bytes"
+	RejectHeaderFields = "header_fields"
+	RejectHost         = "host"
+	RejectPath         = "path"
+	RejectEncoding     = "url_encoding"
+)
+
+// RequestValidator rejects requests net/http accepts but that backends
+// behind stricter parsers may read differently or refuse, before they reach
+// either target: requests without a valid Host, paths that aren't absolute
+// or hide control characters and NULs in percent encodings, malformed
+// percent encodings in the path or the query, and headers larger than the
+// limits.
+type RequestValidator struct {
+	MaxHeaderBytes  int // names and values summed up, 0 for no limit
+	MaxHeaderFields int // 0 for no limit
+	Stats           *RunStats
+}
+
+// Wrap answers the requests v rejects with 400 Bad Request naming the reason
+// and passes the others on to next; next alone for a nil RequestValidator
+func (v *RequestValidator) Wrap(next http.Handler) http.Handler {
+	if v == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if reason, err := v.Validate(req); err != nil {
+			v.Stats.Reject(reason)
+			fmt.Printf("Rejected request from %s: %v\n", req.RemoteAddr, err)
+			http.Error(w, "malformed request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Validate returns why req is rejected, as one of the Reject reasons and an
+// error describing it, or a nil error
+func (v *RequestValidator) Validate(req *http.Request) (string, error) {
+	if v.MaxHeaderFields > 0 || v.MaxHeaderBytes > 0 {
+		fields, size := 0, 0
+		for name, values := range req.Header {
+			fields += len(values)
+			for _, value := range values {
+				size += len(name) + len(value)
+			}
+		}
+		if v.MaxHeaderFields > 0 && fields > v.MaxHeaderFields {
+			return RejectHeaderFields, fmt.Errorf("%d header fields, at most %d are allowed", fields, v.MaxHeaderFields)
+		}
+		if v.MaxHeaderBytes > 0 && size > v.MaxHeaderBytes {
+			return RejectHeaderBytes, fmt.Errorf("header of %d bytes, at most %d are allowed", size, v.MaxHeaderBytes)
+		}
+	}
+	if err := validHost(req.Host); err != nil {
+		return RejectHost, err
+	}
+	if req.Method == http.MethodConnect || req.Method == http.MethodOptions && req.RequestURI == "*" {
+		return "", nil
+	}
+	path := req.URL.EscapedPath()
+	if !strings.HasPrefix(path, "/") {
+		return RejectPath, fmt.Errorf("path %q is not absolute", path)
+	}
+	for _, part := range []struct{ name, escaped string }{{"path", path}, {"query", req.URL.RawQuery}} {
+		unescaped, err := url.PathUnescape(part.escaped)
+		if err != nil {
+			return RejectEncoding, fmt.Errorf("%s: %v", part.name, err)
+		}
+		if strings.IndexFunc(unescaped, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+			return RejectEncoding, fmt.Errorf("%s has encoded control characters", part.name)
+		}
+	}
+	if _, err := url.ParseQuery(req.URL.RawQuery); err != nil {
+		return RejectEncoding, fmt.Errorf("query: %v", err)
+	}
+	return "", nil
+}
+
+// validHost checks that host is a host name or IP address, optionally with
+// a port
+func validHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("no host")
+	}
+	name := host
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("host %q has an invalid port", host)
+		}
+		name = h
+	}
+	if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+		name = name[1 : len(name)-1]
+	}
+	if net.ParseIP(name) != nil {
+		return nil
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("host %q is no valid host name", host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("host %q is no valid host name", host)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+	runtimedebug "runtime/debug"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X teeproxy/proxy.version=1.2.3 -X teeproxy/proxy.commit=$(git rev-parse HEAD) -X teeproxy/proxy.buildDate=$(date -u +%FT%TZ)"
+//
+// The commit and build date are taken from the VCS information Go embeds if
+// they are not set.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+func init() {
+	info, ok := runtimedebug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && commit == "":
+			commit = setting.Value
+		case setting.Key == "vcs.time" && buildDate == "":
+			buildDate = setting.Value
+		}
+	}
+}
+
+// BuildInfo describes the running binary, as served on /version of the admin API
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Build returns the build information of the running binary
+func Build() BuildInfo {
+	return BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+}
+
+func (b BuildInfo) String() string {
+	s := "teeproxy " + b.Version
+	if b.Commit != "" {
+		s += fmt.Sprintf(", commit %s", b.Commit)
+	}
+	if b.BuildDate != "" {
+		s += fmt.Sprintf(", built %s", b.BuildDate)
+	}
+	return s + " with " + b.GoVersion
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+type warmConn struct {
+	net.Conn
+	address string
+	dialed  time.Time
+}
+
+// Prewarm keeps n connections dialed ahead for Dial to take, so requests
+// don't pay for the TCP and TLS handshakes. Connections idle for longer
+// than maxAge are replaced, as the target may have closed them by then, as
+// are connections past the IdleTimeout or MaxLifetime of f.
+func (f *Failover) Prewarm(n int, maxAge, timeout time.Duration) {
+	f.warm = make(chan warmConn, n)
+	f.taken = make(chan struct{}, 1)
+	for _, limit := range []time.Duration{f.IdleTimeout, f.MaxLifetime} {
+		if limit > 0 && limit < maxAge {
+			maxAge = limit
+		}
+	}
+	f.maxAge = maxAge
+	go f.keepWarm(timeout)
+}
+
+// Warm returns the number of warm connections ready to be taken
+func (f *Failover) Warm() int {
+	return len(f.warm)
+}
+
+// takeWarm returns a warm connection that is not too old and when it was
+// dialed, if there is one
+func (f *Failover) takeWarm() (net.Conn, string, time.Time, bool) {
+	if f.warm == nil {
+		return nil, "", time.Time{}, false
+	}
+	for {
+		select {
+		case c := <-f.warm:
+			select {
+			case f.taken <- struct{}{}:
+			default:
+			}
+			if time.Since(c.dialed) > f.maxAge {
+				c.Close()
+				continue
+			}
+			return c.Conn, c.address, c.dialed, true
+		default:
+			return nil, "", time.Time{}, false
+		}
+	}
+}
+
+// keepWarm refills the warm connections whenever one was taken and replaces
+// the old ones periodically
+func (f *Failover) keepWarm(timeout time.Duration) {
+	refresh := time.NewTicker(f.maxAge / 2)
+	defer refresh.Stop()
+	for {
+		for len(f.warm) < cap(f.warm) {
+			conn, address, err := f.dial(context.Background(), timeout)
+			if err != nil {
+				break // retried on the next refresh
+			}
+			select {
+			case f.warm <- warmConn{Conn: conn, address: address, dialed: time.Now()}:
+			default:
+				conn.Close()
+			}
+		}
+		select {
+		case <-f.taken:
+		case <-refresh.C:
+			f.dropStale()
+		}
+	}
+}
+
+// dropStale closes the warm connections that would be too old before the next refresh
+func (f *Failover) dropStale() {
+	for i := cap(f.warm); i > 0; i-- {
+		select {
+		case c := <-f.warm:
+			if time.Since(c.dialed) > f.maxAge/2 {
+				c.Close()
+				continue
+			}
+			select {
+			case f.warm <- c:
+			default:
+				c.Close()
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// xmlNode is an element of a canonical XML document: names carry namespace
+// URIs instead of prefixes, attributes are sorted, namespace declarations,
+// comments and processing instructions are dropped and text is trimmed
+type xmlNode struct {
+	Name     xml.Name
+	Attrs    []xml.Attr
+	Text     string
+	Children []*xmlNode
+}
+
+// parseXML parses body into a document node holding the root element
+func parseXML(body []byte) (*xmlNode, error) {
+	doc := &xmlNode{}
+	stack := []*xmlNode{doc}
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		parent := stack[len(stack)-1]
+		switch token := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{Name: token.Name}
+			for _, attr := range token.Attr {
+				if attr.Name.Space != "xmlns" && !(attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+					node.Attrs = append(node.Attrs, attr)
+				}
+			}
+			sort.Slice(node.Attrs, func(i, j int) bool {
+				a, b := node.Attrs[i].Name, node.Attrs[j].Name
+				return a.Space < b.Space || a.Space == b.Space && a.Local < b.Local
+			})
+			parent.Children = append(parent.Children, node)
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			parent.Text += strings.TrimSpace(string(token))
+		}
+	}
+	if len(doc.Children) != 1 || doc.Text != "" {
+		return nil, errors.New("not an XML document")
+	}
+	return doc, nil
+}
+
+// xpathStep selects child elements by local name, * for all, or all
+// descendants with the // axis
+type xpathStep struct {
+	Name       string
+	Descendant bool
+}
+
+// XPathRule is a simple XPath of element steps like /Envelope/Body/*/id or
+// //timestamp, optionally ending in an attribute like //order/@created or
+// //@*. Names are matched without namespace prefixes.
+type XPathRule struct {
+	Path  string
+	Steps []xpathStep
+	Attr  string
+}
+
+// XPathRules is a flag of XPaths
+type XPathRules []*XPathRule
+
+func (r *XPathRules) String() string {
+	paths := make([]string, len(*r))
+	for i, rule := range *r {
+		paths[i] = rule.Path
+	}
+	return strings.Join(paths, ",")
+}
+
+func (r *XPathRules) Set(value string) error {
+	if !strings.HasPrefix(value, "/") {
+		return fmt.Errorf("want an absolute XPath like /a/b or //b, got %q", value)
+	}
+	rule := &XPathRule{Path: value}
+	for _, step := range strings.Split(value[1:], "/") {
+		if rule.Attr != "" {
+			return fmt.Errorf("attribute must be the last step of %q", value)
+		}
+		if step == "" {
+			if len(rule.Steps) > 0 && rule.Steps[len(rule.Steps)-1].Name == "" {
+				return fmt.Errorf("empty step in %q", value)
+			}
+			rule.Steps = append(rule.Steps, xpathStep{Descendant: true})
+			continue
+		}
+		if i := strings.IndexByte(step, ':'); i >= 0 {
+			step = step[i+1:]
+		}
+		if strings.HasPrefix(step, "@") {
+			rule.Attr = step[1:]
+			continue
+		}
+		if n := len(rule.Steps); n > 0 && rule.Steps[n-1].Name == "" {
+			rule.Steps[n-1].Name = step
+			continue
+		}
+		rule.Steps = append(rule.Steps, xpathStep{Name: step})
+	}
+	if rule.Attr != "" && len(rule.Steps) == 0 {
+		return fmt.Errorf("attribute %q needs an element, like //@%s", value, rule.Attr)
+	}
+	if n := len(rule.Steps); rule.Attr == "" && (n == 0 || rule.Steps[n-1].Name == "") {
+		return fmt.Errorf("XPath %q selects nothing", value)
+	}
+	for i := range rule.Steps {
+		if rule.Steps[i].Name == "" {
+			rule.Steps[i].Name = "*"
+		}
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// remove removes the elements or attributes the rule selects below n
+func (rule *XPathRule) remove(n *xmlNode, steps []xpathStep) {
+	step := steps[0]
+	last := len(steps) == 1
+	children := n.Children[:0]
+	for _, child := range n.Children {
+		matches := step.Name == "*" || step.Name == child.Name.Local
+		if matches && last && rule.Attr == "" {
+			continue
+		}
+		if matches && last {
+			attrs := child.Attrs[:0]
+			for _, attr := range child.Attrs {
+				if rule.Attr != "*" && rule.Attr != attr.Name.Local {
+					attrs = append(attrs, attr)
+				}
+			}
+			child.Attrs = attrs
+		} else if matches {
+			rule.remove(child, steps[1:])
+		}
+		if step.Descendant {
+			rule.remove(child, steps)
+		}
+		children = append(children, child)
+	}
+	n.Children = children
+}
+
+// isXML reports whether the response has an XML media type, like text/xml,
+// application/xml or application/soap+xml
+func isXML(res *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "text/xml" || mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml"))
+}
+
+// XMLBodiesMatch reports whether the bodies of two XML responses are the same
+// document once canonicalized and the parts selected by -diff.xml.ignore are
+// removed. Responses that are not XML don't match here.
+func XMLBodiesMatch(production *http.Response, productionBody []byte, alternate *http.Response, alternateBody []byte) bool {
+	if !isXML(production) || !isXML(alternate) {
+		return false
+	}
+	p, err := parseXML(productionBody)
+	if err != nil {
+		return false
+	}
+	a, err := parseXML(alternateBody)
+	if err != nil {
+		return false
+	}
+	for _, rule := range diffXMLIgnore {
+		rule.remove(p, rule.Steps)
+		rule.remove(a, rule.Steps)
+	}
+	return reflect.DeepEqual(p, a)
+}